@@ -0,0 +1,74 @@
+// Command logconvert converts hourly NDJSON log files, plain or gzipped, to the compact .relpb format.
+//
+//	logconvert [-out dir] [-force] path...
+//
+// Directories are walked for .log and .log.gz files. Without -out the compact file is written next to its source.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/smallhouse123/go-library/service/log"
+)
+
+func main() {
+	out := flag.String("out", "", "directory for the converted files, mirroring the layout under each path")
+	force := flag.Bool("force", false, "overwrite existing compact files")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: logconvert [-out dir] [-force] path...")
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, root := range flag.Args() {
+		err := filepath.WalkDir(root, func(src string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !log.IsLogFile(src) {
+				return nil
+			}
+
+			dst := log.CompactPath(src)
+			if *out != "" {
+				rel, err := filepath.Rel(root, dst)
+				if err != nil {
+					return err
+				}
+				if rel == "." || strings.HasPrefix(rel, "..") {
+					rel = filepath.Base(dst)
+				}
+				dst = filepath.Join(*out, rel)
+			}
+
+			if _, err := os.Stat(dst); err == nil && !*force {
+				fmt.Fprintf(os.Stderr, "skipping %s, %s exists\n", src, dst)
+				return nil
+			}
+
+			rows, err := log.ConvertFile(src, dst)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "converting %s: %v\n", src, err)
+				failed = true
+				return nil
+			}
+			fmt.Printf("%s -> %s (%d rows)\n", src, dst, rows)
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,83 @@
+// Command logq prints the events of a visitor or a user from hourly log files.
+//
+//	logq [-visitor id] [-user id] [-v] path...
+//
+// Directories are walked for .log and .log.gz files, which are read in name order, so the default file
+// names come out in time order. Files with a sidecar index are looked up through it, the rest are scanned.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/smallhouse123/go-library/service/log"
+)
+
+func main() {
+	visitorId := flag.String("visitor", "", "visitor id to look up")
+	userId := flag.String("user", "", "user id to look up")
+	verbose := flag.Bool("v", false, "report how every file was read on stderr")
+	flag.Parse()
+
+	query := log.IndexQuery{VisitorId: *visitorId, UserId: *userId}
+	if flag.NArg() == 0 || (query.VisitorId == "" && query.UserId == "") {
+		fmt.Fprintln(os.Stderr, "usage: logq [-visitor id] [-user id] [-v] path...")
+		os.Exit(2)
+	}
+
+	paths := []string{}
+	for _, root := range flag.Args() {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && log.IsLogFile(path) {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	sort.Strings(paths)
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	failed := false
+	for _, path := range paths {
+		lines := 0
+		indexed, err := log.Lookup(path, query, func(line []byte) error {
+			lines++
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			_, err := out.Write(line)
+			return err
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading %s: %v\n", path, err)
+			failed = true
+			continue
+		}
+		if *verbose {
+			mode := "scanned"
+			if indexed {
+				mode = "indexed"
+			}
+			fmt.Fprintf(os.Stderr, "%s: %d lines, %s\n", path, lines, mode)
+		}
+	}
+
+	if failed {
+		out.Flush()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,97 @@
+// Command sessionize rebuilds visitor sessions from hourly log files.
+//
+//	sessionize [-gap 30m] [-lateness 1h] [-pages page_view] [-format json|csv] [-o file] path...
+//
+// Directories are walked for .log and .log.gz files, which are read in the order of their first event.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/smallhouse123/go-library/service/log"
+	"github.com/smallhouse123/go-library/service/log/sessionize"
+)
+
+func main() {
+	gap := flag.Duration("gap", sessionize.DEFAULT_GAP, "inactivity that ends a session")
+	lateness := flag.Duration("lateness", sessionize.DEFAULT_LATENESS, "how far out of order events may arrive")
+	pages := flag.String("pages", sessionize.DEFAULT_PAGE_EVENT_TYPE, "comma separated event types counted as pages")
+	format := flag.String("format", sessionize.FORMAT_JSON, "output format, json or csv")
+	output := flag.String("o", "", "output file, stdout by default")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: sessionize [-gap 30m] [-lateness 1h] [-pages page_view] [-format json|csv] [-o file] path...")
+		os.Exit(2)
+	}
+
+	if err := run(flag.Args(), sessionize.Options{
+		Gap:            *gap,
+		Lateness:       *lateness,
+		PageEventTypes: strings.Split(*pages, ","),
+	}, *format, *output); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(roots []string, opts sessionize.Options, format, output string) error {
+	paths := []string{}
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && log.IsLogFile(path) {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	paths, err := sessionize.SortFiles(paths)
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if output != "" {
+		if out, err = os.Create(output); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	buffered := bufio.NewWriter(out)
+
+	writer, err := sessionize.NewWriter(buffered, format)
+	if err != nil {
+		return err
+	}
+
+	s := sessionize.New(opts, writer.Write)
+	for _, path := range paths {
+		if err := s.AddFile(path); err != nil {
+			return fmt.Errorf("reading %s: %v", path, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+	if skipped := s.Skipped(); skipped > 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d events without a timestamp\n", skipped)
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
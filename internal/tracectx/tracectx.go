@@ -0,0 +1,54 @@
+package tracectx
+
+import (
+	"context"
+
+	octrace "go.opencensus.io/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// SpanIds holds the hex encoded ids of a span
+type SpanIds struct {
+	TraceId string
+	SpanId  string
+	Sampled bool
+}
+
+// FromContext returns the span in ctx, OpenTelemetry spans take precedence over OpenCensus ones.
+func FromContext(ctx context.Context) (SpanIds, bool) {
+	if ids, ok := OpenTelemetry(ctx); ok {
+		return ids, true
+	}
+	return OpenCensus(ctx)
+}
+
+// OpenTelemetry returns the OpenTelemetry span in ctx, remote span contexts included.
+func OpenTelemetry(ctx context.Context) (SpanIds, bool) {
+	spanContext := oteltrace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		return SpanIds{}, false
+	}
+	return SpanIds{
+		TraceId: spanContext.TraceID().String(),
+		SpanId:  spanContext.SpanID().String(),
+		Sampled: spanContext.IsSampled(),
+	}, true
+}
+
+// OpenCensus returns the OpenCensus span in ctx, it's where the rediscensus hooks put theirs.
+func OpenCensus(ctx context.Context) (SpanIds, bool) {
+	span := octrace.FromContext(ctx)
+	if span == nil {
+		return SpanIds{}, false
+	}
+
+	spanContext := span.SpanContext()
+	if spanContext.TraceID == (octrace.TraceID{}) {
+		return SpanIds{}, false
+	}
+	return SpanIds{
+		TraceId: spanContext.TraceID.String(),
+		SpanId:  spanContext.SpanID.String(),
+		Sampled: spanContext.IsSampled(),
+	}, true
+}
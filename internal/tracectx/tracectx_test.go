@@ -0,0 +1,84 @@
+package tracectx
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/plugin/ochttp/propagation/b3"
+	octrace "go.opencensus.io/trace"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// the example ids of the W3C trace context and B3 specifications
+const (
+	w3cTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	w3cTraceId     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	w3cSpanId      = "00f067aa0ba902b7"
+	b3TraceId      = "463ac35c9f6413ad48485a3953bb6124"
+	b3SpanId       = "a2fb4a1d1a96d312"
+)
+
+func withTraceparent(ctx context.Context, traceparent string) context.Context {
+	header := http.Header{}
+	header.Set("traceparent", traceparent)
+	return propagation.TraceContext{}.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// withB3 starts an OpenCensus span continuing the B3 headers, like ochttp does
+func withB3(t *testing.T, ctx context.Context, sampled string) (context.Context, *octrace.Span) {
+	r, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.NoError(t, err)
+	r.Header.Set(b3.TraceIDHeader, b3TraceId)
+	r.Header.Set(b3.SpanIDHeader, b3SpanId)
+	r.Header.Set(b3.SampledHeader, sampled)
+
+	parent, ok := (&b3.HTTPFormat{}).SpanContextFromRequest(r)
+	require.True(t, ok)
+	ctx, span := octrace.StartSpanWithRemoteParent(ctx, "request", parent)
+	t.Cleanup(span.End)
+	return ctx, span
+}
+
+func TestOpenTelemetryFromTraceparent(t *testing.T) {
+	ids, ok := OpenTelemetry(withTraceparent(context.Background(), w3cTraceparent))
+	require.True(t, ok)
+	assert.Equal(t, SpanIds{TraceId: w3cTraceId, SpanId: w3cSpanId, Sampled: true}, ids)
+
+	ids, ok = OpenTelemetry(withTraceparent(context.Background(), "00-"+w3cTraceId+"-"+w3cSpanId+"-00"))
+	require.True(t, ok)
+	assert.False(t, ids.Sampled)
+
+	_, ok = OpenTelemetry(withTraceparent(context.Background(), "00-00000000000000000000000000000000-"+w3cSpanId+"-01"))
+	assert.False(t, ok, "an invalid trace id is ignored")
+}
+
+func TestOpenCensusFromB3(t *testing.T) {
+	ctx, span := withB3(t, context.Background(), "1")
+	ids, ok := OpenCensus(ctx)
+	require.True(t, ok)
+	assert.Equal(t, SpanIds{TraceId: b3TraceId, SpanId: span.SpanContext().SpanID.String(), Sampled: true}, ids)
+	assert.NotEqual(t, b3SpanId, ids.SpanId, "the span is a child of the remote one")
+
+	ctx, _ = withB3(t, context.Background(), "0")
+	ids, ok = OpenCensus(ctx)
+	require.True(t, ok)
+	assert.False(t, ids.Sampled)
+}
+
+func TestFromContext(t *testing.T) {
+	_, ok := FromContext(context.Background())
+	assert.False(t, ok)
+
+	ctx, _ := withB3(t, context.Background(), "1")
+	ids, ok := FromContext(ctx)
+	require.True(t, ok)
+	assert.Equal(t, b3TraceId, ids.TraceId)
+
+	// OpenTelemetry takes precedence
+	ids, ok = FromContext(withTraceparent(ctx, w3cTraceparent))
+	require.True(t, ok)
+	assert.Equal(t, w3cTraceId, ids.TraceId)
+}
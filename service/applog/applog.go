@@ -0,0 +1,196 @@
+package applog
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/smallhouse123/go-library/service/config"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	Service = fx.Provide(New)
+)
+
+const (
+	DEFAULT_LEVEL               = "info"
+	DEFAULT_ENCODING            = "json"
+	DEFAULT_SAMPLING_INITIAL    = 100
+	DEFAULT_SAMPLING_THEREAFTER = 100
+	ENCODING_JSON               = "json"
+	ENCODING_CONSOLE            = "console"
+)
+
+type Result struct {
+	fx.Out
+
+	Logger *zap.Logger
+	Levels *Levels
+}
+
+type Params struct {
+	fx.In
+
+	Lifecycle   fx.Lifecycle
+	Config      config.Config
+	Env         string `name:"environment"`
+	ServiceName string `name:"serviceName"`
+}
+
+// New builds the application logger shared by every service of the library, services take
+// a named child of it, e.g. logger.Named("redis"). It's configured by
+//
+//	APPLOG_LEVEL: debug, info, warn or error
+//	APPLOG_LEVELS: a map of component to level, e.g. {redis: debug}
+//	APPLOG_ENCODING: json or console
+//	APPLOG_SAMPLING: false disables sampling, APPLOG_SAMPLING_INITIAL and APPLOG_SAMPLING_THEREAFTER tune it
+//	APPLOG_CALLER: false drops the caller
+//	APPLOG_FIELDS: a map of static fields, added to service, pod and env
+//
+// Levels follow config reloads, and can be changed at runtime through the Levels handler.
+func New(p Params) (Result, error) {
+	rootLevel, componentLevels, err := configuredLevels(p.Config)
+	if err != nil {
+		return Result{}, err
+	}
+	levels := newLevels(rootLevel, componentLevels)
+
+	encoding := getConfigString(p.Config, "APPLOG_ENCODING", DEFAULT_ENCODING)
+	var zapConfig zap.Config
+	switch encoding {
+	case ENCODING_JSON:
+		zapConfig = zap.NewProductionConfig()
+	case ENCODING_CONSOLE:
+		zapConfig = zap.NewDevelopmentConfig()
+		zapConfig.Development = false
+		zapConfig.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
+	default:
+		return Result{}, fmt.Errorf("invalid APPLOG_ENCODING '%s', expecting %s or %s", encoding, ENCODING_JSON, ENCODING_CONSOLE)
+	}
+
+	// the core lets everything through, levelCore filters by logger name
+	zapConfig.Level = zap.NewAtomicLevelAt(zapcore.DebugLevel)
+	zapConfig.DisableCaller = !getConfigBool(p.Config, "APPLOG_CALLER", true)
+	zapConfig.Sampling = nil
+	if getConfigBool(p.Config, "APPLOG_SAMPLING", true) {
+		zapConfig.Sampling = &zap.SamplingConfig{
+			Initial:    getConfigInt(p.Config, "APPLOG_SAMPLING_INITIAL", DEFAULT_SAMPLING_INITIAL),
+			Thereafter: getConfigInt(p.Config, "APPLOG_SAMPLING_THEREAFTER", DEFAULT_SAMPLING_THEREAFTER),
+		}
+	}
+
+	fields := map[string]interface{}{}
+	if p.ServiceName != "" {
+		fields["service"] = p.ServiceName
+	}
+	if podName := os.Getenv("K8S_POD_NAME"); podName != "" {
+		fields["pod"] = podName
+	}
+	if p.Env != "" {
+		fields["env"] = p.Env
+	}
+	if val, err := p.Config.Get("APPLOG_FIELDS"); err == nil {
+		extraFields, ok := val.(map[string]interface{})
+		if !ok {
+			return Result{}, fmt.Errorf("APPLOG_FIELDS must be a map, got %T", val)
+		}
+		for key, value := range extraFields {
+			fields[key] = value
+		}
+	}
+	zapConfig.InitialFields = fields
+
+	logger, err := zapConfig.Build(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &levelCore{Core: core, levels: levels}
+	}))
+	if err != nil {
+		return Result{}, err
+	}
+
+	p.Config.OnChange(func() {
+		rootLevel, componentLevels, err := configuredLevels(p.Config)
+		if err != nil {
+			logger.Named("applog").Error("invalid levels in reloaded config, keeping the current ones", zap.Error(err))
+			return
+		}
+		levels.apply(rootLevel, componentLevels)
+	})
+
+	p.Lifecycle.Append(fx.Hook{
+		OnStop: func(ctx context.Context) error {
+			if err := logger.Sync(); err != nil {
+				// catch path stdout/stderr bug of zap package
+				// https://github.com/uber-go/zap/issues/880
+				if _, ok := err.(*os.PathError); !ok {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+
+	return Result{Logger: logger, Levels: levels}, nil
+}
+
+func configuredLevels(configService config.Config) (zapcore.Level, map[string]zapcore.Level, error) {
+	rootLevel, err := zapcore.ParseLevel(getConfigString(configService, "APPLOG_LEVEL", DEFAULT_LEVEL))
+	if err != nil {
+		return rootLevel, nil, fmt.Errorf("invalid APPLOG_LEVEL: %v", err)
+	}
+
+	componentLevels := map[string]zapcore.Level{}
+	val, err := configService.Get("APPLOG_LEVELS")
+	if err != nil {
+		return rootLevel, componentLevels, nil
+	}
+	levelMap, ok := val.(map[string]interface{})
+	if !ok {
+		return rootLevel, nil, fmt.Errorf("APPLOG_LEVELS must be a map, got %T", val)
+	}
+	for name, levelVal := range levelMap {
+		levelStr, _ := levelVal.(string)
+		level, err := zapcore.ParseLevel(levelStr)
+		if err != nil {
+			return rootLevel, nil, fmt.Errorf("invalid level of '%s' in APPLOG_LEVELS: %v", name, err)
+		}
+		componentLevels[name] = level
+	}
+
+	return rootLevel, componentLevels, nil
+}
+
+func getConfigInt(configService config.Config, key string, defaultValue int) int {
+	val, err := configService.Get(key)
+	if err != nil {
+		return defaultValue
+	}
+	if valInt, ok := val.(int); ok {
+		return valInt
+	}
+	return defaultValue
+}
+
+func getConfigBool(configService config.Config, key string, defaultValue bool) bool {
+	val, err := configService.Get(key)
+	if err != nil {
+		return defaultValue
+	}
+	if valBool, ok := val.(bool); ok {
+		return valBool
+	}
+	return defaultValue
+}
+
+func getConfigString(configService config.Config, key string, defaultValue string) string {
+	val, err := configService.Get(key)
+	if err != nil {
+		return defaultValue
+	}
+	if valStr, ok := val.(string); ok && valStr != "" {
+		return valStr
+	}
+	return defaultValue
+}
@@ -0,0 +1,263 @@
+package applog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Levels holds the level of the root logger and of every component that has its own.
+// A component is a logger name, e.g. "redis" set by logger.Named("redis"). Loggers without a level
+// of their own use the closest parent's, so "redis" also covers "redis.cluster", and the root covers the rest.
+type Levels struct {
+	mu   sync.RWMutex
+	root zap.AtomicLevel
+	// components holds every level handed out, own the components with a level of their own.
+	// The others follow the level they inherit, a handle is never dropped since loggers keep using it.
+	components map[string]zap.AtomicLevel
+	own        map[string]bool
+
+	// levels set by the config, temporary overrides revert to these
+	configuredRoot       zapcore.Level
+	configuredComponents map[string]zapcore.Level
+	reverts              map[string]*time.Timer
+}
+
+// LevelsResponse is the body served by the Levels handler
+type LevelsResponse struct {
+	Root       string            `json:"root"`
+	Components map[string]string `json:"components"`
+}
+
+func newLevels(root zapcore.Level, components map[string]zapcore.Level) *Levels {
+	l := &Levels{
+		root:       zap.NewAtomicLevelAt(root),
+		components: map[string]zap.AtomicLevel{},
+		own:        map[string]bool{},
+		reverts:    map[string]*time.Timer{},
+	}
+	l.apply(root, components)
+	return l
+}
+
+// AtomicLevel returns the level of a component, a component without a level of its own follows the one it inherits.
+// The empty name is the root logger.
+func (l *Levels) AtomicLevel(name string) zap.AtomicLevel {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if name == "" {
+		return l.root
+	}
+	if level, ok := l.components[name]; ok {
+		return level
+	}
+	level := zap.NewAtomicLevelAt(l.lookup(name).Level())
+	l.components[name] = level
+	return level
+}
+
+// Level returns the level effective for a logger name
+func (l *Levels) Level(name string) zapcore.Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.lookup(name).Level()
+}
+
+// Set changes the level of a component, the empty name is the root logger.
+// A positive revertAfter restores the configured level once it passes.
+func (l *Levels) Set(name string, level zapcore.Level, revertAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if timer, ok := l.reverts[name]; ok {
+		timer.Stop()
+		delete(l.reverts, name)
+	}
+
+	if name == "" {
+		l.root.SetLevel(level)
+	} else {
+		l.setOwn(name, level)
+	}
+	l.refresh()
+
+	if revertAfter > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(revertAfter, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			// the override may have been replaced in the meantime
+			if l.reverts[name] != timer {
+				return
+			}
+			delete(l.reverts, name)
+			l.revert(name)
+		})
+		l.reverts[name] = timer
+	}
+}
+
+// All returns the root level and the level of every component
+func (l *Levels) All() LevelsResponse {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	resp := LevelsResponse{
+		Root:       l.root.Level().String(),
+		Components: map[string]string{},
+	}
+	for name, level := range l.components {
+		resp.Components[name] = level.Level().String()
+	}
+	return resp
+}
+
+// ServeHTTP reads the levels on GET. On PUT or POST it sets the level of a component from the form values
+// component (empty for the root logger), level and the optional revert, a duration such as 10m.
+func (l *Levels) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var level zapcore.Level
+		if err := level.UnmarshalText([]byte(r.FormValue("level"))); err != nil {
+			http.Error(w, fmt.Sprintf("invalid level: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		var revertAfter time.Duration
+		if revert := r.FormValue("revert"); revert != "" {
+			var err error
+			if revertAfter, err = time.ParseDuration(revert); err != nil || revertAfter < 0 {
+				http.Error(w, fmt.Sprintf("invalid revert duration '%s'", revert), http.StatusBadRequest)
+				return
+			}
+		}
+
+		l.Set(r.FormValue("component"), level, revertAfter)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.All())
+}
+
+// apply sets the configured levels, it replaces any override since the config is the latest intent
+func (l *Levels) apply(root zapcore.Level, components map[string]zapcore.Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for name, timer := range l.reverts {
+		timer.Stop()
+		delete(l.reverts, name)
+	}
+
+	l.configuredRoot = root
+	l.configuredComponents = components
+
+	l.root.SetLevel(root)
+	// components left out of the config go back to the level they inherit
+	for name := range l.own {
+		if _, ok := components[name]; !ok {
+			delete(l.own, name)
+		}
+	}
+	for name, level := range components {
+		l.setOwn(name, level)
+	}
+	l.refresh()
+}
+
+func (l *Levels) revert(name string) {
+	if name == "" {
+		l.root.SetLevel(l.configuredRoot)
+	} else if level, ok := l.configuredComponents[name]; ok {
+		l.setOwn(name, level)
+	} else {
+		delete(l.own, name)
+	}
+	l.refresh()
+}
+
+// setOwn gives a component a level of its own, the caller must hold the lock
+func (l *Levels) setOwn(name string, level zapcore.Level) {
+	l.own[name] = true
+	if current, ok := l.components[name]; ok {
+		current.SetLevel(level)
+	} else {
+		l.components[name] = zap.NewAtomicLevelAt(level)
+	}
+}
+
+// refresh sets the components without a level of their own to the level they inherit, the caller must hold the lock
+func (l *Levels) refresh() {
+	for name, level := range l.components {
+		if !l.own[name] {
+			level.SetLevel(l.lookup(name).Level())
+		}
+	}
+}
+
+// lookup returns the level of the closest component with a level of its own, the caller must hold the lock
+func (l *Levels) lookup(name string) zap.AtomicLevel {
+	for name != "" {
+		if l.own[name] {
+			return l.components[name]
+		}
+		i := strings.LastIndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	return l.root
+}
+
+// enabled tells if the lowest of all levels allows lvl, loggers are filtered by name afterwards
+func (l *Levels) enabled(lvl zapcore.Level) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.root.Enabled(lvl) {
+		return true
+	}
+	for _, level := range l.components {
+		if level.Enabled(lvl) {
+			return true
+		}
+	}
+	return false
+}
+
+// levelCore filters entries by the level of their logger name
+type levelCore struct {
+	zapcore.Core
+	levels *Levels
+}
+
+func (c *levelCore) Enabled(lvl zapcore.Level) bool {
+	return c.levels.enabled(lvl)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{
+		Core:   c.Core.With(fields),
+		levels: c.levels,
+	}
+}
+
+func (c *levelCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.levels.Level(ent.LoggerName).Enabled(ent.Level) {
+		return ce
+	}
+	return c.Core.Check(ent, ce)
+}
@@ -0,0 +1,47 @@
+package applog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestLevelsKeepHandlesAcrossReloads(t *testing.T) {
+	l := newLevels(zapcore.InfoLevel, map[string]zapcore.Level{"redis": zapcore.DebugLevel})
+
+	redis := l.AtomicLevel("redis")
+	cluster := l.AtomicLevel("redis.cluster")
+	assert.Equal(t, zapcore.DebugLevel, redis.Level())
+	assert.Equal(t, zapcore.DebugLevel, cluster.Level())
+
+	// redis is dropped from the config, the handles loggers hold go back to the root level
+	l.apply(zapcore.WarnLevel, map[string]zapcore.Level{})
+	assert.Equal(t, zapcore.WarnLevel, redis.Level())
+	assert.Equal(t, zapcore.WarnLevel, cluster.Level())
+	assert.Equal(t, zapcore.WarnLevel, l.Level("redis.cluster"))
+
+	// and they follow the config again once redis is back
+	l.apply(zapcore.WarnLevel, map[string]zapcore.Level{"redis": zapcore.ErrorLevel})
+	assert.Equal(t, zapcore.ErrorLevel, redis.Level())
+	assert.Equal(t, zapcore.ErrorLevel, cluster.Level())
+	assert.Equal(t, redis, l.AtomicLevel("redis"))
+}
+
+func TestLevelsRevert(t *testing.T) {
+	l := newLevels(zapcore.InfoLevel, nil)
+	cluster := l.AtomicLevel("redis.cluster")
+
+	l.Set("redis", zapcore.DebugLevel, 0)
+	assert.Equal(t, zapcore.DebugLevel, cluster.Level())
+
+	l.mu.Lock()
+	l.revert("redis")
+	l.mu.Unlock()
+	assert.Equal(t, zapcore.InfoLevel, cluster.Level())
+	assert.Equal(t, zapcore.InfoLevel, l.AtomicLevel("redis").Level())
+
+	// the root level is inherited too
+	l.Set("", zapcore.ErrorLevel, 0)
+	assert.Equal(t, zapcore.ErrorLevel, cluster.Level())
+}
@@ -3,4 +3,7 @@ package config
 type Config interface {
 	// Get key value from either configMap or vault.
 	Get(key string) (interface{}, error)
+
+	// OnChange registers a listener called after the config files are reloaded with new values.
+	OnChange(listener func())
 }
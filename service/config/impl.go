@@ -1,11 +1,15 @@
 package config
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/fx"
 	"go.uber.org/zap"
@@ -13,7 +17,10 @@ import (
 )
 
 var (
-	Service = fx.Provide(New)
+	Service = fx.Options(
+		fx.Provide(New),
+		fx.Invoke(attachLogger),
+	)
 )
 
 type Impl struct {
@@ -21,33 +28,155 @@ type Impl struct {
 	configMapPath string
 	vaultPath     string
 	data          map[string]interface{}
+	mu            sync.RWMutex
+	listeners     []func()
+	sugar         *zap.SugaredLogger
+	loadErr       error
+	done          chan struct{}
+	wg            sync.WaitGroup
 }
 
 type Params struct {
 	fx.In
 
+	Lifecycle     fx.Lifecycle
 	Env           string `name:"environment"`
 	ConfigMapPath string `name:"configMapPath"`
 	VaultPath     string `name:"vaultPath"`
-	Logger        *zap.Logger
 }
 
+// LoggerParams hands the application logger to the config service. It isn't part of Params
+// because applog builds the logger from the config, so the logger is attached once both exist.
+type LoggerParams struct {
+	fx.In
+
+	Config Config
+	Logger *zap.Logger `optional:"true"`
+}
+
+const (
+	DEFAULT_RELOAD_PERIOD = 0 // seconds, reloading is off unless CONFIG_RELOAD_PERIOD is set
+)
+
 func New(p Params) Config {
 	config := make(map[string]interface{})
 
+	// the error is logged once the logger is attached
 	config, err := LoadAndMergeFiles(p.ConfigMapPath, p.VaultPath)
-	if err != nil {
-		p.Logger.Sugar().Errorf("error reading and merging files: %v", err)
-	}
 
-	return &Impl{
+	im := &Impl{
 		env:           p.Env,
 		configMapPath: p.ConfigMapPath,
 		vaultPath:     p.VaultPath,
 		data:          config,
+		loadErr:       err,
+		done:          make(chan struct{}),
+	}
+
+	// mounted ConfigMaps are updated in place, a positive CONFIG_RELOAD_PERIOD turns reloading on
+	reloadPeriod := DEFAULT_RELOAD_PERIOD
+	if val, err := im.Get("CONFIG_RELOAD_PERIOD"); err == nil {
+		if valInt, ok := val.(int); ok {
+			reloadPeriod = valInt
+		}
+	}
+	if reloadPeriod > 0 && p.Lifecycle != nil {
+		p.Lifecycle.Append(fx.Hook{
+			OnStart: func(ctx context.Context) error {
+				im.wg.Add(1)
+				go im.reloadLoop(time.Duration(reloadPeriod) * time.Second)
+				return nil
+			},
+			OnStop: func(ctx context.Context) error {
+				close(im.done)
+				im.wg.Wait()
+				return nil
+			},
+		})
+	}
+
+	return im
+}
+
+func attachLogger(p LoggerParams) {
+	if im, ok := p.Config.(*Impl); ok {
+		im.SetLogger(p.Logger)
+	}
+}
+
+// SetLogger sets the logger of the config service and logs the error of the first load, if any.
+// Errors are printed to stderr while there is no logger.
+func (im *Impl) SetLogger(logger *zap.Logger) {
+	im.mu.Lock()
+	if logger != nil {
+		im.sugar = logger.Named("config").Sugar()
+	}
+	loadErr := im.loadErr
+	im.loadErr = nil
+	im.mu.Unlock()
+
+	if loadErr != nil {
+		im.logError("error reading and merging files", loadErr)
 	}
 }
 
+func (im *Impl) logError(msg string, err error) {
+	im.mu.RLock()
+	sugar := im.sugar
+	im.mu.RUnlock()
+
+	if sugar == nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", msg, err)
+		return
+	}
+	sugar.Errorw(msg, "configMapPath", im.configMapPath, "vaultPath", im.vaultPath, "err", err)
+}
+
+func (im *Impl) reloadLoop(period time.Duration) {
+	defer im.wg.Done()
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			im.Reload()
+		case <-im.done:
+			return
+		}
+	}
+}
+
+// Reload reads the files again and notifies the listeners if anything changed.
+// The current values are kept when the files can't be read.
+func (im *Impl) Reload() {
+	config, err := LoadAndMergeFiles(im.configMapPath, im.vaultPath)
+	if err != nil {
+		im.logError("error reloading config files", err)
+		return
+	}
+
+	im.mu.Lock()
+	if reflect.DeepEqual(im.data, config) {
+		im.mu.Unlock()
+		return
+	}
+	im.data = config
+	listeners := im.listeners
+	im.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener()
+	}
+}
+
+func (im *Impl) OnChange(listener func()) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	im.listeners = append(im.listeners, listener)
+}
+
 // LoadAndMergeFiles loads all JSON or YAML files from the given paths and merges them into a single map
 func LoadAndMergeFiles(paths ...string) (map[string]interface{}, error) {
 	mergedMap := make(map[string]interface{})
@@ -114,6 +243,9 @@ func mergeMaps(dst, src map[string]interface{}) map[string]interface{} {
 }
 
 func (im *Impl) Get(key string) (interface{}, error) {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+
 	if envValue, exist := im.data[im.env]; exist {
 		if value, exist := envValue.(map[string]interface{})[key]; exist {
 			return value, nil
@@ -39,6 +39,11 @@ func (_m *Config) Get(key string) (interface{}, error) {
 	return r0, r1
 }
 
+// OnChange provides a mock function with given fields: listener
+func (_m *Config) OnChange(listener func()) {
+	_m.Called(listener)
+}
+
 // NewConfig creates a new instance of Config. It also registers a testing interface on the mock and a cleanup function to assert the mocks expectations.
 // The first argument is typically a *testing.T value.
 func NewConfig(t interface {
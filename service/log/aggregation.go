@@ -0,0 +1,193 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/smallhouse123/go-library/service/config"
+)
+
+const (
+	DEFAULT_AGGREGATE_WINDOW   = 60 // seconds
+	DEFAULT_AGGREGATE_MAX_KEYS = 10000
+)
+
+// aggregator sums the counts of counter-style user events, such as impressions, within a window.
+// Events are aggregated by logName, visitor, eventType, metadata and sample rate. The aggregated
+// event keeps the RequestCommon of the first event of the window. Events without a Count count as 1.
+type aggregator struct {
+	eventTypes map[string]struct{}
+	window     time.Duration
+	maxKeys    int
+
+	mu         sync.Mutex
+	aggregates map[aggregateKey]*aggregate
+	order      []aggregateKey
+}
+
+type aggregateKey struct {
+	logName      string
+	visitorId    string
+	eventType    string
+	metadataHash string
+	sampleRate   float64
+}
+
+type aggregate struct {
+	logName string
+	common  *RequestCommon
+	event   *UserEvent
+}
+
+func newAggregator(configService config.Config) (*aggregator, error) {
+	a := &aggregator{
+		eventTypes: map[string]struct{}{},
+		window:     time.Duration(getConfigInt(configService, "LOG_AGGREGATE_WINDOW", DEFAULT_AGGREGATE_WINDOW)) * time.Second,
+		maxKeys:    getConfigInt(configService, "LOG_AGGREGATE_MAX_KEYS", DEFAULT_AGGREGATE_MAX_KEYS),
+		aggregates: map[aggregateKey]*aggregate{},
+	}
+	if a.window <= 0 {
+		return nil, fmt.Errorf("LOG_AGGREGATE_WINDOW must be positive, got %v", a.window)
+	}
+	if a.maxKeys <= 0 {
+		return nil, fmt.Errorf("LOG_AGGREGATE_MAX_KEYS must be positive, got %d", a.maxKeys)
+	}
+
+	val, err := configService.Get("LOG_AGGREGATE_EVENT_TYPES")
+	if err != nil {
+		return a, nil
+	}
+	eventTypes, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("LOG_AGGREGATE_EVENT_TYPES must be a list, got %T", val)
+	}
+	for _, eventType := range eventTypes {
+		name, ok := eventType.(string)
+		if !ok {
+			return nil, fmt.Errorf("LOG_AGGREGATE_EVENT_TYPES must hold strings, got %T", eventType)
+		}
+		a.eventTypes[name] = struct{}{}
+	}
+
+	return a, nil
+}
+
+func (a *aggregator) enabled() bool {
+	return len(a.eventTypes) > 0
+}
+
+// add keeps the user events to aggregate and returns the event holding the rest, or nil if nothing is left.
+// Once maxKeys events are kept, events of new keys are returned as they are and full is set, so the window can be drained early.
+func (a *aggregator) add(logName string, requestEvent *RequestEvent) (rest *RequestEvent, full bool) {
+	if !a.enabled() || requestEvent == nil || len(requestEvent.UserEvents) == 0 {
+		return requestEvent, false
+	}
+
+	var common RequestCommon
+	if requestEvent.RequestCommon != nil {
+		common = *requestEvent.RequestCommon
+	}
+
+	others := make([]*UserEvent, 0, len(requestEvent.UserEvents))
+	aggregated := false
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, userEvent := range requestEvent.UserEvents {
+		if userEvent == nil {
+			continue
+		}
+		if _, ok := a.eventTypes[userEvent.EventType]; !ok {
+			others = append(others, userEvent)
+			continue
+		}
+
+		metadataHash, err := hashMetadata(userEvent.Metadata)
+		if err != nil {
+			// can't tell which events it equals to, write it as it is
+			others = append(others, userEvent)
+			continue
+		}
+
+		count := userEvent.Count
+		if count == 0 {
+			count = 1
+		}
+
+		key := aggregateKey{
+			logName:      logName,
+			visitorId:    common.VisitorId,
+			eventType:    userEvent.EventType,
+			metadataHash: metadataHash,
+			sampleRate:   userEvent.SampleRate,
+		}
+		if agg, ok := a.aggregates[key]; ok {
+			agg.event.Count += count
+			aggregated = true
+			continue
+		}
+		if len(a.aggregates) >= a.maxKeys {
+			others = append(others, userEvent)
+			full = true
+			continue
+		}
+
+		aggregated = true
+		event := *userEvent
+		event.Count = count
+		commonCopy := common
+		a.aggregates[key] = &aggregate{
+			logName: logName,
+			common:  &commonCopy,
+			event:   &event,
+		}
+		a.order = append(a.order, key)
+	}
+
+	if !aggregated {
+		return requestEvent, full
+	}
+	if len(others) == 0 {
+		return nil, full
+	}
+	return &RequestEvent{
+		RequestCommon: requestEvent.RequestCommon,
+		UserEvents:    others,
+	}, full
+}
+
+// drain closes the window and returns the aggregated events in the order they were first seen
+func (a *aggregator) drain() []*aggregate {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	aggregates := make([]*aggregate, 0, len(a.order))
+	for _, key := range a.order {
+		aggregates = append(aggregates, a.aggregates[key])
+	}
+
+	a.aggregates = map[aggregateKey]*aggregate{}
+	a.order = nil
+	return aggregates
+}
+
+// hashMetadata hashes the JSON of metadata, map keys are sorted by encoding/json so equal maps get equal hashes
+func hashMetadata(metadata map[string]interface{}) (string, error) {
+	if len(metadata) == 0 {
+		return "", nil
+	}
+
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+
+	h := fnv.New64a()
+	h.Write(metadataJSON)
+	return strconv.FormatUint(h.Sum64(), 16), nil
+}
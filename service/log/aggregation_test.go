@@ -0,0 +1,91 @@
+package log
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAggregator(t *testing.T, values map[string]interface{}) *aggregator {
+	a, err := newAggregator(newTestConfig(t, values))
+	require.NoError(t, err)
+	return a
+}
+
+func impression(visitorId string, count int) *RequestEvent {
+	return &RequestEvent{
+		RequestCommon: &RequestCommon{VisitorId: visitorId},
+		UserEvents:    []*UserEvent{{EventType: "impression", Count: count}},
+	}
+}
+
+func TestAggregatorCountsMissingCountAsOne(t *testing.T) {
+	a := newTestAggregator(t, map[string]interface{}{"LOG_AGGREGATE_EVENT_TYPES": []interface{}{"impression"}})
+
+	for _, count := range []int{0, 0, 3} {
+		rest, full := a.add("access", impression("a", count))
+		assert.Nil(t, rest)
+		assert.False(t, full)
+	}
+
+	aggregates := a.drain()
+	require.Len(t, aggregates, 1)
+	assert.Equal(t, 5, aggregates[0].event.Count)
+	assert.Empty(t, a.drain())
+}
+
+func TestAggregatorMaxKeys(t *testing.T) {
+	a := newTestAggregator(t, map[string]interface{}{
+		"LOG_AGGREGATE_EVENT_TYPES": []interface{}{"impression"},
+		"LOG_AGGREGATE_MAX_KEYS":    2,
+	})
+
+	a.add("access", impression("a", 1))
+	a.add("access", impression("b", 1))
+
+	// known keys are still merged, new ones are written as they are
+	rest, full := a.add("access", impression("a", 1))
+	assert.Nil(t, rest)
+	assert.False(t, full)
+	rest, full = a.add("access", impression("c", 1))
+	require.NotNil(t, rest)
+	assert.Equal(t, "c", rest.RequestCommon.VisitorId)
+	assert.True(t, full)
+
+	assert.Len(t, a.drain(), 2)
+}
+
+func TestAggregatesAreWrittenOnFlush(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 9, 15, 0, 0, time.UTC)}
+	im := newTestLog(t, clock, map[string]interface{}{
+		"LOG_TIMEZONE":              "UTC",
+		"LOG_FLUSH_THRESHOLD":       1,
+		"LOG_AGGREGATE_WINDOW":      3600,
+		"LOG_AGGREGATE_EVENT_TYPES": []interface{}{"impression"},
+	})
+	defer im.Close()
+
+	im.WriteLog("access", impression("a", 2))
+	im.WriteLog("access", impression("a", 0))
+	// a plain event reaches the flush threshold, the flush writes the aggregate as well
+	im.WriteLog("access", &RequestEvent{RequestCommon: &RequestCommon{VisitorId: "b"}})
+
+	path := filepath.Join(im.Dir(), "24_03_01__09.log")
+	require.Eventually(t, func() bool {
+		return exists(path) && len(readLines(t, path)) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	counts := map[string]int{}
+	for _, line := range readLines(t, path) {
+		requestEvent := &RequestEvent{}
+		require.NoError(t, json.Unmarshal([]byte(line), requestEvent))
+		for _, userEvent := range requestEvent.UserEvents {
+			counts[requestEvent.RequestCommon.VisitorId] += userEvent.Count
+		}
+	}
+	assert.Equal(t, map[string]int{"a": 3}, counts)
+}
@@ -0,0 +1,66 @@
+package log
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_TIMEZONE      = "Local" // time.Local, set LOG_TIMEZONE to UTC to bucket in UTC
+	DEFAULT_FILE_TEMPLATE = "{yy}_{mm}_{dd}__{HH}.log"
+)
+
+// Clock tells the log service what time it is, replace it to control hour bucketing in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// truncateHour returns the start of the hour t falls in, within loc.
+// time.Truncate works on absolute time, so it would be wrong for zones with a half hour offset.
+func truncateHour(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+}
+
+// eventTime returns the time an event belongs to. Events are routed by their MicroTimestamp,
+// events without one or from the future fall back to now.
+func eventTime(requestEvent *RequestEvent, now time.Time) time.Time {
+	if requestEvent == nil || requestEvent.RequestCommon == nil || requestEvent.RequestCommon.MicroTimestamp <= 0 {
+		return now
+	}
+
+	t := time.UnixMicro(int64(requestEvent.RequestCommon.MicroTimestamp * 1e3))
+	if t.After(now) {
+		return now
+	}
+	return t
+}
+
+// formatFileName expands a file template such as {logName}/{yyyy}/{mm}/{dd}/{HH}.log for the given hour
+func formatFileName(template, logName string, hour time.Time) string {
+	replacer := strings.NewReplacer(
+		"{logName}", sanitizeLogName(logName),
+		"{yyyy}", hour.Format("2006"),
+		"{yy}", hour.Format("06"),
+		"{mm}", hour.Format("01"),
+		"{dd}", hour.Format("02"),
+		"{HH}", hour.Format("15"),
+	)
+	return filepath.FromSlash(replacer.Replace(template))
+}
+
+// sanitizeLogName keeps a logName from escaping the log directory
+func sanitizeLogName(logName string) string {
+	logName = strings.NewReplacer("/", "_", "\\", "_").Replace(logName)
+	if logName == "" || logName == "." || logName == ".." {
+		return "_"
+	}
+	return logName
+}
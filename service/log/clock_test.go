@@ -0,0 +1,130 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smallhouse123/go-library/service/config/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newTestConfig returns a config holding values, other keys are not found
+func newTestConfig(t *testing.T, values map[string]interface{}) *mocks.Config {
+	cfg := mocks.NewConfig(t)
+	cfg.On("Get", mock.Anything).Return(func(key string) (interface{}, error) {
+		if val, ok := values[key]; ok {
+			return val, nil
+		}
+		return nil, errors.New("not found")
+	}).Maybe()
+	cfg.On("OnChange", mock.Anything).Maybe()
+	return cfg
+}
+
+// newTestLog returns a log service writing to a temporary directory
+func newTestLog(t *testing.T, clock Clock, values map[string]interface{}) *Impl {
+	rootDir := ROOT_DIR
+	ROOT_DIR = t.TempDir()
+	t.Cleanup(func() { ROOT_DIR = rootDir })
+	t.Setenv("K8S_POD_NAME", "")
+
+	l, err := New(Params{
+		Config: newTestConfig(t, values),
+		Logger: zap.NewNop(),
+		Clock:  clock,
+	})
+	require.NoError(t, err)
+	return l.(*Impl)
+}
+
+func readLines(t *testing.T, path string) []string {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestHourBucketingWithTimezone(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 23, 59, 0, 0, time.UTC)}
+	im := newTestLog(t, clock, map[string]interface{}{"LOG_TIMEZONE": "Asia/Taipei"})
+
+	im.WriteLog("access", &RequestEvent{RequestCommon: &RequestCommon{VisitorId: "a"}})
+	clock.Add(time.Minute)
+	im.WriteLog("access", &RequestEvent{RequestCommon: &RequestCommon{VisitorId: "b"}})
+	// a late event lands in the hour it happened in
+	late := float64(time.Date(2024, 3, 1, 23, 30, 0, 0, time.UTC).UnixMilli())
+	im.WriteLog("access", &RequestEvent{RequestCommon: &RequestCommon{VisitorId: "c", MicroTimestamp: late}})
+	im.Close()
+
+	// 23:59 UTC is 07:59 in Taipei, the next minute starts a new hour there
+	assert.Len(t, readLines(t, filepath.Join(im.Dir(), "24_03_02__07.log")), 2)
+	assert.Len(t, readLines(t, filepath.Join(im.Dir(), "24_03_02__08.log")), 1)
+}
+
+func TestDefaultTimezoneIsLocal(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	im := newTestLog(t, clock, nil)
+
+	im.WriteLog("access", &RequestEvent{RequestCommon: &RequestCommon{VisitorId: "a"}})
+	im.Close()
+
+	name := formatFileName(DEFAULT_FILE_TEMPLATE, "access", truncateHour(clock.Now(), time.Local))
+	assert.FileExists(t, filepath.Join(im.Dir(), name))
+	assert.Equal(t, time.Local, im.location)
+}
+
+func TestFileTemplate(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 9, 15, 0, 0, time.UTC)}
+	im := newTestLog(t, clock, map[string]interface{}{
+		"LOG_TIMEZONE":      "UTC",
+		"LOG_FILE_TEMPLATE": "{logName}/{yyyy}/{mm}/{dd}/{HH}.log",
+	})
+
+	im.WriteLog("../access", &RequestEvent{RequestCommon: &RequestCommon{VisitorId: "a"}})
+	im.Close()
+
+	assert.FileExists(t, filepath.Join(im.Dir(), ".._access", "2024", "03", "01", "09.log"))
+}
+
+func TestTruncateHourWithHalfHourOffset(t *testing.T) {
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	require.NoError(t, err)
+
+	// 04:10 UTC is 09:40 in Kolkata
+	hour := truncateHour(time.Date(2024, 3, 1, 4, 10, 0, 0, time.UTC), kolkata)
+	assert.Equal(t, time.Date(2024, 3, 1, 9, 0, 0, 0, kolkata), hour)
+}
+
+func TestEventTime(t *testing.T) {
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	past := now.Add(-2 * time.Hour)
+	future := now.Add(time.Hour)
+
+	assert.Equal(t, now, eventTime(&RequestEvent{}, now))
+	assert.True(t, past.Equal(eventTime(&RequestEvent{RequestCommon: &RequestCommon{MicroTimestamp: float64(past.UnixMilli())}}, now)))
+	assert.Equal(t, now, eventTime(&RequestEvent{RequestCommon: &RequestCommon{MicroTimestamp: float64(future.UnixMilli())}}, now))
+}
@@ -0,0 +1,511 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// The compact format holds one row per user event, with the RequestCommon fields repeated on every row.
+// A file starts with COMPACT_MAGIC and the length-prefixed FileDescriptorProto describing the rows,
+// followed by the length-prefixed rows encoded as COMPACT_MESSAGE protobuf messages.
+// Lengths are unsigned varints, so any protobuf runtime can read the file with the embedded schema.
+const (
+	COMPACT_SUFFIX  = ".relpb"
+	COMPACT_MAGIC   = "RELPB\x01"
+	COMPACT_PACKAGE = "smallhouse.log"
+	COMPACT_MESSAGE = "RequestEventRow"
+
+	// a row larger than this is a corrupted file rather than a real event
+	MAX_COMPACT_ROW_SIZE = 64 << 20
+)
+
+// field numbers of the row message
+const (
+	compactMicroTimestamp protowire.Number = iota + 1
+	compactVisitorId
+	compactIsNewVisitor
+	compactUserName
+	compactUserId
+	compactStatusCode
+	compactLatencyMs
+	compactTraceId
+	compactSpanId
+	compactRequestId
+	compactEventType
+	compactCount
+	compactSampleRate
+	compactMetadata
+)
+
+// CompactRow is a user event flattened with its RequestCommon. Requests without user events have a single
+// row with empty event fields. Metadata is kept as JSON, since its values have no fixed type.
+type CompactRow struct {
+	MicroTimestamp float64
+	VisitorId      string
+	IsNewVisitor   bool
+	UserName       string
+	UserId         *string
+	StatusCode     int64
+	LatencyMs      float64
+	TraceId        string
+	SpanId         string
+	RequestId      string
+	EventType      string
+	Count          int64
+	SampleRate     float64
+	Metadata       string
+}
+
+// CompactSchema returns the FileDescriptorProto embedded in every compact file
+func CompactSchema() *descriptorpb.FileDescriptorProto {
+	field := func(name string, number protowire.Number, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(int32(number)),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+		}
+	}
+
+	userId := field("userId", compactUserId, descriptorpb.FieldDescriptorProto_TYPE_STRING)
+	userId.OneofIndex = proto.Int32(0)
+	userId.Proto3Optional = proto.Bool(true)
+
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("request_event_row.proto"),
+		Package: proto.String(COMPACT_PACKAGE),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String(COMPACT_MESSAGE),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("microTimestamp", compactMicroTimestamp, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+				field("visitorId", compactVisitorId, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("isNewVisitor", compactIsNewVisitor, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+				field("userName", compactUserName, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				userId,
+				field("statusCode", compactStatusCode, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+				field("latencyMs", compactLatencyMs, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+				field("traceId", compactTraceId, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("spanId", compactSpanId, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("requestId", compactRequestId, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("eventType", compactEventType, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("count", compactCount, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+				field("sampleRate", compactSampleRate, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+				field("metadata", compactMetadata, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			},
+			OneofDecl: []*descriptorpb.OneofDescriptorProto{{
+				Name: proto.String("_userId"),
+			}},
+		}},
+	}
+}
+
+// FlattenEvent returns the rows of a request event
+func FlattenEvent(requestEvent *RequestEvent) ([]*CompactRow, error) {
+	common := &CompactRow{}
+	if requestEvent.RequestCommon != nil {
+		rc := requestEvent.RequestCommon
+		common = &CompactRow{
+			MicroTimestamp: rc.MicroTimestamp,
+			VisitorId:      rc.VisitorId,
+			IsNewVisitor:   rc.IsNewVisitor,
+			UserName:       rc.UserName,
+			UserId:         rc.UserId,
+			StatusCode:     int64(rc.StatusCode),
+			LatencyMs:      rc.LatencyMs,
+			TraceId:        rc.TraceId,
+			SpanId:         rc.SpanId,
+			RequestId:      rc.RequestId,
+		}
+	}
+
+	rows := []*CompactRow{}
+	for _, userEvent := range requestEvent.UserEvents {
+		if userEvent == nil {
+			continue
+		}
+
+		row := *common
+		row.EventType = userEvent.EventType
+		row.Count = int64(userEvent.Count)
+		row.SampleRate = userEvent.SampleRate
+		if userEvent.Metadata != nil {
+			metadataJSON, err := json.Marshal(userEvent.Metadata)
+			if err != nil {
+				return nil, err
+			}
+			row.Metadata = string(metadataJSON)
+		}
+		rows = append(rows, &row)
+	}
+
+	if len(rows) == 0 {
+		rows = append(rows, common)
+	}
+	return rows, nil
+}
+
+func (row *CompactRow) appendProto(b []byte) []byte {
+	appendDouble := func(b []byte, num protowire.Number, v float64) []byte {
+		if v == 0 {
+			return b
+		}
+		b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+		return protowire.AppendFixed64(b, math.Float64bits(v))
+	}
+	appendString := func(b []byte, num protowire.Number, v string) []byte {
+		if v == "" {
+			return b
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendString(b, v)
+	}
+	appendInt := func(b []byte, num protowire.Number, v int64) []byte {
+		if v == 0 {
+			return b
+		}
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		return protowire.AppendVarint(b, uint64(v))
+	}
+
+	b = appendDouble(b, compactMicroTimestamp, row.MicroTimestamp)
+	b = appendString(b, compactVisitorId, row.VisitorId)
+	if row.IsNewVisitor {
+		b = appendInt(b, compactIsNewVisitor, 1)
+	}
+	b = appendString(b, compactUserName, row.UserName)
+	if row.UserId != nil {
+		// optional field, an empty id is written to keep its presence
+		b = protowire.AppendTag(b, compactUserId, protowire.BytesType)
+		b = protowire.AppendString(b, *row.UserId)
+	}
+	b = appendInt(b, compactStatusCode, row.StatusCode)
+	b = appendDouble(b, compactLatencyMs, row.LatencyMs)
+	b = appendString(b, compactTraceId, row.TraceId)
+	b = appendString(b, compactSpanId, row.SpanId)
+	b = appendString(b, compactRequestId, row.RequestId)
+	b = appendString(b, compactEventType, row.EventType)
+	b = appendInt(b, compactCount, row.Count)
+	b = appendDouble(b, compactSampleRate, row.SampleRate)
+	b = appendString(b, compactMetadata, row.Metadata)
+	return b
+}
+
+func (row *CompactRow) unmarshalProto(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case typ == protowire.Fixed64Type && (num == compactMicroTimestamp || num == compactLatencyMs || num == compactSampleRate):
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			switch num {
+			case compactMicroTimestamp:
+				row.MicroTimestamp = math.Float64frombits(v)
+			case compactLatencyMs:
+				row.LatencyMs = math.Float64frombits(v)
+			case compactSampleRate:
+				row.SampleRate = math.Float64frombits(v)
+			}
+		case typ == protowire.VarintType && (num == compactIsNewVisitor || num == compactStatusCode || num == compactCount):
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			switch num {
+			case compactIsNewVisitor:
+				row.IsNewVisitor = v != 0
+			case compactStatusCode:
+				row.StatusCode = int64(v)
+			case compactCount:
+				row.Count = int64(v)
+			}
+		case typ == protowire.BytesType && num >= compactVisitorId && num <= compactMetadata:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			switch num {
+			case compactVisitorId:
+				row.VisitorId = v
+			case compactUserName:
+				row.UserName = v
+			case compactUserId:
+				row.UserId = &v
+			case compactTraceId:
+				row.TraceId = v
+			case compactSpanId:
+				row.SpanId = v
+			case compactRequestId:
+				row.RequestId = v
+			case compactEventType:
+				row.EventType = v
+			case compactMetadata:
+				row.Metadata = v
+			}
+		default:
+			// unknown fields are skipped, so files written by newer versions stay readable
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+// CompactWriter writes request events in the compact format
+type CompactWriter struct {
+	w    *bufio.Writer
+	buf  []byte
+	rows int64
+}
+
+func NewCompactWriter(w io.Writer) (*CompactWriter, error) {
+	schema, err := proto.Marshal(CompactSchema())
+	if err != nil {
+		return nil, err
+	}
+
+	cw := &CompactWriter{w: bufio.NewWriter(w)}
+	if _, err := cw.w.WriteString(COMPACT_MAGIC); err != nil {
+		return nil, err
+	}
+	if err := cw.writeBlock(schema); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// Write flattens the event and writes its rows
+func (cw *CompactWriter) Write(requestEvent *RequestEvent) error {
+	rows, err := FlattenEvent(requestEvent)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		cw.buf = row.appendProto(cw.buf[:0])
+		if err := cw.writeBlock(cw.buf); err != nil {
+			return err
+		}
+		cw.rows++
+	}
+	return nil
+}
+
+// Rows returns the number of rows written so far
+func (cw *CompactWriter) Rows() int64 {
+	return cw.rows
+}
+
+// Flush writes any buffered data to the underlying writer
+func (cw *CompactWriter) Flush() error {
+	return cw.w.Flush()
+}
+
+func (cw *CompactWriter) writeBlock(b []byte) error {
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(b)))
+	if _, err := cw.w.Write(size[:n]); err != nil {
+		return err
+	}
+	_, err := cw.w.Write(b)
+	return err
+}
+
+// CompactReader reads the rows of a compact file
+type CompactReader struct {
+	r      *bufio.Reader
+	schema *descriptorpb.FileDescriptorProto
+	buf    []byte
+}
+
+func NewCompactReader(r io.Reader) (*CompactReader, error) {
+	cr := &CompactReader{r: bufio.NewReader(r)}
+
+	magic := make([]byte, len(COMPACT_MAGIC))
+	if _, err := io.ReadFull(cr.r, magic); err != nil {
+		return nil, fmt.Errorf("failed to read compact header: %v", err)
+	}
+	if !bytes.Equal(magic, []byte(COMPACT_MAGIC)) {
+		return nil, errors.New("not a compact request event file")
+	}
+
+	schema, err := cr.readBlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compact schema: %v", err)
+	}
+	cr.schema = &descriptorpb.FileDescriptorProto{}
+	if err := proto.Unmarshal(schema, cr.schema); err != nil {
+		return nil, fmt.Errorf("invalid compact schema: %v", err)
+	}
+
+	return cr, nil
+}
+
+// Schema returns the schema embedded in the file
+func (cr *CompactReader) Schema() *descriptorpb.FileDescriptorProto {
+	return cr.schema
+}
+
+// Next returns the next row, or io.EOF after the last one
+func (cr *CompactReader) Next() (*CompactRow, error) {
+	b, err := cr.readBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	row := &CompactRow{}
+	if err := row.unmarshalProto(b); err != nil {
+		return nil, fmt.Errorf("invalid compact row: %v", err)
+	}
+	return row, nil
+}
+
+func (cr *CompactReader) readBlock() ([]byte, error) {
+	size, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		return nil, err
+	}
+	if size > MAX_COMPACT_ROW_SIZE {
+		return nil, fmt.Errorf("block of %d bytes exceeds the limit", size)
+	}
+
+	if uint64(cap(cr.buf)) < size {
+		cr.buf = make([]byte, size)
+	}
+	cr.buf = cr.buf[:size]
+	if _, err := io.ReadFull(cr.r, cr.buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return cr.buf, nil
+}
+
+// CompactPath returns the path of the compact file converted from an hourly file,
+// the .log extension, and .gz for compressed files, is replaced.
+func CompactPath(path string) string {
+	path = strings.TrimSuffix(path, COMPRESSED_SUFFIX)
+	return strings.TrimSuffix(path, LOG_SUFFIX) + COMPACT_SUFFIX
+}
+
+// ConvertFile converts an NDJSON hourly file, optionally gzipped, to the compact format at dst.
+// The file at dst only appears once it's complete.
+func ConvertFile(src, dst string) (int64, error) {
+	in, err := OpenLogFile(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	return convert(in, dst)
+}
+
+func convert(in io.Reader, dst string) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return 0, err
+	}
+	out, err := os.Create(dst + TMP_SUFFIX)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(out.Name())
+
+	cw, err := NewCompactWriter(out)
+	if err != nil {
+		out.Close()
+		return 0, err
+	}
+	if err := ReadEvents(in, func(offset int64, requestEvent *RequestEvent) error {
+		return cw.Write(requestEvent)
+	}); err != nil {
+		out.Close()
+		return 0, err
+	}
+	if err := cw.Flush(); err != nil {
+		out.Close()
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		return 0, err
+	}
+
+	return cw.Rows(), os.Rename(out.Name(), dst)
+}
+
+// exportCompact converts the entries written while the file was open. A piece of a file reopened for late
+// events gets a numbered name when the previous piece is still around, e.g. 24_01_02__03.1.relpb
+func (im *Impl) exportCompact(file ClosedFile) {
+	src, err := os.Open(file.Path)
+	if err != nil {
+		im.sugar.Errorw("failed to open closed file for compact export", "path", file.Path, "err", err)
+		return
+	}
+	defer src.Close()
+
+	if _, err := src.Seek(file.Offset, io.SeekStart); err != nil {
+		im.sugar.Errorw("failed to seek closed file for compact export", "path", file.Path, "err", err)
+		return
+	}
+
+	dst := CompactPath(file.Path)
+	for i := 1; exists(dst); i++ {
+		dst = strings.TrimSuffix(CompactPath(file.Path), COMPACT_SUFFIX) + "." + strconv.Itoa(i) + COMPACT_SUFFIX
+	}
+
+	if _, err := convert(src, dst); err != nil {
+		im.sugar.Errorw("failed to export compact file", "path", file.Path, "err", err)
+		im.metrics.BumpCount(METRIC_WRITE_ERRORS, 1, "logName", file.LogName, "op", "compact")
+	}
+}
+
+// countCompactRows returns the number of rows of a compact file
+func countCompactRows(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	cr, err := NewCompactReader(file)
+	if err != nil {
+		return 0, err
+	}
+
+	var rows int64
+	for {
+		if _, err := cr.Next(); err == io.EOF {
+			return rows, nil
+		} else if err != nil {
+			return rows, err
+		}
+		rows++
+	}
+}
@@ -0,0 +1,160 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func compactTestEvents() []*RequestEvent {
+	userId := "u-42"
+	emptyUserId := ""
+	return []*RequestEvent{
+		{
+			RequestCommon: &RequestCommon{
+				MicroTimestamp: 1709284500123456,
+				VisitorId:      "v-1",
+				IsNewVisitor:   true,
+				UserName:       "alice",
+				UserId:         &userId,
+				StatusCode:     201,
+				LatencyMs:      12.5,
+				TraceId:        "4bf92f3577b34da6a3ce929d0e0e4736",
+				SpanId:         "00f067aa0ba902b7",
+				RequestId:      "req-1",
+			},
+			UserEvents: []*UserEvent{
+				{EventType: "impression", Count: 3, SampleRate: 0.25, Metadata: map[string]interface{}{"item": "i-1"}},
+				{EventType: "click", Count: 1},
+			},
+		},
+		// no user id, and no user events
+		{RequestCommon: &RequestCommon{MicroTimestamp: 1709284500200000, VisitorId: "v-2"}},
+		// an empty user id is still present
+		{RequestCommon: &RequestCommon{MicroTimestamp: 1709284500300000, VisitorId: "v-3", UserId: &emptyUserId}},
+	}
+}
+
+// readDynamicRows reads a compact file with the protobuf runtime only, the way a reader in another language would
+func readDynamicRows(t *testing.T, data []byte) []*dynamicpb.Message {
+	r := bufio.NewReader(bytes.NewReader(data))
+	magic := make([]byte, len(COMPACT_MAGIC))
+	_, err := io.ReadFull(r, magic)
+	require.NoError(t, err)
+	require.Equal(t, COMPACT_MAGIC, string(magic))
+
+	readBlock := func() ([]byte, error) {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size)
+		_, err = io.ReadFull(r, b)
+		return b, err
+	}
+
+	schemaBytes, err := readBlock()
+	require.NoError(t, err)
+	schema := &descriptorpb.FileDescriptorProto{}
+	require.NoError(t, proto.Unmarshal(schemaBytes, schema))
+	assert.True(t, proto.Equal(CompactSchema(), schema), "the embedded schema is CompactSchema")
+
+	file, err := protodesc.NewFile(schema, nil)
+	require.NoError(t, err)
+	descriptor := file.Messages().ByName(COMPACT_MESSAGE)
+	require.NotNil(t, descriptor)
+
+	rows := []*dynamicpb.Message{}
+	for {
+		b, err := readBlock()
+		if err == io.EOF {
+			return rows
+		}
+		require.NoError(t, err)
+		row := dynamicpb.NewMessage(descriptor)
+		require.NoError(t, proto.Unmarshal(b, row))
+		assert.Empty(t, row.GetUnknown(), "every written field is in the schema")
+		rows = append(rows, row)
+	}
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	cw, err := NewCompactWriter(buf)
+	require.NoError(t, err)
+	for _, requestEvent := range compactTestEvents() {
+		require.NoError(t, cw.Write(requestEvent))
+	}
+	require.NoError(t, cw.Flush())
+	assert.EqualValues(t, 4, cw.Rows())
+
+	rows := readDynamicRows(t, buf.Bytes())
+	require.Len(t, rows, 4)
+
+	fields := rows[0].Descriptor().Fields()
+	get := func(row *dynamicpb.Message, name string) interface{} {
+		field := fields.ByName(protoreflect.Name(name))
+		require.NotNil(t, field, name)
+		return row.Get(field).Interface()
+	}
+	has := func(row *dynamicpb.Message, name string) bool {
+		return row.Has(fields.ByName(protoreflect.Name(name)))
+	}
+
+	assert.True(t, fields.ByName("userId").HasPresence(), "userId is proto3 optional")
+	for i, eventFields := range []map[string]interface{}{
+		{"eventType": "impression", "count": int64(3), "sampleRate": 0.25, "metadata": `{"item":"i-1"}`},
+		{"eventType": "click", "count": int64(1), "sampleRate": 0.0, "metadata": ""},
+	} {
+		row := rows[i]
+		assert.Equal(t, 1709284500123456.0, get(row, "microTimestamp"))
+		assert.Equal(t, "v-1", get(row, "visitorId"))
+		assert.Equal(t, true, get(row, "isNewVisitor"))
+		assert.Equal(t, "alice", get(row, "userName"))
+		assert.True(t, has(row, "userId"))
+		assert.Equal(t, "u-42", get(row, "userId"))
+		assert.Equal(t, int64(201), get(row, "statusCode"))
+		assert.Equal(t, 12.5, get(row, "latencyMs"))
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", get(row, "traceId"))
+		assert.Equal(t, "00f067aa0ba902b7", get(row, "spanId"))
+		assert.Equal(t, "req-1", get(row, "requestId"))
+		for name, want := range eventFields {
+			assert.Equal(t, want, get(row, name), name)
+		}
+	}
+
+	assert.Equal(t, "v-2", get(rows[2], "visitorId"))
+	assert.False(t, has(rows[2], "userId"), "a missing user id isn't present")
+	assert.Equal(t, "", get(rows[2], "eventType"))
+	assert.Equal(t, false, get(rows[2], "isNewVisitor"))
+
+	assert.True(t, has(rows[3], "userId"), "an empty user id is present")
+	assert.Equal(t, "", get(rows[3], "userId"))
+
+	// the reader of the package gets the same rows
+	cr, err := NewCompactReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	want := []*CompactRow{}
+	for _, requestEvent := range compactTestEvents() {
+		eventRows, err := FlattenEvent(requestEvent)
+		require.NoError(t, err)
+		want = append(want, eventRows...)
+	}
+	for _, wantRow := range want {
+		row, err := cr.Next()
+		require.NoError(t, err)
+		assert.Equal(t, wantRow, row)
+	}
+	_, err = cr.Next()
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,136 @@
+package log
+
+import (
+	"context"
+
+	"github.com/smallhouse123/go-library/internal/tracectx"
+)
+
+// ContextExtractor fills RequestCommon fields from a context, fields already set are left as they are.
+type ContextExtractor interface {
+	Extract(ctx context.Context, requestCommon *RequestCommon)
+}
+
+// ContextExtractorFunc adapts a function to a ContextExtractor
+type ContextExtractorFunc func(ctx context.Context, requestCommon *RequestCommon)
+
+func (f ContextExtractorFunc) Extract(ctx context.Context, requestCommon *RequestCommon) {
+	f(ctx, requestCommon)
+}
+
+// DefaultExtractors are always applied by WriteLogContext, after the extractors provided to the container.
+func DefaultExtractors() []ContextExtractor {
+	return []ContextExtractor{
+		OpenTelemetryExtractor(),
+		OpenCensusExtractor(),
+		RequestIdExtractor(),
+		UserExtractor(),
+	}
+}
+
+// OpenTelemetryExtractor sets TraceId and SpanId from the OpenTelemetry span in the context
+func OpenTelemetryExtractor() ContextExtractor {
+	return ContextExtractorFunc(func(ctx context.Context, requestCommon *RequestCommon) {
+		if ids, ok := tracectx.OpenTelemetry(ctx); ok {
+			setSpanIds(requestCommon, ids)
+		}
+	})
+}
+
+// OpenCensusExtractor sets TraceId and SpanId from the OpenCensus span in the context
+func OpenCensusExtractor() ContextExtractor {
+	return ContextExtractorFunc(func(ctx context.Context, requestCommon *RequestCommon) {
+		if ids, ok := tracectx.OpenCensus(ctx); ok {
+			setSpanIds(requestCommon, ids)
+		}
+	})
+}
+
+func setSpanIds(requestCommon *RequestCommon, ids tracectx.SpanIds) {
+	if requestCommon.TraceId != "" {
+		return
+	}
+	requestCommon.TraceId = ids.TraceId
+	requestCommon.SpanId = ids.SpanId
+}
+
+type requestIdKey struct{}
+
+// WithRequestId returns a context carrying the request id
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, requestId)
+}
+
+// RequestIdFromContext returns the request id set by WithRequestId
+func RequestIdFromContext(ctx context.Context) (string, bool) {
+	requestId, ok := ctx.Value(requestIdKey{}).(string)
+	return requestId, ok && requestId != ""
+}
+
+// RequestIdExtractor sets RequestId from WithRequestId
+func RequestIdExtractor() ContextExtractor {
+	return ContextExtractorFunc(func(ctx context.Context, requestCommon *RequestCommon) {
+		if requestCommon.RequestId != "" {
+			return
+		}
+		if requestId, ok := RequestIdFromContext(ctx); ok {
+			requestCommon.RequestId = requestId
+		}
+	})
+}
+
+type userKey struct{}
+
+// User is the authenticated user of a request
+type User struct {
+	UserName string
+	UserId   *string
+}
+
+// WithUser returns a context carrying the authenticated user, it's meant to be called by the auth middleware
+func WithUser(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// UserFromContext returns the user set by WithUser
+func UserFromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(userKey{}).(User)
+	return user, ok
+}
+
+// UserExtractor sets UserName and UserId from WithUser
+func UserExtractor() ContextExtractor {
+	return ContextExtractorFunc(func(ctx context.Context, requestCommon *RequestCommon) {
+		user, ok := UserFromContext(ctx)
+		if !ok {
+			return
+		}
+		if requestCommon.UserName == "" {
+			requestCommon.UserName = user.UserName
+		}
+		if requestCommon.UserId == nil {
+			requestCommon.UserId = user.UserId
+		}
+	})
+}
+
+// extractContext returns a copy of requestEvent with the fields found in ctx,
+// the caller's event is never modified.
+func extractContext(ctx context.Context, extractors []ContextExtractor, requestEvent *RequestEvent) *RequestEvent {
+	if requestEvent == nil {
+		return nil
+	}
+
+	var requestCommon RequestCommon
+	if requestEvent.RequestCommon != nil {
+		requestCommon = *requestEvent.RequestCommon
+	}
+	for _, extractor := range extractors {
+		extractor.Extract(ctx, &requestCommon)
+	}
+
+	return &RequestEvent{
+		RequestCommon: &requestCommon,
+		UserEvents:    requestEvent.UserEvents,
+	}
+}
@@ -0,0 +1,111 @@
+package log
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/plugin/ochttp/propagation/b3"
+	octrace "go.opencensus.io/trace"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// tracing continues the trace of the request headers, the way otelhttp and ochttp do
+func tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		if parent, ok := (&b3.HTTPFormat{}).SpanContextFromRequest(r); ok {
+			var span *octrace.Span
+			ctx, span = octrace.StartSpanWithRemoteParent(ctx, r.URL.Path, parent)
+			defer span.End()
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func serveTraced(t *testing.T, header http.Header) *RequestCommon {
+	memoryLog := NewMemoryLog(10)
+	handler := tracing(Middleware(memoryLog, "requests", MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for name, values := range header {
+		for _, value := range values {
+			r.Header.Add(name, value)
+		}
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	entries := memoryLog.Entries()
+	require.Len(t, entries, 1)
+	return entries[0].RequestEvent.RequestCommon
+}
+
+func TestTraceIdsFromTraceparent(t *testing.T) {
+	common := serveTraced(t, http.Header{
+		"Traceparent":  {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		"X-Request-Id": {"req-1"},
+	})
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", common.TraceId)
+	assert.Equal(t, "00f067aa0ba902b7", common.SpanId)
+	assert.Equal(t, "req-1", common.RequestId)
+}
+
+func TestTraceIdsFromB3(t *testing.T) {
+	common := serveTraced(t, http.Header{
+		b3.TraceIDHeader: {"463ac35c9f6413ad48485a3953bb6124"},
+		b3.SpanIDHeader:  {"a2fb4a1d1a96d312"},
+		b3.SampledHeader: {"1"},
+	})
+	assert.Equal(t, "463ac35c9f6413ad48485a3953bb6124", common.TraceId)
+	assert.Len(t, common.SpanId, 16)
+
+	// W3C wins when both are sent
+	common = serveTraced(t, http.Header{
+		"Traceparent":    {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		b3.TraceIDHeader: {"463ac35c9f6413ad48485a3953bb6124"},
+		b3.SpanIDHeader:  {"a2fb4a1d1a96d312"},
+	})
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", common.TraceId)
+
+	common = serveTraced(t, http.Header{})
+	assert.Empty(t, common.TraceId)
+	assert.Empty(t, common.SpanId)
+}
+
+func TestExtractContext(t *testing.T) {
+	userId := "42"
+	ctx := WithUser(WithRequestId(context.Background(), "req-1"), User{UserName: "alice", UserId: &userId})
+	custom := ContextExtractorFunc(func(ctx context.Context, requestCommon *RequestCommon) {
+		requestCommon.RequestId = "custom"
+	})
+
+	requestEvent := &RequestEvent{RequestCommon: &RequestCommon{VisitorId: "v", UserName: "bob"}}
+	extracted := extractContext(ctx, append([]ContextExtractor{custom}, DefaultExtractors()...), requestEvent)
+
+	assert.Equal(t, "custom", extracted.RequestCommon.RequestId, "extractors run in order, set fields are kept")
+	assert.Equal(t, "bob", extracted.RequestCommon.UserName)
+	assert.Equal(t, &userId, extracted.RequestCommon.UserId)
+	assert.Equal(t, "v", extracted.RequestCommon.VisitorId)
+	assert.Equal(t, &RequestCommon{VisitorId: "v", UserName: "bob"}, requestEvent.RequestCommon, "the caller's event isn't modified")
+
+	extracted = extractContext(ctx, DefaultExtractors(), &RequestEvent{})
+	assert.Equal(t, "req-1", extracted.RequestCommon.RequestId)
+	assert.Nil(t, extractContext(ctx, DefaultExtractors(), nil))
+}
+
+func TestWriteLogContextWritesTraceIds(t *testing.T) {
+	memoryLog := NewMemoryLog(10)
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.HeaderCarrier(header))
+
+	requestEvent := &RequestEvent{RequestCommon: &RequestCommon{VisitorId: "v"}}
+	memoryLog.WriteLogContext(ctx, "requests", requestEvent)
+
+	logged := memoryLog.Entries()[0].RequestEvent.RequestCommon
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", logged.TraceId)
+	assert.Equal(t, "00f067aa0ba902b7", logged.SpanId)
+	assert.Empty(t, requestEvent.RequestCommon.TraceId)
+}
@@ -0,0 +1,267 @@
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/smallhouse123/go-library/service/metrics"
+	"go.uber.org/zap"
+)
+
+// modes of the log service, anything but MODE_FILE is a fallback selected by LOG_FALLBACK
+const (
+	MODE_FILE   = "file"
+	MODE_ERROR  = "error"
+	MODE_STDOUT = "stdout"
+	MODE_MEMORY = "memory"
+	MODE_NOOP   = "noop"
+
+	DEFAULT_MEMORY_CAPACITY = 1000
+
+	METRIC_DISCARDED_EVENTS = "log_discarded_events_total"
+)
+
+// Health reports which sink the log service is writing to
+type Health struct {
+	Mode string `json:"mode"`
+	// Degraded is set when the log service fell back from writing files
+	Degraded bool   `json:"degraded"`
+	Reason   string `json:"reason,omitempty"`
+	// Discarded is the number of events dropped by the noop sink
+	Discarded int64 `json:"discarded"`
+}
+
+// HealthReporter is implemented by every Log of this package
+type HealthReporter interface {
+	Health() Health
+}
+
+// HealthHandler serves the health of logger as JSON, it answers 503 while the logger is degraded.
+func HealthHandler(logger Log) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		health := Health{Mode: MODE_FILE}
+		if reporter, ok := logger.(HealthReporter); ok {
+			health = reporter.Health()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if health.Degraded {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health)
+	})
+}
+
+// newFallback returns the sink selected by LOG_FALLBACK, stdout by default so the app keeps running
+// like it did before the fallbacks. MODE_ERROR returns cause itself so fx fails to start.
+func newFallback(p Params, metricsService metrics.Metrics, sugar *zap.SugaredLogger, cause error) (Log, error) {
+	mode := getConfigString(p.Config, "LOG_FALLBACK", MODE_STDOUT)
+	extractors := append(append([]ContextExtractor{}, p.Extractors...), DefaultExtractors()...)
+
+	var logger Log
+	switch mode {
+	case MODE_STDOUT:
+		logger = &StdoutLog{
+			writer:     os.Stdout,
+			sugar:      sugar,
+			extractors: extractors,
+			reason:     cause.Error(),
+		}
+	case MODE_MEMORY:
+		memoryLog := NewMemoryLog(getConfigInt(p.Config, "LOG_MEMORY_CAPACITY", DEFAULT_MEMORY_CAPACITY))
+		memoryLog.extractors = extractors
+		memoryLog.reason = cause.Error()
+		logger = memoryLog
+	case MODE_NOOP:
+		logger = &NopLog{
+			metrics: metricsService,
+			reason:  cause.Error(),
+		}
+	case MODE_ERROR:
+		return nil, fmt.Errorf("log service can't write files: %v", cause)
+	default:
+		return nil, fmt.Errorf("log service can't write files: %v, and LOG_FALLBACK '%s' is unknown", cause, mode)
+	}
+
+	sugar.Errorw("log service can't write files, falling back", "mode", mode, "err", cause)
+	return logger, nil
+}
+
+// StdoutLog writes every event as a JSON line, tagged with its logName, to stdout.
+type StdoutLog struct {
+	mu         sync.Mutex
+	writer     io.Writer
+	sugar      *zap.SugaredLogger
+	extractors []ContextExtractor
+	reason     string
+}
+
+type stdoutEntry struct {
+	LogName      string        `json:"logName"`
+	RequestEvent *RequestEvent `json:"requestEvent"`
+}
+
+func (l *StdoutLog) WriteLog(logName string, requestEvent *RequestEvent) {
+	entryJSON, err := json.Marshal(&stdoutEntry{LogName: logName, RequestEvent: requestEvent})
+	if err != nil {
+		l.sugar.Errorw("failed to encode event to JSON", "logName", logName, "err", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.writer.Write(append(entryJSON, '\n'))
+}
+
+func (l *StdoutLog) WriteLogContext(ctx context.Context, logName string, requestEvent *RequestEvent) {
+	l.WriteLog(logName, extractContext(ctx, l.extractors, requestEvent))
+}
+
+func (l *StdoutLog) Close() {}
+
+func (l *StdoutLog) Health() Health {
+	return Health{Mode: MODE_STDOUT, Degraded: true, Reason: l.reason}
+}
+
+// MemoryLog keeps copies of the latest events in a ring buffer, older events are overwritten.
+type MemoryLog struct {
+	mu         sync.Mutex
+	entries    []MemoryEntry
+	next       int
+	full       bool
+	extractors []ContextExtractor
+	reason     string
+}
+
+type MemoryEntry struct {
+	LogName      string
+	RequestEvent *RequestEvent
+}
+
+func NewMemoryLog(capacity int) *MemoryLog {
+	if capacity <= 0 {
+		capacity = DEFAULT_MEMORY_CAPACITY
+	}
+	return &MemoryLog{
+		entries:    make([]MemoryEntry, capacity),
+		extractors: DefaultExtractors(),
+	}
+}
+
+func (l *MemoryLog) WriteLog(logName string, requestEvent *RequestEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries[l.next] = MemoryEntry{LogName: logName, RequestEvent: copyRequestEvent(requestEvent)}
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+func (l *MemoryLog) WriteLogContext(ctx context.Context, logName string, requestEvent *RequestEvent) {
+	l.WriteLog(logName, extractContext(ctx, l.extractors, requestEvent))
+}
+
+func (l *MemoryLog) Close() {}
+
+// Entries returns the buffered events, oldest first
+func (l *MemoryLog) Entries() []MemoryEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.full {
+		return append([]MemoryEntry{}, l.entries[:l.next]...)
+	}
+	return append(append([]MemoryEntry{}, l.entries[l.next:]...), l.entries[:l.next]...)
+}
+
+func (l *MemoryLog) Health() Health {
+	return Health{Mode: MODE_MEMORY, Degraded: l.reason != "", Reason: l.reason}
+}
+
+// copyRequestEvent deep copies an event, so the caller can reuse it once it's written
+func copyRequestEvent(requestEvent *RequestEvent) *RequestEvent {
+	if requestEvent == nil {
+		return nil
+	}
+
+	eventCopy := &RequestEvent{}
+	if requestEvent.RequestCommon != nil {
+		requestCommon := *requestEvent.RequestCommon
+		if requestCommon.UserId != nil {
+			userId := *requestCommon.UserId
+			requestCommon.UserId = &userId
+		}
+		eventCopy.RequestCommon = &requestCommon
+	}
+	if requestEvent.UserEvents != nil {
+		eventCopy.UserEvents = make([]*UserEvent, len(requestEvent.UserEvents))
+		for i, userEvent := range requestEvent.UserEvents {
+			if userEvent == nil {
+				continue
+			}
+			userEventCopy := *userEvent
+			if userEvent.Metadata != nil {
+				userEventCopy.Metadata = copyValue(userEvent.Metadata).(map[string]interface{})
+			}
+			eventCopy.UserEvents[i] = &userEventCopy
+		}
+	}
+	return eventCopy
+}
+
+// copyValue copies the maps and slices of a decoded JSON value
+func copyValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = copyValue(item)
+		}
+		return m
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = copyValue(item)
+		}
+		return items
+	default:
+		return val
+	}
+}
+
+// NopLog discards every event, it only counts them.
+type NopLog struct {
+	discarded atomic.Int64
+	metrics   metrics.Metrics
+	reason    string
+}
+
+func (l *NopLog) WriteLog(logName string, requestEvent *RequestEvent) {
+	l.discarded.Add(1)
+	if l.metrics != nil {
+		l.metrics.BumpCount(METRIC_DISCARDED_EVENTS, 1, "logName", logName)
+	}
+}
+
+func (l *NopLog) WriteLogContext(ctx context.Context, logName string, requestEvent *RequestEvent) {
+	l.WriteLog(logName, requestEvent)
+}
+
+func (l *NopLog) Close() {}
+
+// Discarded returns the number of events dropped so far
+func (l *NopLog) Discarded() int64 {
+	return l.discarded.Load()
+}
+
+func (l *NopLog) Health() Health {
+	return Health{Mode: MODE_NOOP, Degraded: true, Reason: l.reason, Discarded: l.Discarded()}
+}
@@ -0,0 +1,62 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newFallbackLog(t *testing.T, values map[string]interface{}) (Log, error) {
+	rootDir := ROOT_DIR
+	ROOT_DIR = ""
+	t.Cleanup(func() { ROOT_DIR = rootDir })
+
+	return New(Params{Config: newTestConfig(t, values), Logger: zap.NewNop()})
+}
+
+func TestFallbackDefaultsToStdout(t *testing.T) {
+	logger, err := newFallbackLog(t, nil)
+	require.NoError(t, err)
+	defer logger.Close()
+
+	health := logger.(HealthReporter).Health()
+	assert.Equal(t, MODE_STDOUT, health.Mode)
+	assert.True(t, health.Degraded)
+}
+
+func TestFallbackError(t *testing.T) {
+	_, err := newFallbackLog(t, map[string]interface{}{"LOG_FALLBACK": MODE_ERROR})
+	assert.ErrorContains(t, err, "APP_ROOT is not set")
+}
+
+func TestMemoryLogKeepsCopies(t *testing.T) {
+	memoryLog := NewMemoryLog(2)
+
+	userId := "u1"
+	requestEvent := &RequestEvent{
+		RequestCommon: &RequestCommon{VisitorId: "a", UserId: &userId},
+		UserEvents: []*UserEvent{{
+			EventType: "click",
+			Metadata:  map[string]interface{}{"tags": []interface{}{"x"}},
+		}},
+	}
+	memoryLog.WriteLog("access", requestEvent)
+
+	// the caller reuses its event
+	requestEvent.RequestCommon.VisitorId = "b"
+	userId = "u2"
+	requestEvent.UserEvents[0].EventType = "scroll"
+	requestEvent.UserEvents[0].Metadata["tags"].([]interface{})[0] = "y"
+	memoryLog.WriteLog("access", requestEvent)
+
+	entries := memoryLog.Entries()
+	require.Len(t, entries, 2)
+	first := entries[0].RequestEvent
+	assert.Equal(t, "a", first.RequestCommon.VisitorId)
+	assert.Equal(t, "u1", *first.RequestCommon.UserId)
+	assert.Equal(t, "click", first.UserEvents[0].EventType)
+	assert.Equal(t, []interface{}{"x"}, first.UserEvents[0].Metadata["tags"])
+	assert.Equal(t, "b", entries[1].RequestEvent.RequestCommon.VisitorId)
+}
@@ -1,7 +1,9 @@
 package log
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -9,28 +11,73 @@ import (
 	"time"
 
 	"github.com/smallhouse123/go-library/service/config"
+	"github.com/smallhouse123/go-library/service/metrics"
 	"go.uber.org/fx"
+	"go.uber.org/zap"
 )
 
 var (
 	Service = fx.Provide(New)
 )
 
+type Params struct {
+	fx.In
+
+	Config     config.Config
+	Logger     *zap.Logger        `optional:"true"`
+	Metrics    metrics.Metrics    `optional:"true"`
+	Clock      Clock              `optional:"true"`
+	Extractors []ContextExtractor `group:"logContextExtractors"`
+}
+
 type Impl struct {
 	logDir         string
-	currentHour    string
-	currentFile    *os.File
-	logBuffer      []string
+	fileTemplate   string
+	location       *time.Location
+	clock          Clock
+	currentHour    time.Time
+	files          map[string]*logFile
+	buffered       int
 	flushThreshold int
 	flushPeriod    int
 	mu             sync.Mutex
 	flushChan      chan struct{}
 	done           chan struct{}
 	wg             sync.WaitGroup
+	sampler        *sampler
+	aggregator     *aggregator
+	extractors     []ContextExtractor
+	metrics        metrics.Metrics
+	sugar          *zap.SugaredLogger
+	closeHooks     []func(file ClosedFile)
+	closedFiles    []ClosedFile
+	hooksPending   map[string]int
+	closedChan     chan struct{}
+	closed         bool
 
 	configService config.Config
 }
 
+// logFile is an hourly file of a logName, it's opened on the first flush
+type logFile struct {
+	logName string
+	path    string
+	hour    time.Time
+	file    *os.File
+	buffer  []string
+	// size of the file when it was opened, files are reopened in append mode for late events
+	openOffset int64
+}
+
+// ClosedFile is an hourly file that was just closed. Offset is where the entries written since
+// it was opened start, it's not 0 when the file was reopened for late events.
+type ClosedFile struct {
+	LogName string
+	Path    string
+	Hour    time.Time
+	Offset  int64
+}
+
 var ROOT_DIR = os.Getenv("APP_ROOT")
 
 const (
@@ -38,41 +85,114 @@ const (
 	DEFAULT_FLUSH_PERIOD    = 5 // minutes
 )
 
-func New(configService config.Config) Log {
-	podName := os.Getenv("K8S_POD_NAME")
+// metrics of the log service itself, labeled by logName
+const (
+	METRIC_EVENTS             = "log_events_total"
+	METRIC_SAMPLED_OUT_EVENTS = "log_sampled_out_user_events_total"
+	METRIC_BYTES              = "log_bytes_total"
+	METRIC_FLUSH_DURATION     = "log_flush_duration_seconds"
+	METRIC_WRITE_ERRORS       = "log_write_errors_total"
+	METRIC_FILE_ROTATIONS     = "log_file_rotations_total"
+	METRIC_BUFFERED_EVENTS    = "log_buffered_events"
+)
 
-	var subDir string
-	if podName != "" {
-		subDir = filepath.Join("logs", podName)
+func New(p Params) (Log, error) {
+	configService := p.Config
+	logger := p.Logger
+	if logger == nil {
+		logger = zap.NewNop()
 	}
+	sugar := logger.Named("log").Sugar()
 
-	fullDir := filepath.Join(ROOT_DIR, subDir)
-	if fullDir == "" {
-		fmt.Println("ROOT_DIR is not set. Logs will not be stored.")
-		return nil
+	metricsService := p.Metrics
+	if metricsService == nil {
+		metricsService = metrics.NewNop()
 	}
 
-	if err := os.MkdirAll(fullDir, os.ModePerm); err != nil {
-		fmt.Printf("Failed to create log directory: %v\n", err)
-		return nil
+	fullDir, err := createLogDir()
+	if err != nil {
+		return newFallback(p, metricsService, sugar, err)
 	}
 
 	flushThreshold := getConfigInt(configService, "LOG_FLUSH_THRESHOLD", DEFAULT_FLUSH_THRESHOLD)
 	flushPeriod := getConfigInt(configService, "LOG_FLUSH_PERIOD", DEFAULT_FLUSH_PERIOD)
+	fileTemplate := getConfigString(configService, "LOG_FILE_TEMPLATE", DEFAULT_FILE_TEMPLATE)
+
+	timezone := getConfigString(configService, "LOG_TIMEZONE", DEFAULT_TIMEZONE)
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		sugar.Warnw("invalid timezone, falling back to local time", "timezone", timezone, "err", err)
+		location = time.Local
+	}
+
+	eventSampler, err := newSampler(configService)
+	if err != nil {
+		sugar.Errorw("invalid sampling rules, sampling is disabled", "err", err)
+		eventSampler = &sampler{}
+	}
+
+	eventAggregator, err := newAggregator(configService)
+	if err != nil {
+		sugar.Errorw("invalid aggregation settings, aggregation is disabled", "err", err)
+		eventAggregator = &aggregator{}
+	}
+
+	clock := p.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
 
 	im := &Impl{
 		logDir:         fullDir,
-		logBuffer:      make([]string, 0, flushThreshold),
+		fileTemplate:   fileTemplate,
+		location:       location,
+		clock:          clock,
+		files:          map[string]*logFile{},
+		hooksPending:   map[string]int{},
 		flushChan:      make(chan struct{}, 1),
 		done:           make(chan struct{}),
+		closedChan:     make(chan struct{}, 1),
 		configService:  configService,
 		flushThreshold: flushThreshold,
 		flushPeriod:    flushPeriod,
+		sampler:        eventSampler,
+		aggregator:     eventAggregator,
+		metrics:        metricsService,
+		sugar:          sugar,
+		extractors:     append(append([]ContextExtractor{}, p.Extractors...), DefaultExtractors()...),
 	}
 
+	if getConfigBool(configService, "LOG_INDEX", false) {
+		im.OnFileClosed(im.indexFile)
+	}
+	if getConfigBool(configService, "LOG_COMPACT_EXPORT", false) {
+		im.OnFileClosed(im.exportCompact)
+	}
+
+	im.wg.Add(2) // the flush loop and the close hook loop
 	go im.flushLoop()
+	go im.closeHookLoop()
+
+	return im, nil
+}
+
+func createLogDir() (string, error) {
+	if ROOT_DIR == "" {
+		return "", errors.New("APP_ROOT is not set")
+	}
+
+	podName := os.Getenv("K8S_POD_NAME")
+
+	var subDir string
+	if podName != "" {
+		subDir = filepath.Join("logs", podName)
+	}
 
-	return im
+	fullDir := filepath.Join(ROOT_DIR, subDir)
+	if err := os.MkdirAll(fullDir, os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create log directory: %v", err)
+	}
+	return fullDir, nil
 }
 
 func getConfigInt(configService config.Config, key string, defaultValue int) int {
@@ -86,84 +206,320 @@ func getConfigInt(configService config.Config, key string, defaultValue int) int
 	return defaultValue
 }
 
+func getConfigBool(configService config.Config, key string, defaultValue bool) bool {
+	val, err := configService.Get(key)
+	if err != nil {
+		return defaultValue
+	}
+	if valBool, ok := val.(bool); ok {
+		return valBool
+	}
+	return defaultValue
+}
+
+func getConfigString(configService config.Config, key string, defaultValue string) string {
+	val, err := configService.Get(key)
+	if err != nil {
+		return defaultValue
+	}
+	if valStr, ok := val.(string); ok && valStr != "" {
+		return valStr
+	}
+	return defaultValue
+}
+
 func (im *Impl) WriteLog(logName string, requestEvent *RequestEvent) {
-	currentHour := time.Now().Format("06_01_02__15")
+	sampled := im.sampler.sample(logName, requestEvent, im.clock.Now())
+	if sampledOut := countUserEvents(requestEvent) - countUserEvents(sampled); sampledOut > 0 {
+		im.metrics.BumpCount(METRIC_SAMPLED_OUT_EVENTS, float64(sampledOut), "logName", logName)
+	}
+	if sampled == nil {
+		return
+	}
+	requestEvent = sampled
+
+	requestEvent, full := im.aggregator.add(logName, requestEvent)
+	if full {
+		im.requestFlush()
+	}
+	if requestEvent == nil {
+		return
+	}
+
+	im.write(logName, requestEvent)
+}
+
+func (im *Impl) Health() Health {
+	return Health{Mode: MODE_FILE}
+}
+
+func (im *Impl) WriteLogContext(ctx context.Context, logName string, requestEvent *RequestEvent) {
+	im.WriteLog(logName, extractContext(ctx, im.extractors, requestEvent))
+}
+
+func countUserEvents(requestEvent *RequestEvent) int {
+	if requestEvent == nil {
+		return 0
+	}
+	return len(requestEvent.UserEvents)
+}
+
+// writeAggregates writes the events aggregated since the last drain, on every window tick and flush
+func (im *Impl) writeAggregates() {
+	for _, agg := range im.aggregator.drain() {
+		im.write(agg.logName, &RequestEvent{
+			RequestCommon: agg.common,
+			UserEvents:    []*UserEvent{agg.event},
+		})
+	}
+}
+
+func (im *Impl) write(logName string, requestEvent *RequestEvent) {
+	now := im.clock.Now()
+	currentHour := truncateHour(now, im.location)
+	eventHour := truncateHour(eventTime(requestEvent, now), im.location)
+	logFilePath := filepath.Join(im.logDir, formatFileName(im.fileTemplate, logName, eventHour))
+
+	eventJSON, err := json.Marshal(&requestEvent)
+	if err != nil {
+		im.sugar.Errorw("failed to encode event to JSON", "logName", logName, "err", err)
+		im.metrics.BumpCount(METRIC_WRITE_ERRORS, 1, "logName", logName, "op", "encode")
+		return
+	}
+	im.metrics.BumpCount(METRIC_EVENTS, 1, "logName", logName)
 
 	im.mu.Lock()
 	defer im.mu.Unlock()
 
-	if im.currentHour != currentHour {
+	if !im.currentHour.Equal(currentHour) {
+		// the hour has passed, write out and close the files of previous hours
+		im.currentHour = currentHour
 		im.flush()
-		if im.currentFile != nil {
-			im.currentFile.Close()
+	}
+
+	lf, ok := im.files[logFilePath]
+	if !ok {
+		lf = &logFile{
+			logName: logName,
+			path:    logFilePath,
+			hour:    eventHour,
+		}
+		im.files[logFilePath] = lf
+	}
+
+	lf.buffer = append(lf.buffer, string(eventJSON))
+	im.buffered++
+	im.metrics.AddGauge(METRIC_BUFFERED_EVENTS, 1, "logName", logName)
+
+	if im.buffered >= im.flushThreshold {
+		im.requestFlush()
+	}
+}
+
+// requestFlush asks the flush loop for a flush, which also writes the aggregated events
+func (im *Impl) requestFlush() {
+	select {
+	case im.flushChan <- struct{}{}:
+	default: // Avoid blocking if the channel is full
+	}
+}
+
+// flush writes all buffered entries and closes the files of hours before the current one,
+// late events for those hours reopen the file in append mode.
+func (im *Impl) flush() {
+	currentHour := truncateHour(im.clock.Now(), im.location)
+
+	for path, lf := range im.files {
+		im.writeFile(lf)
+
+		if lf.hour.Before(currentHour) {
+			im.closeFile(lf)
+			delete(im.files, path)
 		}
+	}
 
-		logFilePath := filepath.Join(im.logDir, currentHour+".log")
-		file, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	im.buffered = 0
+}
+
+func (im *Impl) writeFile(lf *logFile) {
+	if len(lf.buffer) == 0 {
+		return
+	}
+	// the buffer is emptied on every path below, written or not
+	defer im.metrics.SubGauge(METRIC_BUFFERED_EVENTS, float64(len(lf.buffer)), "logName", lf.logName)
+
+	if timer, err := im.metrics.BumpTime(METRIC_FLUSH_DURATION, "logName", lf.logName); err == nil {
+		defer timer.End()
+	}
+
+	if lf.file == nil {
+		if err := os.MkdirAll(filepath.Dir(lf.path), os.ModePerm); err != nil {
+			im.sugar.Errorw("failed to create log directory", "path", lf.path, "err", err)
+			im.metrics.BumpCount(METRIC_WRITE_ERRORS, float64(len(lf.buffer)), "logName", lf.logName, "op", "open")
+			lf.buffer = lf.buffer[:0]
+			return
+		}
+
+		file, err := os.OpenFile(lf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
-			fmt.Printf("Failed to open log file: %v\n", err)
-			im.currentFile = nil
+			im.sugar.Errorw("failed to open log file", "path", lf.path, "err", err)
+			im.metrics.BumpCount(METRIC_WRITE_ERRORS, float64(len(lf.buffer)), "logName", lf.logName, "op", "open")
+			lf.buffer = lf.buffer[:0]
 			return
 		}
+		lf.file = file
+		if info, err := file.Stat(); err == nil {
+			lf.openOffset = info.Size()
+		}
+	}
 
-		im.currentFile = file
-		im.currentHour = currentHour
+	written := 0
+	for _, logEntry := range lf.buffer {
+		n, err := lf.file.WriteString(logEntry + "\n")
+		written += n
+		if err != nil {
+			im.sugar.Errorw("failed to write log entry", "path", lf.path, "err", err)
+			im.metrics.BumpCount(METRIC_WRITE_ERRORS, 1, "logName", lf.logName, "op", "write")
+		}
 	}
+	im.metrics.BumpCount(METRIC_BYTES, float64(written), "logName", lf.logName)
 
-	eventJSON, err := json.Marshal(&requestEvent)
-	if err != nil {
-		fmt.Printf("Failed to encode event to JSON: %v\n", err)
+	lf.buffer = lf.buffer[:0]
+}
+
+func (im *Impl) closeFile(lf *logFile) {
+	if lf.file == nil {
 		return
 	}
+	if err := lf.file.Close(); err != nil {
+		im.sugar.Errorw("failed to close log file", "path", lf.path, "err", err)
+		im.metrics.BumpCount(METRIC_WRITE_ERRORS, 1, "logName", lf.logName, "op", "close")
+	}
+	lf.file = nil
+	im.metrics.BumpCount(METRIC_FILE_ROTATIONS, 1, "logName", lf.logName)
 
-	im.logBuffer = append(im.logBuffer, string(eventJSON))
-
-	if len(im.logBuffer) >= im.flushThreshold {
+	if len(im.closeHooks) > 0 && !im.closed {
+		im.closedFiles = append(im.closedFiles, ClosedFile{
+			LogName: lf.logName,
+			Path:    lf.path,
+			Hour:    lf.hour,
+			Offset:  lf.openOffset,
+		})
+		im.hooksPending[lf.path]++
 		select {
-		case im.flushChan <- struct{}{}:
-		default: // Avoid blocking if the channel is full
+		case im.closedChan <- struct{}{}:
+		default:
 		}
 	}
 }
 
-func (im *Impl) flush() {
-	if len(im.logBuffer) == 0 || im.currentFile == nil {
-		return
+// OnFileClosed registers fn to be called with every hourly file once it's closed.
+// Hooks run one at a time on a separate goroutine, in the order they were registered.
+func (im *Impl) OnFileClosed(fn func(file ClosedFile)) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	im.closeHooks = append(im.closeHooks, fn)
+}
+
+// Dir returns the directory the hourly files are written to.
+func (im *Impl) Dir() string {
+	return im.logDir
+}
+
+// claim renames a closed file to claimedPath, so it can't be appended to anymore.
+// A file still held by the logger or by close hooks that haven't finished is never claimed. Unless force is set,
+// files modified within the current hour are left alone as well, they may belong to an hour not written yet by this process.
+func (im *Impl) claim(path, claimedPath string, force bool) (bool, error) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	if _, ok := im.files[path]; ok {
+		return false, nil
+	}
+	if im.hooksPending[path] > 0 {
+		return false, nil
 	}
 
-	for _, logEntry := range im.logBuffer {
-		if _, err := im.currentFile.WriteString(logEntry + "\n"); err != nil {
-			fmt.Printf("Failed to write log entry: %v\n", err)
+	if !force {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		currentHour := truncateHour(im.clock.Now(), im.location)
+		if !truncateHour(info.ModTime(), im.location).Before(currentHour) {
+			return false, nil
 		}
 	}
 
-	im.logBuffer = im.logBuffer[:0]
+	if err := os.Rename(path, claimedPath); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (im *Impl) closeHookLoop() {
+	defer im.wg.Done()
+
+	for range im.closedChan {
+		im.mu.Lock()
+		hooks := im.closeHooks
+		files := im.closedFiles
+		im.closedFiles = nil
+		im.mu.Unlock()
+
+		for _, file := range files {
+			for _, hook := range hooks {
+				hook(file)
+			}
+
+			im.mu.Lock()
+			if im.hooksPending[file.Path]--; im.hooksPending[file.Path] <= 0 {
+				delete(im.hooksPending, file.Path)
+			}
+			im.mu.Unlock()
+		}
+	}
 }
 
 func (im *Impl) flushLoop() {
-	im.wg.Add(1)       // Increment the WaitGroup counter
 	defer im.wg.Done() // Decrement when the flush loop exits
 
 	ticker := time.NewTicker(time.Duration(im.flushPeriod) * time.Minute)
 	defer ticker.Stop()
 
+	// a nil channel never fires, so the window only ticks when aggregation is enabled
+	var windowC <-chan time.Time
+	if im.aggregator.enabled() {
+		windowTicker := time.NewTicker(im.aggregator.window)
+		defer windowTicker.Stop()
+		windowC = windowTicker.C
+	}
+
 	for {
 		select {
+		case <-windowC:
+			im.writeAggregates()
 		case <-im.flushChan:
+			im.writeAggregates()
 			im.mu.Lock()
 			im.flush()
 			im.mu.Unlock()
 		case <-ticker.C:
+			im.writeAggregates()
 			im.mu.Lock()
 			im.flush()
 			im.mu.Unlock()
 		case <-im.done:
+			im.writeAggregates()
 			im.mu.Lock()
 			im.flush()
-			if im.currentFile != nil {
-				im.currentFile.Close()
+			for path, lf := range im.files {
+				im.closeFile(lf)
+				delete(im.files, path)
 			}
+			im.closed = true
 			im.mu.Unlock()
+			close(im.closedChan)
 			return
 		}
 	}
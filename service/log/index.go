@@ -0,0 +1,541 @@
+package log
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A sidecar index x.log.idx starts with INDEX_MAGIC and the size of the log it covers, followed by a bloom filter
+// of the visitor and user ids and the entries of every id, sorted by kind and id. A table of fixed size positions
+// of the entries comes first so a lookup can binary search them. An entry holds the byte offsets of the lines of its id.
+// Numbers are unsigned varints, positions are 8 byte little endian, offsets are delta encoded.
+// Lines appended after the index was built are past the covered size.
+const (
+	INDEX_SUFFIX = ".idx"
+	INDEX_MAGIC  = "RELIDX\x02"
+
+	// about 1% false positives
+	INDEX_BITS_PER_KEY = 10
+	INDEX_HASHES       = 7
+
+	// an id longer than this is a corrupted index rather than a real id
+	MAX_INDEX_ID_SIZE = 1 << 20
+)
+
+const (
+	indexVisitor byte = iota + 1
+	indexUser
+)
+
+// IndexQuery selects the events of a visitor, a user or both, empty fields match anything
+type IndexQuery struct {
+	VisitorId string
+	UserId    string
+}
+
+// Match reports whether the event belongs to the query
+func (q IndexQuery) Match(requestEvent *RequestEvent) bool {
+	if requestEvent == nil || requestEvent.RequestCommon == nil {
+		return false
+	}
+	common := requestEvent.RequestCommon
+	if q.VisitorId != "" && common.VisitorId != q.VisitorId {
+		return false
+	}
+	if q.UserId != "" && (common.UserId == nil || *common.UserId != q.UserId) {
+		return false
+	}
+	return true
+}
+
+// keys returns the index keys of the query, the most selective one first
+func (q IndexQuery) keys() []indexKey {
+	keys := []indexKey{}
+	if q.UserId != "" {
+		keys = append(keys, indexKey{kind: indexUser, id: q.UserId})
+	}
+	if q.VisitorId != "" {
+		keys = append(keys, indexKey{kind: indexVisitor, id: q.VisitorId})
+	}
+	return keys
+}
+
+type indexKey struct {
+	kind byte
+	id   string
+}
+
+func compareIndexKeys(a, b indexKey) int {
+	if a.kind != b.kind {
+		return int(a.kind) - int(b.kind)
+	}
+	return strings.Compare(a.id, b.id)
+}
+
+// IndexPath returns the path of the sidecar index of a log file
+func IndexPath(path string) string {
+	return path + INDEX_SUFFIX
+}
+
+// BuildIndex indexes the complete lines of the log file at path, replacing its previous index
+func BuildIndex(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offsets := map[indexKey][]int64{}
+	reader := bufio.NewReaderSize(file, 64*1024)
+
+	// a line still being written isn't covered, it's scanned by lookups instead
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		requestEvent := &RequestEvent{}
+		if json.Unmarshal(line, requestEvent) == nil && requestEvent.RequestCommon != nil {
+			common := requestEvent.RequestCommon
+			if common.VisitorId != "" {
+				key := indexKey{kind: indexVisitor, id: common.VisitorId}
+				offsets[key] = append(offsets[key], offset)
+			}
+			if common.UserId != nil && *common.UserId != "" {
+				key := indexKey{kind: indexUser, id: *common.UserId}
+				offsets[key] = append(offsets[key], offset)
+			}
+		}
+		offset += int64(len(line))
+	}
+
+	keys := make([]indexKey, 0, len(offsets))
+	for key := range offsets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return compareIndexKeys(keys[i], keys[j]) < 0
+	})
+
+	bloom := newBloomFilter(len(keys))
+	for _, key := range keys {
+		bloom.add(key)
+	}
+
+	b := []byte(INDEX_MAGIC)
+	b = binary.AppendUvarint(b, uint64(offset))
+	b = binary.AppendUvarint(b, uint64(bloom.hashes))
+	b = binary.AppendUvarint(b, uint64(len(bloom.bits)))
+	b = append(b, bloom.bits...)
+	b = binary.AppendUvarint(b, uint64(len(keys)))
+	entries := []byte{}
+	for _, key := range keys {
+		b = binary.LittleEndian.AppendUint64(b, uint64(len(entries)))
+		entries = append(entries, key.kind)
+		entries = binary.AppendUvarint(entries, uint64(len(key.id)))
+		entries = append(entries, key.id...)
+		entries = binary.AppendUvarint(entries, uint64(len(offsets[key])))
+		var previous int64
+		for _, lineOffset := range offsets[key] {
+			entries = binary.AppendUvarint(entries, uint64(lineOffset-previous))
+			previous = lineOffset
+		}
+	}
+	b = append(b, entries...)
+
+	tmp := IndexPath(path) + TMP_SUFFIX
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, IndexPath(path))
+}
+
+// Index is an open sidecar index. Only the header and the bloom filter are read when it's opened,
+// the entries are read on demand.
+type Index struct {
+	// Size is the number of bytes of the log file covered by the index
+	Size int64
+
+	file  *os.File
+	bloom *bloomFilter
+	// count entries, their positions start at table and the entries right after the positions
+	count int64
+	table int64
+}
+
+// OpenIndex opens the sidecar index of the log file at path
+func OpenIndex(path string) (*Index, error) {
+	file, err := os.Open(IndexPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	idx, err := readIndexHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("invalid index %s: %v", file.Name(), err)
+	}
+	return idx, nil
+}
+
+func readIndexHeader(file *os.File) (*Index, error) {
+	reader := &countingReader{r: bufio.NewReader(file)}
+
+	magic := make([]byte, len(INDEX_MAGIC))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != INDEX_MAGIC {
+		return nil, errors.New("not an index file")
+	}
+
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	bitsLen, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if hashes == 0 || bitsLen == 0 || bitsLen > 1<<32 {
+		return nil, errors.New("invalid bloom filter")
+	}
+	bits := make([]byte, bitsLen)
+	if _, err := io.ReadFull(reader, bits); err != nil {
+		return nil, err
+	}
+
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if count > 1<<40 {
+		return nil, errors.New("invalid entry count")
+	}
+
+	return &Index{
+		Size:  int64(size),
+		file:  file,
+		bloom: &bloomFilter{bits: bits, hashes: int(hashes)},
+		count: int64(count),
+		table: reader.n,
+	}, nil
+}
+
+// MayContain reports whether the indexed lines may hold events of the query, false means they certainly don't
+func (idx *Index) MayContain(q IndexQuery) bool {
+	for _, key := range q.keys() {
+		if !idx.bloom.mayContain(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// Offsets returns the offsets of the lines with the query's user id, or its visitor id when no user is given.
+// The lines still have to be matched against the query when it has both.
+// An id the bloom filter rules out costs no read, others are binary searched in the entries.
+func (idx *Index) Offsets(q IndexQuery) ([]int64, error) {
+	keys := q.keys()
+	if len(keys) == 0 {
+		return nil, errors.New("empty index query")
+	}
+	want := keys[0]
+	if !idx.bloom.mayContain(want) {
+		return nil, nil
+	}
+
+	lo, hi := int64(0), idx.count
+	for lo < hi {
+		mid := int64(uint64(lo+hi) >> 1)
+		key, reader, err := idx.entry(mid)
+		if err != nil {
+			return nil, err
+		}
+		switch c := compareIndexKeys(key, want); {
+		case c == 0:
+			return readIndexOffsets(reader)
+		case c < 0:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return nil, nil
+}
+
+// entry reads the key of the i-th entry, the reader is left at its offsets
+func (idx *Index) entry(i int64) (indexKey, *bufio.Reader, error) {
+	position := make([]byte, 8)
+	if _, err := idx.file.ReadAt(position, idx.table+8*i); err != nil {
+		return indexKey{}, nil, err
+	}
+	start := idx.table + 8*idx.count + int64(binary.LittleEndian.Uint64(position))
+	reader := bufio.NewReader(io.NewSectionReader(idx.file, start, math.MaxInt64-start))
+
+	kind, err := reader.ReadByte()
+	if err != nil {
+		return indexKey{}, nil, err
+	}
+	idLen, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return indexKey{}, nil, err
+	}
+	if idLen > MAX_INDEX_ID_SIZE {
+		return indexKey{}, nil, errors.New("invalid index entry")
+	}
+	id := make([]byte, idLen)
+	if _, err := io.ReadFull(reader, id); err != nil {
+		return indexKey{}, nil, err
+	}
+	return indexKey{kind: kind, id: string(id)}, reader, nil
+}
+
+func readIndexOffsets(reader *bufio.Reader) ([]int64, error) {
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	offsets := []int64{}
+	var offset int64
+	for i := uint64(0); i < count; i++ {
+		delta, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		offset += int64(delta)
+		offsets = append(offsets, offset)
+	}
+	return offsets, nil
+}
+
+func (idx *Index) Close() error {
+	return idx.file.Close()
+}
+
+// Lookup calls fn with every line of the log file at path that matches the query, in file order.
+// The sidecar index is used when there is one that fits the file, the lines past it are scanned.
+// A shipped x.log.gz uses the x.log.gz.idx shipped with it, the file is decompressed up to the matching lines.
+// Files without a usable index are scanned completely. It reports whether the index was used.
+func Lookup(path string, q IndexQuery, fn func(line []byte) error) (bool, error) {
+	if len(q.keys()) == 0 {
+		return false, errors.New("empty index query")
+	}
+
+	if strings.HasSuffix(path, COMPRESSED_SUFFIX) {
+		return lookupCompressed(path, q, fn)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	idx, err := OpenIndex(path)
+	if err != nil || idx.Size > info.Size() {
+		// missing, unreadable, or built for a different file
+		if idx != nil {
+			idx.Close()
+		}
+		return false, scanLines(path, 0, q, fn)
+	}
+	defer idx.Close()
+
+	if idx.MayContain(q) {
+		offsets, err := idx.Offsets(q)
+		if err != nil {
+			return true, err
+		}
+		for _, offset := range offsets {
+			if _, err := file.Seek(offset, io.SeekStart); err != nil {
+				return true, err
+			}
+			line, err := bufio.NewReader(file).ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return true, err
+			}
+			if err := matchLine(line, q, fn); err != nil {
+				return true, err
+			}
+		}
+	}
+
+	return true, scanLines(path, idx.Size, q, fn)
+}
+
+// lookupCompressed looks up a shipped file, it's complete so its index covers all of it
+func lookupCompressed(path string, q IndexQuery, fn func(line []byte) error) (bool, error) {
+	idx, err := OpenIndex(path)
+	if err != nil {
+		return false, scanLines(path, 0, q, fn)
+	}
+	defer idx.Close()
+
+	if !idx.MayContain(q) {
+		return true, nil
+	}
+	offsets, err := idx.Offsets(q)
+	if err != nil || len(offsets) == 0 {
+		return true, err
+	}
+
+	file, err := OpenLogFile(path)
+	if err != nil {
+		return true, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 64*1024)
+	var position int64
+	for _, offset := range offsets {
+		if _, err := io.CopyN(io.Discard, reader, offset-position); err != nil {
+			return true, err
+		}
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return true, err
+		}
+		position = offset + int64(len(line))
+		if err := matchLine(line, q, fn); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// matchLine calls fn with the line if it holds an event of the query
+func matchLine(line []byte, q IndexQuery, fn func(line []byte) error) error {
+	requestEvent := &RequestEvent{}
+	if json.Unmarshal(line, requestEvent) == nil && q.Match(requestEvent) {
+		return fn(line)
+	}
+	return nil
+}
+
+// scanLines calls fn with the matching lines of the file, starting at offset
+func scanLines(path string, offset int64, q IndexQuery, fn func(line []byte) error) error {
+	file, err := OpenLogFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if offset > 0 {
+		if seeker, ok := file.(io.Seeker); ok {
+			if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	}
+
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if err := matchLine(line, q, fn); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// indexFile rebuilds the index of a closed file, a file reopened for late events is indexed again when it's closed
+func (im *Impl) indexFile(file ClosedFile) {
+	if err := BuildIndex(file.Path); err != nil && !os.IsNotExist(err) {
+		im.sugar.Errorw("failed to index log file", "path", file.Path, "err", err)
+		im.metrics.BumpCount(METRIC_WRITE_ERRORS, 1, "logName", file.LogName, "op", "index")
+	}
+}
+
+// bloomFilter uses double hashing to derive its hash functions from one 64 bit hash
+type bloomFilter struct {
+	bits   []byte
+	hashes int
+}
+
+func newBloomFilter(keys int) *bloomFilter {
+	bits := keys * INDEX_BITS_PER_KEY
+	if bits < 64 {
+		bits = 64
+	}
+	return &bloomFilter{bits: make([]byte, (bits+7)/8), hashes: INDEX_HASHES}
+}
+
+func (f *bloomFilter) locations(key indexKey, fn func(bit uint64) bool) bool {
+	h := fnv.New64a()
+	h.Write([]byte{key.kind})
+	h.Write([]byte(key.id))
+	h1 := mix64(h.Sum64())
+	h2 := mix64(h1) | 1
+
+	m := uint64(len(f.bits)) * 8
+	for i := 0; i < f.hashes; i++ {
+		if !fn((h1 + uint64(i)*h2) % m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) add(key indexKey) {
+	f.locations(key, func(bit uint64) bool {
+		f.bits[bit/8] |= 1 << (bit % 8)
+		return true
+	})
+}
+
+func (f *bloomFilter) mayContain(key indexKey) bool {
+	return f.locations(key, func(bit uint64) bool {
+		return f.bits[bit/8]&(1<<(bit%8)) != 0
+	})
+}
+
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
@@ -0,0 +1,139 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestLog writes a log file where visitor v<i> has i%3+1 lines, and the user u<i> one line of every visitor
+func writeTestLog(t *testing.T, path string, visitors int) []byte {
+	lines := []byte{}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < visitors; i++ {
+			if round > i%3 {
+				continue
+			}
+			userId := fmt.Sprintf("u%d", i)
+			requestEvent := &RequestEvent{RequestCommon: &RequestCommon{VisitorId: fmt.Sprintf("v%d", i)}}
+			if round == 0 {
+				requestEvent.RequestCommon.UserId = &userId
+			}
+			line, err := json.Marshal(requestEvent)
+			require.NoError(t, err)
+			lines = append(append(lines, line...), '\n')
+		}
+	}
+	require.NoError(t, os.WriteFile(path, lines, 0644))
+	return lines
+}
+
+func lookupVisitors(t *testing.T, path string, q IndexQuery) ([]string, bool) {
+	visitorIds := []string{}
+	indexed, err := Lookup(path, q, func(line []byte) error {
+		requestEvent := &RequestEvent{}
+		require.NoError(t, json.Unmarshal(line, requestEvent))
+		visitorIds = append(visitorIds, requestEvent.RequestCommon.VisitorId)
+		return nil
+	})
+	require.NoError(t, err)
+	return visitorIds, indexed
+}
+
+func TestIndexOffsets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "24_03_01__09.log")
+	writeTestLog(t, path, 500)
+	require.NoError(t, BuildIndex(path))
+
+	idx, err := OpenIndex(path)
+	require.NoError(t, err)
+	defer idx.Close()
+	assert.Equal(t, int64(1000), idx.count, "500 visitors and 500 users")
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	for _, i := range []int{0, 1, 2, 250, 499} {
+		offsets, err := idx.Offsets(IndexQuery{VisitorId: fmt.Sprintf("v%d", i)})
+		require.NoError(t, err)
+		require.Len(t, offsets, i%3+1)
+		for _, offset := range offsets {
+			line := data[offset:]
+			line = line[:bytes.IndexByte(line, '\n')]
+			requestEvent := &RequestEvent{}
+			require.NoError(t, json.Unmarshal(line, requestEvent))
+			assert.Equal(t, fmt.Sprintf("v%d", i), requestEvent.RequestCommon.VisitorId)
+		}
+
+		offsets, err = idx.Offsets(IndexQuery{UserId: fmt.Sprintf("u%d", i)})
+		require.NoError(t, err)
+		assert.Len(t, offsets, 1)
+	}
+
+	// unknown ids and ids of the other kind don't match
+	for _, q := range []IndexQuery{{VisitorId: "v500"}, {VisitorId: "u1"}, {UserId: "v1"}} {
+		offsets, err := idx.Offsets(q)
+		require.NoError(t, err)
+		assert.Empty(t, offsets, q)
+	}
+
+	_, err = idx.Offsets(IndexQuery{})
+	assert.Error(t, err)
+}
+
+func TestLookupScansPastTheIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "24_03_01__09.log")
+	writeTestLog(t, path, 10)
+	require.NoError(t, BuildIndex(path))
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"requestCommon":{"visitorId":"v1"}}` + "\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	visitorIds, indexed := lookupVisitors(t, path, IndexQuery{VisitorId: "v1"})
+	assert.True(t, indexed)
+	assert.Equal(t, []string{"v1", "v1", "v1"}, visitorIds)
+}
+
+func TestLookupCompressed(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "24_03_01__09.log")
+	lines := writeTestLog(t, path, 100)
+	require.NoError(t, BuildIndex(path))
+
+	// a shipped file and its index, as downloaded from the store
+	compressedPath := path + COMPRESSED_SUFFIX
+	file, err := os.Create(compressedPath)
+	require.NoError(t, err)
+	zw := gzip.NewWriter(file)
+	_, err = zw.Write(lines)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.NoError(t, file.Close())
+	require.NoError(t, os.Rename(IndexPath(path), IndexPath(compressedPath)))
+
+	visitorIds, indexed := lookupVisitors(t, compressedPath, IndexQuery{VisitorId: "v98", UserId: "u98"})
+	assert.True(t, indexed)
+	assert.Equal(t, []string{"v98"}, visitorIds)
+
+	visitorIds, indexed = lookupVisitors(t, compressedPath, IndexQuery{VisitorId: "v5"})
+	assert.True(t, indexed)
+	assert.Equal(t, []string{"v5", "v5", "v5"}, visitorIds)
+
+	visitorIds, _ = lookupVisitors(t, compressedPath, IndexQuery{VisitorId: "missing"})
+	assert.Empty(t, visitorIds)
+
+	// without its index the file is scanned
+	require.NoError(t, os.Remove(IndexPath(compressedPath)))
+	visitorIds, indexed = lookupVisitors(t, compressedPath, IndexQuery{VisitorId: "v5"})
+	assert.False(t, indexed)
+	assert.Equal(t, []string{"v5", "v5", "v5"}, visitorIds)
+}
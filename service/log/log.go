@@ -1,8 +1,12 @@
 package log
 
+import "context"
+
 type Log interface {
 	// write log to destination file
 	WriteLog(logName string, requestEvent *RequestEvent)
+	// write log to destination file, with the trace, request and user found in ctx
+	WriteLogContext(ctx context.Context, logName string, requestEvent *RequestEvent)
 	// close logger instance
 	Close()
 }
@@ -11,6 +15,8 @@ type UserEvent struct {
 	EventType string                 `json:"eventType"`
 	Metadata  map[string]interface{} `json:"metadata"`
 	Count     int                    `json:"count"`
+	// SampleRate is the rate the event was kept at, 0 means it wasn't sampled
+	SampleRate float64 `json:"sampleRate,omitempty"`
 }
 
 // make some fields to be pointer, so it's default value can be null
@@ -20,6 +26,11 @@ type RequestCommon struct {
 	IsNewVisitor   bool    `json:"isNewVisitor"`
 	UserName       string  `json:"userName"`
 	UserId         *string `json:"userId"`
+	StatusCode     int     `json:"statusCode,omitempty"`
+	LatencyMs      float64 `json:"latencyMs,omitempty"`
+	TraceId        string  `json:"traceId,omitempty"`
+	SpanId         string  `json:"spanId,omitempty"`
+	RequestId      string  `json:"requestId,omitempty"`
 }
 
 type RequestEvent struct {
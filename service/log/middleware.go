@@ -0,0 +1,222 @@
+package log
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_VISITOR_COOKIE         = "visitorId"
+	DEFAULT_VISITOR_COOKIE_MAX_AGE = 365 * 24 * time.Hour
+	DEFAULT_REQUEST_ID_HEADER      = "X-Request-Id"
+	// MAX_VISITOR_ID_LENGTH bounds the visitor cookie, longer values are replaced by a new id
+	MAX_VISITOR_ID_LENGTH = 64
+)
+
+// MiddlewareOptions controls how the middleware identifies visitors.
+// Zero values fall back to the defaults above.
+type MiddlewareOptions struct {
+	CookieName   string
+	CookieMaxAge time.Duration
+	CookieDomain string
+	CookiePath   string
+	Secure       bool
+	// RequestIdHeader is read into the request id of the event and the request context
+	RequestIdHeader string
+}
+
+type collectorKey struct{}
+
+// Collector gathers the user events of a single request, it's safe for concurrent use.
+type Collector struct {
+	mu     sync.Mutex
+	common *RequestCommon
+	events []*UserEvent
+}
+
+// AddEvent appends user events to the request event.
+func (c *Collector) AddEvent(events ...*UserEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, events...)
+}
+
+// SetUser records the authenticated user of the request.
+func (c *Collector) SetUser(userName string, userId *string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.common.UserName = userName
+	c.common.UserId = userId
+}
+
+// VisitorId returns the visitor id read from or issued to the request.
+func (c *Collector) VisitorId() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.common.VisitorId
+}
+
+// requestEvent returns a copy of the collected event, handlers may still add events
+// from their goroutines while it's written
+func (c *Collector) requestEvent() *RequestEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	common := *c.common
+	return &RequestEvent{
+		RequestCommon: &common,
+		UserEvents:    append([]*UserEvent{}, c.events...),
+	}
+}
+
+// CollectorFromContext returns the collector stored by Middleware, or nil if there is none.
+func CollectorFromContext(ctx context.Context) *Collector {
+	collector, _ := ctx.Value(collectorKey{}).(*Collector)
+	return collector
+}
+
+// AddEvent appends user events to the collector in ctx, it's a no-op outside of Middleware.
+func AddEvent(ctx context.Context, events ...*UserEvent) {
+	if collector := CollectorFromContext(ctx); collector != nil {
+		collector.AddEvent(events...)
+	}
+}
+
+// Middleware builds a RequestEvent for every request and writes it to logName
+// once the response is completed.
+func Middleware(logger Log, logName string, opts MiddlewareOptions) func(http.Handler) http.Handler {
+	if opts.CookieName == "" {
+		opts.CookieName = DEFAULT_VISITOR_COOKIE
+	}
+	if opts.CookieMaxAge == 0 {
+		opts.CookieMaxAge = DEFAULT_VISITOR_COOKIE_MAX_AGE
+	}
+	if opts.CookiePath == "" {
+		opts.CookiePath = "/"
+	}
+	if opts.RequestIdHeader == "" {
+		opts.RequestIdHeader = DEFAULT_REQUEST_ID_HEADER
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			common := &RequestCommon{
+				MicroTimestamp: float64(start.UnixNano()) / 1e6,
+			}
+			if cookie, err := r.Cookie(opts.CookieName); err == nil && validVisitorId(cookie.Value) {
+				common.VisitorId = cookie.Value
+			} else {
+				common.VisitorId = newVisitorId()
+				common.IsNewVisitor = true
+				http.SetCookie(w, &http.Cookie{
+					Name:     opts.CookieName,
+					Value:    common.VisitorId,
+					Path:     opts.CookiePath,
+					Domain:   opts.CookieDomain,
+					MaxAge:   int(opts.CookieMaxAge / time.Second),
+					Secure:   opts.Secure,
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+
+			ctx := r.Context()
+			if requestId := r.Header.Get(opts.RequestIdHeader); requestId != "" {
+				ctx = WithRequestId(ctx, requestId)
+			}
+
+			collector := &Collector{common: common}
+			ctx = context.WithValue(ctx, collectorKey{}, collector)
+			sw := &statusWriter{ResponseWriter: w}
+
+			defer func() {
+				p := recover()
+				if p != nil && sw.status == 0 {
+					// the server answers a panic with a 500 only if nothing was written yet
+					sw.status = http.StatusInternalServerError
+				}
+
+				collector.mu.Lock()
+				common.StatusCode = sw.statusCode()
+				common.LatencyMs = float64(time.Since(start).Microseconds()) / 1e3
+				collector.mu.Unlock()
+
+				logger.WriteLogContext(ctx, logName, collector.requestEvent())
+
+				if p != nil {
+					panic(p)
+				}
+			}()
+
+			next.ServeHTTP(sw, r.WithContext(ctx))
+		})
+	}
+}
+
+func newVisitorId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// fall back to a time based id, it's still unique enough for a visitor
+		return hex.EncodeToString([]byte(time.Now().Format(time.RFC3339Nano)))
+	}
+	return hex.EncodeToString(b)
+}
+
+// validVisitorId accepts the ids issued by newVisitorId and the ones of other services,
+// as long as they are short and made of letters, digits, '-' and '_'
+func validVisitorId(visitorId string) bool {
+	if visitorId == "" || len(visitorId) > MAX_VISITOR_ID_LENGTH {
+		return false
+	}
+	for _, c := range visitorId {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// statusWriter records the status code written by the handler
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
@@ -0,0 +1,108 @@
+package log
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serveLogged(t *testing.T, handler http.HandlerFunc, r *http.Request) (*httptest.ResponseRecorder, *RequestEvent) {
+	memoryLog := NewMemoryLog(10)
+	rec := httptest.NewRecorder()
+	Middleware(memoryLog, "requests", MiddlewareOptions{})(handler).ServeHTTP(rec, r)
+
+	entries := memoryLog.Entries()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "requests", entries[0].LogName)
+	return rec, entries[0].RequestEvent
+}
+
+func TestMiddlewareRecordsStatusAndLatency(t *testing.T) {
+	_, event := serveLogged(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		AddEvent(r.Context(), &UserEvent{EventType: "impression", Count: 1})
+		w.WriteHeader(http.StatusCreated)
+	}, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusCreated, event.RequestCommon.StatusCode)
+	assert.GreaterOrEqual(t, event.RequestCommon.LatencyMs, 20.0)
+	require.Len(t, event.UserEvents, 1)
+	assert.Equal(t, "impression", event.UserEvents[0].EventType)
+
+	_, event = serveLogged(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, event.RequestCommon.StatusCode)
+}
+
+func TestMiddlewareVisitorCookie(t *testing.T) {
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+
+	// a new visitor gets a cookie
+	rec, event := serveLogged(t, noop, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, DEFAULT_VISITOR_COOKIE, cookies[0].Name)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.Equal(t, cookies[0].Value, event.RequestCommon.VisitorId)
+	assert.True(t, event.RequestCommon.IsNewVisitor)
+
+	// a returning visitor keeps theirs
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: DEFAULT_VISITOR_COOKIE, Value: "returning-visitor_1"})
+	rec, event = serveLogged(t, noop, r)
+	assert.Empty(t, rec.Result().Cookies())
+	assert.Equal(t, "returning-visitor_1", event.RequestCommon.VisitorId)
+	assert.False(t, event.RequestCommon.IsNewVisitor)
+
+	// forged or oversized cookies are replaced
+	for _, value := range []string{"a.b", "<script>", strings.Repeat("a", MAX_VISITOR_ID_LENGTH+1)} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Cookie", DEFAULT_VISITOR_COOKIE+"="+value)
+		rec, event := serveLogged(t, noop, r)
+		require.Len(t, rec.Result().Cookies(), 1, value)
+		assert.NotEqual(t, value, event.RequestCommon.VisitorId, value)
+		assert.True(t, event.RequestCommon.IsNewVisitor, value)
+	}
+}
+
+func TestMiddlewareRecordsPanics(t *testing.T) {
+	memoryLog := NewMemoryLog(10)
+	middleware := Middleware(memoryLog, "requests", MiddlewareOptions{})
+
+	assert.PanicsWithValue(t, "boom", func() {
+		middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}, "the panic goes on to the server")
+	assert.Panics(t, func() {
+		middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+			panic("boom")
+		})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+
+	entries := memoryLog.Entries()
+	require.Len(t, entries, 2)
+	assert.Equal(t, http.StatusInternalServerError, entries[0].RequestEvent.RequestCommon.StatusCode)
+	assert.Equal(t, http.StatusAccepted, entries[1].RequestEvent.RequestCommon.StatusCode, "a written status is kept")
+}
+
+func TestMiddlewareEventIsACopy(t *testing.T) {
+	memoryLog := NewMemoryLog(10)
+	var collector *Collector
+	Middleware(memoryLog, "requests", MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		collector = CollectorFromContext(r.Context())
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	event := collector.requestEvent()
+	collector.AddEvent(&UserEvent{EventType: "late"})
+	collector.SetUser("alice", nil)
+	assert.Empty(t, event.UserEvents)
+	assert.Empty(t, event.RequestCommon.UserName)
+}
@@ -3,6 +3,8 @@
 package mocks
 
 import (
+	context "context"
+
 	log "github.com/smallhouse123/go-library/service/log"
 	mock "github.com/stretchr/testify/mock"
 )
@@ -22,6 +24,11 @@ func (_m *Log) WriteLog(logName string, requestEvent *log.RequestEvent) {
 	_m.Called(logName, requestEvent)
 }
 
+// WriteLogContext provides a mock function with given fields: ctx, logName, requestEvent
+func (_m *Log) WriteLogContext(ctx context.Context, logName string, requestEvent *log.RequestEvent) {
+	_m.Called(ctx, logName, requestEvent)
+}
+
 // NewLog creates a new instance of Log. It also registers a testing interface on the mock and a cleanup function to assert the mocks expectations.
 // The first argument is typically a *testing.T value.
 func NewLog(t interface {
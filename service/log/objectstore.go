@@ -0,0 +1,114 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/smallhouse123/go-library/service/config"
+)
+
+const (
+	OBJECT_STORE_S3    = "s3"
+	OBJECT_STORE_LOCAL = "local"
+)
+
+var (
+	ErrObjectNotFound = errors.New("object not found")
+)
+
+// ObjectStore is where closed log files are shipped to.
+type ObjectStore interface {
+	// Put uploads size bytes read from r to key, replacing any existing object.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+
+	// Stat returns the info of the object at key, or ErrObjectNotFound if there is none.
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+}
+
+type ObjectInfo struct {
+	Key  string
+	Size int64
+}
+
+// NewObjectStore builds the store selected by LOG_UPLOAD_STORE.
+func NewObjectStore(configService config.Config) (ObjectStore, error) {
+	switch store := getConfigString(configService, "LOG_UPLOAD_STORE", ""); store {
+	case OBJECT_STORE_S3:
+		return NewS3Store(S3Options{
+			Endpoint:     getConfigString(configService, "LOG_UPLOAD_S3_ENDPOINT", ""),
+			Region:       getConfigString(configService, "LOG_UPLOAD_S3_REGION", DEFAULT_S3_REGION),
+			Bucket:       getConfigString(configService, "LOG_UPLOAD_S3_BUCKET", ""),
+			AccessKey:    getConfigString(configService, "LOG_UPLOAD_S3_ACCESS_KEY", ""),
+			SecretKey:    getConfigString(configService, "LOG_UPLOAD_S3_SECRET_KEY", ""),
+			SessionToken: getConfigString(configService, "LOG_UPLOAD_S3_SESSION_TOKEN", ""),
+			PathStyle:    getConfigBool(configService, "LOG_UPLOAD_S3_PATH_STYLE", false),
+		})
+	case OBJECT_STORE_LOCAL:
+		dir := getConfigString(configService, "LOG_UPLOAD_LOCAL_DIR", "")
+		if dir == "" {
+			return nil, errors.New("LOG_UPLOAD_LOCAL_DIR is not set")
+		}
+		return NewLocalStore(dir), nil
+	case "":
+		return nil, errors.New("LOG_UPLOAD_STORE is not set")
+	default:
+		return nil, fmt.Errorf("unknown object store '%s'", store)
+	}
+}
+
+// LocalStore keeps objects as files under a directory, it's meant for tests and local runs.
+type LocalStore struct {
+	dir string
+}
+
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{dir: dir}
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so a failed upload never leaves a partial object
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if n != size {
+		tmp.Close()
+		return fmt.Errorf("wrote %d bytes to '%s', expected %d", n, key, size)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := os.Stat(filepath.Join(s.dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return ObjectInfo{}, ErrObjectNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: info.Size()}, nil
+}
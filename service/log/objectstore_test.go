@@ -0,0 +1,54 @@
+package log
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalStore(t *testing.T) {
+	dir := t.TempDir()
+	store := NewLocalStore(dir)
+	ctx := context.Background()
+
+	require.NoError(t, store.Put(ctx, "pod/a/b.log.gz", strings.NewReader("hello"), 5))
+
+	info, err := store.Stat(ctx, "pod/a/b.log.gz")
+	require.NoError(t, err)
+	assert.Equal(t, ObjectInfo{Key: "pod/a/b.log.gz", Size: 5}, info)
+
+	data, err := os.ReadFile(filepath.Join(dir, "pod", "a", "b.log.gz"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// a replaced object is overwritten
+	require.NoError(t, store.Put(ctx, "pod/a/b.log.gz", strings.NewReader("hi"), 2))
+	info, err = store.Stat(ctx, "pod/a/b.log.gz")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), info.Size)
+}
+
+func TestLocalStoreShortWrite(t *testing.T) {
+	dir := t.TempDir()
+	store := NewLocalStore(dir)
+	ctx := context.Background()
+
+	assert.Error(t, store.Put(ctx, "short.gz", strings.NewReader("abc"), 10))
+
+	// nothing is left behind, not even the temporary file
+	_, err := store.Stat(ctx, "short.gz")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestLocalStoreStatMissing(t *testing.T) {
+	_, err := NewLocalStore(t.TempDir()).Stat(context.Background(), "missing")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+}
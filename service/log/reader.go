@@ -0,0 +1,74 @@
+package log
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ReadEvents calls fn with every event of an NDJSON log file and the byte offset of its line.
+// Lines that aren't valid events are skipped, reading stops at the first error returned by fn.
+func ReadEvents(r io.Reader, fn func(offset int64, requestEvent *RequestEvent) error) error {
+	reader := bufio.NewReaderSize(r, 64*1024)
+
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			lineOffset := offset
+			offset += int64(len(line))
+
+			requestEvent := &RequestEvent{}
+			if jsonErr := json.Unmarshal(line, requestEvent); jsonErr == nil {
+				if fnErr := fn(lineOffset, requestEvent); fnErr != nil {
+					return fnErr
+				}
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// IsLogFile tells if a path is an hourly log file OpenLogFile reads, either a local .log file
+// or a shipped .log.gz object. Claimed, temporary and compact files are not.
+func IsLogFile(path string) bool {
+	return strings.HasSuffix(path, LOG_SUFFIX) || strings.HasSuffix(path, LOG_SUFFIX+COMPRESSED_SUFFIX)
+}
+
+// OpenLogFile opens an hourly log file for reading, files ending in .gz are decompressed.
+func OpenLogFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, COMPRESSED_SUFFIX) {
+		return file, nil
+	}
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to decompress %s: %v", path, err)
+	}
+	return &gzipFile{Reader: zr, file: file}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (f *gzipFile) Close() error {
+	f.Reader.Close()
+	return f.file.Close()
+}
@@ -0,0 +1,21 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsLogFile(t *testing.T) {
+	for path, want := range map[string]bool{
+		"24_03_01__09.log":                     true,
+		"pod/24_03_01__09.0123456789ab.log.gz": true,
+		"24_03_01__09.log.claimed":             false,
+		"24_03_01__09.log.gz.tmp":              false,
+		"24_03_01__09.log.idx":                 false,
+		"24_03_01__09.relpb.gz":                false,
+		"24_03_01__09.log.gz.manifest.json":    false,
+	} {
+		assert.Equal(t, want, IsLogFile(path), path)
+	}
+}
@@ -0,0 +1,281 @@
+package log
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/smallhouse123/go-library/service/config"
+)
+
+const (
+	SAMPLING_MODE_FIXED   = "fixed"
+	SAMPLING_MODE_VISITOR = "visitor"
+
+	// matches any logName or eventType in a sampling rule
+	SAMPLING_WILDCARD = "*"
+)
+
+// samplingRule decides whether user events of a logName and eventType are kept.
+// A rule is configured under LOG_SAMPLING_RULES, e.g.
+//
+//	LOG_SAMPLING_RULES:
+//	  - logName: user_activity
+//	    eventType: scroll
+//	    mode: visitor
+//	    rate: 0.1
+//	    maxPerSecond: 500
+type samplingRule struct {
+	logName   string
+	eventType string
+	rate      float64
+	byVisitor bool
+	limiter   *tokenBucket
+}
+
+func (r *samplingRule) match(logName, eventType string) bool {
+	return (r.logName == SAMPLING_WILDCARD || r.logName == logName) &&
+		(r.eventType == SAMPLING_WILDCARD || r.eventType == eventType)
+}
+
+// keep decides whether an event is kept, it returns the rate it was kept at. With maxPerSecond
+// the rate also accounts for the share of events the token bucket let through, so kept events can be re-weighted.
+func (r *samplingRule) keep(visitorId string, now time.Time) (bool, float64) {
+	if r.rate < 1 {
+		var p float64
+		if r.byVisitor && visitorId != "" {
+			p = hashToUnit(visitorId)
+		} else {
+			p = rand.Float64()
+		}
+		if p >= r.rate {
+			return false, 0
+		}
+	}
+	if r.limiter == nil {
+		return true, r.rate
+	}
+	allowed, ratio := r.limiter.allow(now)
+	return allowed, r.rate * ratio
+}
+
+type sampler struct {
+	rules []*samplingRule
+}
+
+func newSampler(configService config.Config) (*sampler, error) {
+	val, err := configService.Get("LOG_SAMPLING_RULES")
+	if err != nil {
+		return &sampler{}, nil
+	}
+
+	rawRules, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("LOG_SAMPLING_RULES must be a list, got %T", val)
+	}
+
+	s := &sampler{}
+	for i, rawRule := range rawRules {
+		m, ok := rawRule.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("sampling rule %d must be a map, got %T", i, rawRule)
+		}
+
+		rule := &samplingRule{
+			logName:   SAMPLING_WILDCARD,
+			eventType: SAMPLING_WILDCARD,
+			rate:      1,
+		}
+		if v, ok := m["logName"].(string); ok && v != "" {
+			rule.logName = v
+		}
+		if v, ok := m["eventType"].(string); ok && v != "" {
+			rule.eventType = v
+		}
+		if v, ok := toFloat(m["rate"]); ok {
+			if v < 0 || v > 1 {
+				return nil, fmt.Errorf("sampling rule %d: rate %v is not within [0, 1]", i, v)
+			}
+			rule.rate = v
+		}
+		switch mode, _ := m["mode"].(string); mode {
+		case "", SAMPLING_MODE_FIXED:
+		case SAMPLING_MODE_VISITOR:
+			rule.byVisitor = true
+		default:
+			return nil, fmt.Errorf("sampling rule %d: unknown mode '%s'", i, mode)
+		}
+		if v, ok := toFloat(m["maxPerSecond"]); ok && v > 0 {
+			rule.limiter = newTokenBucket(v)
+		}
+
+		s.rules = append(s.rules, rule)
+	}
+
+	return s, nil
+}
+
+// sample returns the event holding only the kept user events, the request itself is still logged
+// when all of them are dropped. Kept user events are copied with the applied sample rate, so the caller's event is never modified.
+func (s *sampler) sample(logName string, requestEvent *RequestEvent, now time.Time) *RequestEvent {
+	if len(s.rules) == 0 || requestEvent == nil || len(requestEvent.UserEvents) == 0 {
+		return requestEvent
+	}
+
+	var visitorId string
+	if requestEvent.RequestCommon != nil {
+		visitorId = requestEvent.RequestCommon.VisitorId
+	}
+
+	sampled := false
+	userEvents := make([]*UserEvent, 0, len(requestEvent.UserEvents))
+	for _, userEvent := range requestEvent.UserEvents {
+		if userEvent == nil {
+			continue
+		}
+
+		rule := s.ruleFor(logName, userEvent.EventType)
+		if rule == nil {
+			userEvents = append(userEvents, userEvent)
+			continue
+		}
+
+		sampled = true
+		ok, rate := rule.keep(visitorId, now)
+		if !ok {
+			continue
+		}
+
+		kept := *userEvent
+		kept.SampleRate = rate
+		userEvents = append(userEvents, &kept)
+	}
+
+	if !sampled {
+		return requestEvent
+	}
+
+	return &RequestEvent{
+		RequestCommon: requestEvent.RequestCommon,
+		UserEvents:    userEvents,
+	}
+}
+
+func (s *sampler) ruleFor(logName, eventType string) *samplingRule {
+	for _, rule := range s.rules {
+		if rule.match(logName, eventType) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// hashToUnit maps a string to [0, 1), the same string always gets the same value
+func hashToUnit(s string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	// fnv doesn't spread short inputs over the high bits, mix them before scaling
+	return float64(mix64(h.Sum64())>>11) / (1 << 53)
+}
+
+// mix64 is the murmur3 finalizer, it spreads every input bit over the whole value
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// tokenBucket allows up to rate events per second, with a burst of the same size.
+// It counts the events it sees and lets through to report its keep ratio.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	// counts of the current and the previous second
+	second   time.Time
+	seen     int
+	kept     int
+	prevSeen int
+	prevKept int
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		tokens: rate,
+	}
+}
+
+// allow takes a token if there is one, and returns the share of events kept during the last second.
+func (b *tokenBucket) allow(now time.Time) (bool, float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+
+	if second := now.Truncate(time.Second); !second.Equal(b.second) {
+		b.prevSeen, b.prevKept = 0, 0
+		if second.Sub(b.second) == time.Second {
+			b.prevSeen, b.prevKept = b.seen, b.kept
+		}
+		b.second = second
+		b.seen = 0
+		b.kept = 0
+	}
+	b.seen++
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+		b.kept++
+	}
+	return allowed, b.ratio(now)
+}
+
+// ratio estimates the keep ratio over the second before now, the counts of the previous second are
+// weighted by how much of it is still within that window. It's rounded to 2 significant digits,
+// so aggregated events mostly share a sample rate.
+func (b *tokenBucket) ratio(now time.Time) float64 {
+	weight := 1 - now.Sub(b.second).Seconds()
+	seen := float64(b.seen) + float64(b.prevSeen)*weight
+	kept := float64(b.kept) + float64(b.prevKept)*weight
+	if kept <= 0 {
+		return 0
+	}
+	if kept >= seen {
+		return 1
+	}
+
+	ratio := kept / seen
+	scale := math.Pow(10, 1-math.Floor(math.Log10(ratio)))
+	return math.Round(ratio*scale) / scale
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
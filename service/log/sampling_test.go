@@ -0,0 +1,133 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSampler(t *testing.T, rules ...interface{}) *sampler {
+	s, err := newSampler(newTestConfig(t, map[string]interface{}{"LOG_SAMPLING_RULES": rules}))
+	require.NoError(t, err)
+	return s
+}
+
+func visitorEvent(visitorId string, eventTypes ...string) *RequestEvent {
+	requestEvent := &RequestEvent{RequestCommon: &RequestCommon{VisitorId: visitorId}}
+	for _, eventType := range eventTypes {
+		requestEvent.UserEvents = append(requestEvent.UserEvents, &UserEvent{EventType: eventType, Count: 1})
+	}
+	return requestEvent
+}
+
+func eventTypes(requestEvent *RequestEvent) []string {
+	types := []string{}
+	for _, userEvent := range requestEvent.UserEvents {
+		types = append(types, userEvent.EventType)
+	}
+	return types
+}
+
+func TestSamplingByVisitorIsConsistent(t *testing.T) {
+	s := newTestSampler(t, map[string]interface{}{"eventType": "scroll", "mode": SAMPLING_MODE_VISITOR, "rate": 0.5})
+	now := time.Now()
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		visitorId := fmt.Sprintf("visitor-%d", i)
+		first := len(s.sample("access", visitorEvent(visitorId, "scroll"), now).UserEvents)
+		for j := 0; j < 5; j++ {
+			require.Equal(t, first, len(s.sample("access", visitorEvent(visitorId, "scroll"), now).UserEvents),
+				"a visitor is always kept or always dropped")
+		}
+		kept += first
+	}
+	assert.InDelta(t, 500, kept, 60)
+}
+
+func TestSamplingRatesPerEventType(t *testing.T) {
+	s := newTestSampler(t,
+		map[string]interface{}{"logName": "access", "eventType": "scroll", "rate": 0},
+		map[string]interface{}{"eventType": "hover", "rate": 1},
+		map[string]interface{}{"eventType": "*", "rate": 0.25},
+	)
+	now := time.Now()
+
+	sampled := s.sample("access", visitorEvent("a", "scroll", "hover"), now)
+	assert.Equal(t, []string{"hover"}, eventTypes(sampled))
+	assert.Equal(t, 1.0, sampled.UserEvents[0].SampleRate)
+
+	// the scroll rule only applies to access, other log names get the catch-all rate
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		sampled := s.sample("other", visitorEvent("a", "scroll"), now)
+		for _, userEvent := range sampled.UserEvents {
+			assert.Equal(t, 0.25, userEvent.SampleRate)
+			kept++
+		}
+	}
+	assert.InDelta(t, 250, kept, 60)
+
+	// the request is still logged when every event is dropped
+	requestEvent := visitorEvent("a", "scroll")
+	sampled = s.sample("access", requestEvent, now)
+	require.NotNil(t, sampled)
+	assert.Same(t, requestEvent.RequestCommon, sampled.RequestCommon)
+	assert.Empty(t, sampled.UserEvents)
+	assert.Len(t, requestEvent.UserEvents, 1, "the caller's event isn't modified")
+}
+
+func TestSamplingTokenBucketCap(t *testing.T) {
+	s := newTestSampler(t, map[string]interface{}{"eventType": "scroll", "maxPerSecond": 10})
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+
+	// a burst is capped by the bucket size
+	kept := 0
+	for i := 0; i < 100; i++ {
+		kept += len(s.sample("access", visitorEvent("a", "scroll"), start).UserEvents)
+	}
+	assert.Equal(t, 10, kept)
+
+	// at a steady 100 events per second, a tenth is kept and re-weighted by 10
+	rates := []float64{}
+	for i := 0; i < 400; i++ {
+		now := start.Add(time.Second + time.Duration(i)*10*time.Millisecond)
+		for _, userEvent := range s.sample("access", visitorEvent("a", "scroll"), now).UserEvents {
+			// the second after the burst still gets the tokens refilled meanwhile
+			if now.Sub(start) >= 3*time.Second {
+				rates = append(rates, userEvent.SampleRate)
+			}
+		}
+	}
+	assert.InDelta(t, 20, len(rates), 1)
+	for _, rate := range rates {
+		assert.InDelta(t, 0.1, rate, 0.011)
+	}
+}
+
+func TestSampledOutRequestIsWritten(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 9, 15, 0, 0, time.UTC)}
+	im := newTestLog(t, clock, map[string]interface{}{
+		"LOG_TIMEZONE":        "UTC",
+		"LOG_FLUSH_THRESHOLD": 1,
+		"LOG_SAMPLING_RULES":  []interface{}{map[string]interface{}{"eventType": "scroll", "rate": 0}},
+	})
+	defer im.Close()
+
+	im.WriteLog("access", visitorEvent("a", "scroll"))
+
+	path := filepath.Join(im.Dir(), "24_03_01__09.log")
+	require.Eventually(t, func() bool { return exists(path) }, time.Second, 10*time.Millisecond)
+	lines := readLines(t, path)
+	require.Len(t, lines, 1)
+
+	var requestEvent RequestEvent
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &requestEvent))
+	assert.Equal(t, "a", requestEvent.RequestCommon.VisitorId)
+	assert.Empty(t, requestEvent.UserEvents)
+}
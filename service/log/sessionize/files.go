@@ -0,0 +1,73 @@
+package sessionize
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/smallhouse123/go-library/service/log"
+)
+
+var errStop = errors.New("stop")
+
+// SortFiles orders log files by the time of their first event, so any file template reads in time order.
+// Files without events go first.
+func SortFiles(paths []string) ([]string, error) {
+	starts := map[string]time.Time{}
+	for _, path := range paths {
+		start, err := firstEventTime(path)
+		if err != nil {
+			return nil, err
+		}
+		starts[path] = start
+	}
+
+	sorted := append([]string{}, paths...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !starts[sorted[i]].Equal(starts[sorted[j]]) {
+			return starts[sorted[i]].Before(starts[sorted[j]])
+		}
+		return sorted[i] < sorted[j]
+	})
+	return sorted, nil
+}
+
+func firstEventTime(path string) (time.Time, error) {
+	file, err := log.OpenLogFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	var start time.Time
+	err = log.ReadEvents(file, func(offset int64, requestEvent *log.RequestEvent) error {
+		if requestEvent.RequestCommon == nil || requestEvent.RequestCommon.MicroTimestamp <= 0 {
+			return nil
+		}
+		start = time.UnixMicro(int64(requestEvent.RequestCommon.MicroTimestamp * 1e3))
+		return errStop
+	})
+	if err != nil && err != errStop {
+		return time.Time{}, err
+	}
+	return start, nil
+}
+
+// AddFile adds the events of a log file, gzipped files are decompressed
+func (s *Sessionizer) AddFile(path string) error {
+	file, err := log.OpenLogFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return s.AddReader(file)
+}
+
+// AddReader adds the events of an NDJSON stream
+func (s *Sessionizer) AddReader(r io.Reader) error {
+	return log.ReadEvents(r, func(offset int64, requestEvent *log.RequestEvent) error {
+		return s.Add(requestEvent)
+	})
+}
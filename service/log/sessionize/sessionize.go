@@ -0,0 +1,248 @@
+// Package sessionize rebuilds visitor sessions from the events of the hourly request logs.
+package sessionize
+
+import (
+	"sort"
+	"time"
+
+	"github.com/smallhouse123/go-library/service/log"
+)
+
+const (
+	DEFAULT_GAP             = 30 * time.Minute
+	DEFAULT_LATENESS        = time.Hour
+	DEFAULT_PAGE_EVENT_TYPE = "page_view"
+)
+
+type Options struct {
+	// Gap is the inactivity that ends a session
+	Gap time.Duration
+	// Lateness is how far behind the newest event an event may arrive, sessions stay open that much longer.
+	// Files of the same hour written by different pods are read one after the other, so it defaults to an hour.
+	Lateness time.Duration
+	// PageEventTypes are the user event types counted as pages
+	PageEventTypes []string
+}
+
+// Event is the entry or exit event of a session
+type Event struct {
+	Time      time.Time              `json:"time"`
+	EventType string                 `json:"eventType"`
+	Metadata  map[string]interface{} `json:"metadata"`
+}
+
+type Session struct {
+	VisitorId string `json:"visitorId"`
+	// UserId is the last user the visitor was logged in as during the session
+	UserId          *string   `json:"userId"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Requests        int       `json:"requests"`
+	Pages           int       `json:"pages"`
+	Events          int       `json:"events"`
+	// IsNewVisitor is set when the visitor got its id during the session
+	IsNewVisitor bool `json:"isNewVisitor"`
+	// Entry and Exit are the first and last page events, or user events of any type when there were no pages
+	Entry *Event `json:"entry"`
+	Exit  *Event `json:"exit"`
+
+	userIdTime time.Time
+	entryPage  bool
+	exitPage   bool
+}
+
+// Sessionizer groups events by visitor into sessions and emits every session once it can't grow anymore.
+// Events should come roughly in time order, within Options.Lateness.
+type Sessionizer struct {
+	gap        time.Duration
+	lateness   time.Duration
+	pageTypes  map[string]struct{}
+	emit       func(*Session) error
+	open       map[string][]*Session
+	watermark  time.Time
+	lastExpire time.Time
+	skipped    int
+}
+
+func New(opts Options, emit func(*Session) error) *Sessionizer {
+	if opts.Gap <= 0 {
+		opts.Gap = DEFAULT_GAP
+	}
+	if opts.Lateness < 0 {
+		opts.Lateness = 0
+	}
+	if opts.PageEventTypes == nil {
+		opts.PageEventTypes = []string{DEFAULT_PAGE_EVENT_TYPE}
+	}
+
+	pageTypes := map[string]struct{}{}
+	for _, eventType := range opts.PageEventTypes {
+		pageTypes[eventType] = struct{}{}
+	}
+
+	return &Sessionizer{
+		gap:       opts.Gap,
+		lateness:  opts.Lateness,
+		pageTypes: pageTypes,
+		emit:      emit,
+		open:      map[string][]*Session{},
+	}
+}
+
+// Add adds a request event to the session of its visitor. Events without a visitor are skipped, and so are
+// events without a timestamp, which can't be placed in any session.
+func (s *Sessionizer) Add(requestEvent *log.RequestEvent) error {
+	if requestEvent == nil || requestEvent.RequestCommon == nil || requestEvent.RequestCommon.VisitorId == "" {
+		return nil
+	}
+	if requestEvent.RequestCommon.MicroTimestamp <= 0 {
+		s.skipped++
+		return nil
+	}
+
+	session := s.newSession(requestEvent)
+	if session.Start.After(s.watermark) {
+		s.watermark = session.Start
+	}
+
+	// a late event can bridge two sessions of the visitor, they are merged then
+	visitorId := session.VisitorId
+	kept := []*Session{}
+	for _, other := range s.open[visitorId] {
+		if other.Start.After(session.End.Add(s.gap)) || session.Start.After(other.End.Add(s.gap)) {
+			kept = append(kept, other)
+			continue
+		}
+		session.merge(other)
+	}
+	s.open[visitorId] = append(kept, session)
+
+	if s.watermark.Sub(s.lastExpire) >= s.gap {
+		s.lastExpire = s.watermark
+		return s.expire(s.watermark.Add(-s.gap - s.lateness))
+	}
+	return nil
+}
+
+// Skipped returns the number of events skipped for having no timestamp
+func (s *Sessionizer) Skipped() int {
+	return s.skipped
+}
+
+// Close emits the sessions still open
+func (s *Sessionizer) Close() error {
+	return s.expire(time.Time{})
+}
+
+// expire emits the sessions that ended before cutoff, or all of them for a zero cutoff, in start order
+func (s *Sessionizer) expire(cutoff time.Time) error {
+	expired := []*Session{}
+	for visitorId, sessions := range s.open {
+		kept := sessions[:0]
+		for _, session := range sessions {
+			if cutoff.IsZero() || session.End.Before(cutoff) {
+				expired = append(expired, session)
+			} else {
+				kept = append(kept, session)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.open, visitorId)
+		} else {
+			s.open[visitorId] = kept
+		}
+	}
+
+	sort.Slice(expired, func(i, j int) bool {
+		if !expired[i].Start.Equal(expired[j].Start) {
+			return expired[i].Start.Before(expired[j].Start)
+		}
+		return expired[i].VisitorId < expired[j].VisitorId
+	})
+	for _, session := range expired {
+		session.DurationSeconds = session.End.Sub(session.Start).Seconds()
+		if err := s.emit(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newSession returns the session of a single request
+func (s *Sessionizer) newSession(requestEvent *log.RequestEvent) *Session {
+	common := requestEvent.RequestCommon
+	t := time.UnixMicro(int64(common.MicroTimestamp * 1e3)).UTC()
+
+	session := &Session{
+		VisitorId:    common.VisitorId,
+		Start:        t,
+		End:          t,
+		Requests:     1,
+		IsNewVisitor: common.IsNewVisitor,
+		userIdTime:   t,
+	}
+	if common.UserId != nil && *common.UserId != "" {
+		userId := *common.UserId
+		session.UserId = &userId
+	}
+
+	for _, userEvent := range requestEvent.UserEvents {
+		if userEvent == nil {
+			continue
+		}
+		count := userEvent.Count
+		if count <= 0 {
+			count = 1
+		}
+		session.Events += count
+
+		_, isPage := s.pageTypes[userEvent.EventType]
+		if isPage {
+			session.Pages += count
+		}
+
+		event := &Event{Time: t, EventType: userEvent.EventType, Metadata: userEvent.Metadata}
+		// the first page wins over any earlier event
+		if session.Entry == nil || (isPage && !session.entryPage) {
+			session.Entry = event
+			session.entryPage = isPage
+		}
+		if isPage || !session.exitPage {
+			session.Exit = event
+			session.exitPage = isPage
+		}
+	}
+
+	return session
+}
+
+// merge adds other to the session
+func (session *Session) merge(other *Session) {
+	if other.UserId != nil && (session.UserId == nil || other.userIdTime.After(session.userIdTime)) {
+		session.UserId = other.UserId
+		session.userIdTime = other.userIdTime
+	}
+
+	if session.Entry == nil || (other.Entry != nil && ((other.entryPage && !session.entryPage) ||
+		(other.entryPage == session.entryPage && other.Entry.Time.Before(session.Entry.Time)))) {
+		session.Entry = other.Entry
+		session.entryPage = other.entryPage
+	}
+	if session.Exit == nil || (other.Exit != nil && ((other.exitPage && !session.exitPage) ||
+		(other.exitPage == session.exitPage && !other.Exit.Time.Before(session.Exit.Time)))) {
+		session.Exit = other.Exit
+		session.exitPage = other.exitPage
+	}
+
+	if other.Start.Before(session.Start) {
+		session.Start = other.Start
+	}
+	if other.End.After(session.End) {
+		session.End = other.End
+	}
+	session.Requests += other.Requests
+	session.Pages += other.Pages
+	session.Events += other.Events
+	session.IsNewVisitor = session.IsNewVisitor || other.IsNewVisitor
+}
@@ -0,0 +1,164 @@
+package sessionize
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smallhouse123/go-library/service/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var base = time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+func at(minutes int) time.Time {
+	return base.Add(time.Duration(minutes) * time.Minute)
+}
+
+// millis is the timestamp of a request event, milliseconds with a microsecond fraction
+func millis(t time.Time) float64 {
+	return float64(t.UnixMicro()) / 1e3
+}
+
+func request(visitorId string, t time.Time, eventTypes ...string) *log.RequestEvent {
+	requestEvent := &log.RequestEvent{RequestCommon: &log.RequestCommon{
+		MicroTimestamp: millis(t),
+		VisitorId:      visitorId,
+	}}
+	for _, eventType := range eventTypes {
+		requestEvent.UserEvents = append(requestEvent.UserEvents, &log.UserEvent{EventType: eventType, Count: 1})
+	}
+	return requestEvent
+}
+
+// newTestSessionizer returns a sessionizer with a 30 minute gap and an hour of lateness, and the sessions it emitted
+func newTestSessionizer() (*Sessionizer, *[]*Session) {
+	emitted := []*Session{}
+	s := New(Options{Gap: 30 * time.Minute, Lateness: time.Hour}, func(session *Session) error {
+		emitted = append(emitted, session)
+		return nil
+	})
+	return s, &emitted
+}
+
+func add(t *testing.T, s *Sessionizer, requestEvents ...*log.RequestEvent) {
+	for _, requestEvent := range requestEvents {
+		require.NoError(t, s.Add(requestEvent))
+	}
+}
+
+func TestSessionMergesConsecutiveEvents(t *testing.T) {
+	s, emitted := newTestSessionizer()
+	userId := "u-1"
+	login := request("a", at(20), "click")
+	login.RequestCommon.UserId = &userId
+	login.RequestCommon.IsNewVisitor = true
+
+	add(t, s,
+		request("a", at(0), "impression"),
+		request("a", at(5), DEFAULT_PAGE_EVENT_TYPE),
+		login,
+		request("a", at(45), DEFAULT_PAGE_EVENT_TYPE, "scroll"),
+	)
+	require.NoError(t, s.Close())
+
+	require.Len(t, *emitted, 1)
+	session := (*emitted)[0]
+	assert.Equal(t, "a", session.VisitorId)
+	assert.Equal(t, at(0), session.Start)
+	assert.Equal(t, at(45), session.End)
+	assert.Equal(t, 45*60.0, session.DurationSeconds)
+	assert.Equal(t, 4, session.Requests)
+	assert.Equal(t, 2, session.Pages)
+	assert.Equal(t, 5, session.Events)
+	assert.Equal(t, &userId, session.UserId)
+	assert.True(t, session.IsNewVisitor)
+	assert.Equal(t, &Event{Time: at(5), EventType: DEFAULT_PAGE_EVENT_TYPE}, session.Entry, "the first page is the entry")
+	assert.Equal(t, &Event{Time: at(45), EventType: DEFAULT_PAGE_EVENT_TYPE}, session.Exit, "the last page is the exit")
+}
+
+func TestSessionExpiresAfterGap(t *testing.T) {
+	s, emitted := newTestSessionizer()
+	add(t, s,
+		request("a", at(0)),
+		request("a", at(29)),
+		// 31 minutes without an event
+		request("a", at(60)),
+		request("b", at(10)),
+	)
+	require.NoError(t, s.Close())
+
+	require.Len(t, *emitted, 3)
+	assert.Equal(t, []time.Time{at(0), at(10), at(60)}, []time.Time{(*emitted)[0].Start, (*emitted)[1].Start, (*emitted)[2].Start})
+	assert.Equal(t, at(29), (*emitted)[0].End)
+	assert.Equal(t, 2, (*emitted)[0].Requests)
+	assert.Equal(t, "b", (*emitted)[1].VisitorId)
+}
+
+func TestSessionWatermarkAndLateness(t *testing.T) {
+	s, emitted := newTestSessionizer()
+	add(t, s, request("a", at(0)))
+
+	// other visitors move the watermark, a's session is kept for the gap and the lateness
+	add(t, s, request("b", at(45)))
+	assert.Empty(t, *emitted)
+
+	// a late event of a, still within the lateness, joins its open session
+	add(t, s, request("a", at(20)))
+	add(t, s, request("b", at(80)))
+	assert.Empty(t, *emitted, "a ended at 20 minutes, it's kept until 110")
+
+	add(t, s, request("c", at(111)))
+	require.Len(t, *emitted, 1)
+	assert.Equal(t, "a", (*emitted)[0].VisitorId)
+	assert.Equal(t, 2, (*emitted)[0].Requests)
+	assert.Equal(t, at(20), (*emitted)[0].End)
+}
+
+func TestLateEventBridgesSessions(t *testing.T) {
+	s, emitted := newTestSessionizer()
+	add(t, s,
+		request("a", at(0)),
+		request("a", at(50)),
+		// fills the gap between both sessions
+		request("a", at(25)),
+	)
+	require.NoError(t, s.Close())
+
+	require.Len(t, *emitted, 1)
+	assert.Equal(t, 3, (*emitted)[0].Requests)
+	assert.Equal(t, at(0), (*emitted)[0].Start)
+	assert.Equal(t, at(50), (*emitted)[0].End)
+}
+
+func TestEventAfterSessionWasEmitted(t *testing.T) {
+	s, emitted := newTestSessionizer()
+	add(t, s, request("a", at(0)), request("b", at(120)))
+	require.Len(t, *emitted, 1)
+
+	// too late to join the emitted session, it starts a session of its own
+	add(t, s, request("a", at(10)))
+	require.NoError(t, s.Close())
+
+	require.Len(t, *emitted, 3)
+	assert.Equal(t, "a", (*emitted)[1].VisitorId)
+	assert.Equal(t, at(10), (*emitted)[1].Start)
+	assert.Equal(t, 1, (*emitted)[1].Requests)
+	assert.Equal(t, "b", (*emitted)[2].VisitorId)
+}
+
+func TestEventsWithoutTimestampAreSkipped(t *testing.T) {
+	s, emitted := newTestSessionizer()
+	add(t, s,
+		request("a", at(0)),
+		&log.RequestEvent{RequestCommon: &log.RequestCommon{VisitorId: "a"}},
+		&log.RequestEvent{RequestCommon: &log.RequestCommon{VisitorId: "b"}},
+		&log.RequestEvent{RequestCommon: &log.RequestCommon{MicroTimestamp: millis(at(0))}},
+	)
+	require.NoError(t, s.Close())
+
+	require.Len(t, *emitted, 1)
+	assert.Equal(t, at(0), (*emitted)[0].Start)
+	assert.Equal(t, 1, (*emitted)[0].Requests)
+	assert.Equal(t, 2, s.Skipped(), "events without a visitor aren't counted")
+}
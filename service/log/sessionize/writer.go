@@ -0,0 +1,113 @@
+package sessionize
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	FORMAT_JSON = "json"
+	FORMAT_CSV  = "csv"
+)
+
+// Writer writes sessions in one of the output formats
+type Writer interface {
+	Write(session *Session) error
+	Flush() error
+}
+
+// NewWriter returns a writer for FORMAT_JSON, one session per line, or FORMAT_CSV with a header row
+func NewWriter(w io.Writer, format string) (Writer, error) {
+	switch format {
+	case FORMAT_JSON:
+		return &jsonWriter{encoder: json.NewEncoder(w)}, nil
+	case FORMAT_CSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown session format '%s'", format)
+	}
+}
+
+type jsonWriter struct {
+	encoder *json.Encoder
+}
+
+func (jw *jsonWriter) Write(session *Session) error {
+	return jw.encoder.Encode(session)
+}
+
+func (jw *jsonWriter) Flush() error {
+	return nil
+}
+
+var csvHeader = []string{
+	"visitorId", "userId", "start", "end", "durationSeconds", "requests", "pages", "events", "isNewVisitor",
+	"entryEventType", "entryMetadata", "exitEventType", "exitMetadata",
+}
+
+type csvWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func (cw *csvWriter) Write(session *Session) error {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		if err := cw.w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+
+	userId := ""
+	if session.UserId != nil {
+		userId = *session.UserId
+	}
+	entryType, entryMetadata, err := csvEvent(session.Entry)
+	if err != nil {
+		return err
+	}
+	exitType, exitMetadata, err := csvEvent(session.Exit)
+	if err != nil {
+		return err
+	}
+
+	return cw.w.Write([]string{
+		session.VisitorId,
+		userId,
+		session.Start.Format(time.RFC3339Nano),
+		session.End.Format(time.RFC3339Nano),
+		strconv.FormatFloat(session.DurationSeconds, 'f', -1, 64),
+		strconv.Itoa(session.Requests),
+		strconv.Itoa(session.Pages),
+		strconv.Itoa(session.Events),
+		strconv.FormatBool(session.IsNewVisitor),
+		entryType,
+		entryMetadata,
+		exitType,
+		exitMetadata,
+	})
+}
+
+func (cw *csvWriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// csvEvent returns the event type and the metadata as JSON, metadata has no fixed columns
+func csvEvent(event *Event) (string, string, error) {
+	if event == nil {
+		return "", "", nil
+	}
+	if event.Metadata == nil {
+		return event.EventType, "", nil
+	}
+	metadata, err := json.Marshal(event.Metadata)
+	if err != nil {
+		return "", "", err
+	}
+	return event.EventType, string(metadata), nil
+}
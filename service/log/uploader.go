@@ -0,0 +1,544 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smallhouse123/go-library/service/config"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+var (
+	// UploaderService ships closed hourly files to the store selected by LOG_UPLOAD_STORE
+	UploaderService = fx.Options(
+		fx.Provide(NewObjectStore, NewUploader),
+		fx.Invoke(func(*Uploader) {}),
+	)
+)
+
+const (
+	DEFAULT_UPLOAD_PERIOD = 1 // minutes
+	MAX_UPLOAD_BACKOFF    = time.Hour
+
+	LOG_SUFFIX        = ".log"
+	CLAIMED_SUFFIX    = ".claimed"
+	COMPRESSED_SUFFIX = ".gz"
+	MANIFEST_SUFFIX   = ".manifest.json"
+	TMP_SUFFIX        = ".tmp"
+)
+
+type UploaderParams struct {
+	fx.In
+
+	Lifecycle fx.Lifecycle
+	Config    config.Config
+	Log       Log
+	Store     ObjectStore
+	Logger    *zap.Logger `optional:"true"`
+}
+
+// Manifest describes an uploaded file, it's uploaded next to the file as <key>.manifest.json. IndexKey is the key
+// of the sidecar index shipped with the file, at <key>.idx, and is empty for a file without one.
+type Manifest struct {
+	File             string    `json:"file"`
+	Key              string    `json:"key"`
+	Pod              string    `json:"pod"`
+	Rows             int64     `json:"rows"`
+	Bytes            int64     `json:"bytes"`
+	Sha256           string    `json:"sha256"`
+	CompressedBytes  int64     `json:"compressedBytes"`
+	CompressedSha256 string    `json:"compressedSha256"`
+	IndexKey         string    `json:"indexKey,omitempty"`
+	IndexBytes       int64     `json:"indexBytes,omitempty"`
+	CreatedAt        time.Time `json:"createdAt"`
+}
+
+// Uploader compresses closed hourly files and uploads them with a manifest.
+//
+// Every step leaves its state on disk, so an upload interrupted by a restart is retried:
+// a closed x.log is renamed to x.log.claimed, compressed to x.log.gz with x.log.manifest.json,
+// and both are deleted only after the store confirms the upload. Its index x.log.idx becomes x.log.gz.idx
+// and is shipped next to it. Compact .relpb files take the same steps.
+// A file is only claimed once its close hooks, like the index and the compact export, are done with it.
+type Uploader struct {
+	logger  *Impl
+	store   ObjectStore
+	sugar   *zap.SugaredLogger
+	prefix  string
+	pod     string
+	period  time.Duration
+	trigger chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	passMu  sync.Mutex
+
+	mu      sync.Mutex
+	closed  map[string]struct{}
+	retries map[string]*uploadRetry
+}
+
+type uploadRetry struct {
+	attempts int
+	next     time.Time
+}
+
+func NewUploader(p UploaderParams) (*Uploader, error) {
+	appLogger := p.Logger
+	if appLogger == nil {
+		appLogger = zap.NewNop()
+	}
+	sugar := appLogger.Named("log.uploader").Sugar()
+
+	logger, ok := p.Log.(*Impl)
+	if !ok {
+		// the log service fell back to a sink without files, there is nothing to upload
+		sugar.Warn("log files are not written, uploader is disabled")
+		return &Uploader{}, nil
+	}
+
+	u := &Uploader{
+		logger:  logger,
+		store:   p.Store,
+		sugar:   sugar,
+		prefix:  getConfigString(p.Config, "LOG_UPLOAD_PREFIX", ""),
+		pod:     os.Getenv("K8S_POD_NAME"),
+		period:  time.Duration(getConfigInt(p.Config, "LOG_UPLOAD_PERIOD", DEFAULT_UPLOAD_PERIOD)) * time.Minute,
+		trigger: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		closed:  map[string]struct{}{},
+		retries: map[string]*uploadRetry{},
+	}
+
+	logger.OnFileClosed(u.fileClosed)
+
+	p.Lifecycle.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			u.wg.Add(1)
+			go u.loop()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			close(u.stop)
+			u.wg.Wait()
+			// give the files closed since the last pass a chance before shutting down
+			u.Upload(ctx)
+			return nil
+		},
+	})
+
+	return u, nil
+}
+
+func (u *Uploader) fileClosed(file ClosedFile) {
+	u.mu.Lock()
+	u.closed[file.Path] = struct{}{}
+	u.mu.Unlock()
+
+	select {
+	case u.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (u *Uploader) loop() {
+	defer u.wg.Done()
+
+	ticker := time.NewTicker(u.period)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-u.stop
+		cancel()
+	}()
+
+	u.Upload(ctx)
+	for {
+		select {
+		case <-ticker.C:
+			u.Upload(ctx)
+		case <-u.trigger:
+			u.Upload(ctx)
+		case <-u.stop:
+			return
+		}
+	}
+}
+
+// Upload runs one pass over the log directory, shipping every closed file that isn't backing off.
+// It does nothing when the uploader is disabled.
+func (u *Uploader) Upload(ctx context.Context) {
+	if u.logger == nil {
+		return
+	}
+
+	u.passMu.Lock()
+	defer u.passMu.Unlock()
+
+	bases, err := u.scan()
+	if err != nil {
+		u.sugar.Errorw("failed to scan log directory", "err", err)
+		return
+	}
+
+	now := time.Now()
+	for _, base := range bases {
+		if ctx.Err() != nil {
+			return
+		}
+
+		u.mu.Lock()
+		retry := u.retries[base]
+		u.mu.Unlock()
+		if retry != nil && now.Before(retry.next) {
+			continue
+		}
+
+		if err := u.process(ctx, base); err != nil {
+			u.sugar.Errorw("failed to upload log file", "path", base, "err", err)
+			u.backoff(base, now)
+			continue
+		}
+
+		u.mu.Lock()
+		delete(u.retries, base)
+		u.mu.Unlock()
+	}
+}
+
+func (u *Uploader) backoff(base string, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	retry, ok := u.retries[base]
+	if !ok {
+		retry = &uploadRetry{}
+		u.retries[base] = retry
+	}
+	retry.attempts++
+
+	delay := u.period << (retry.attempts - 1)
+	if delay <= 0 || delay > MAX_UPLOAD_BACKOFF {
+		delay = MAX_UPLOAD_BACKOFF
+	}
+	retry.next = now.Add(delay)
+}
+
+// scan returns the paths of the .log and .relpb files that have something to do, either the file itself or its leftovers
+func (u *Uploader) scan() ([]string, error) {
+	seen := map[string]struct{}{}
+	bases := []string{}
+
+	err := filepath.WalkDir(u.logger.Dir(), func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		if strings.HasSuffix(filePath, COMPRESSED_SUFFIX+TMP_SUFFIX) || strings.HasSuffix(filePath, MANIFEST_SUFFIX+TMP_SUFFIX) {
+			// leftovers of an interrupted compression
+			os.Remove(filePath)
+			return nil
+		}
+		if strings.HasSuffix(filePath, COMPACT_SUFFIX+TMP_SUFFIX) || strings.HasSuffix(filePath, INDEX_SUFFIX+TMP_SUFFIX) {
+			// the compact export or the index may still be writing it, only an old one is a leftover
+			if info, err := d.Info(); err == nil && time.Since(info.ModTime()) > time.Hour {
+				os.Remove(filePath)
+			}
+			return nil
+		}
+
+		var base string
+		for _, suffix := range []string{LOG_SUFFIX, COMPACT_SUFFIX} {
+			switch {
+			case strings.HasSuffix(filePath, suffix):
+				base = filePath
+			case strings.HasSuffix(filePath, suffix+CLAIMED_SUFFIX):
+				base = strings.TrimSuffix(filePath, CLAIMED_SUFFIX)
+			case strings.HasSuffix(filePath, suffix+MANIFEST_SUFFIX):
+				base = strings.TrimSuffix(filePath, MANIFEST_SUFFIX)
+			}
+		}
+		if base == "" {
+			return nil
+		}
+
+		if _, ok := seen[base]; !ok {
+			seen[base] = struct{}{}
+			bases = append(bases, base)
+		}
+		return nil
+	})
+
+	return bases, err
+}
+
+// process moves base through the remaining steps. Pending uploads go first,
+// so a file reopened for late events never overwrites what is still waiting to be shipped.
+func (u *Uploader) process(ctx context.Context, base string) error {
+	claimedPath := base + CLAIMED_SUFFIX
+
+	if exists(base + MANIFEST_SUFFIX) {
+		if err := u.upload(ctx, base); err != nil {
+			return err
+		}
+	}
+
+	if exists(claimedPath) {
+		if err := u.prepare(base); err != nil {
+			return err
+		}
+		if err := u.upload(ctx, base); err != nil {
+			return err
+		}
+	}
+
+	if !exists(base) {
+		return nil
+	}
+
+	u.mu.Lock()
+	_, force := u.closed[base]
+	u.mu.Unlock()
+
+	if strings.HasSuffix(base, COMPACT_SUFFIX) {
+		// compact files only appear once they are complete
+		if err := os.Rename(base, claimedPath); err != nil {
+			return err
+		}
+	} else if claimed, err := u.logger.claim(base, claimedPath, force); err != nil || !claimed {
+		return err
+	}
+
+	u.mu.Lock()
+	delete(u.closed, base)
+	u.mu.Unlock()
+
+	if err := u.prepare(base); err != nil {
+		return err
+	}
+	return u.upload(ctx, base)
+}
+
+// prepare compresses the claimed file and writes its manifest, then removes the claimed file
+func (u *Uploader) prepare(base string) error {
+	claimedPath := base + CLAIMED_SUFFIX
+	compressedPath := base + COMPRESSED_SUFFIX
+
+	src, err := os.Open(claimedPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.Create(compressedPath + TMP_SUFFIX)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	rawHash := sha256.New()
+	compressedHash := sha256.New()
+	compressedCount := &countingWriter{w: io.MultiWriter(tmp, compressedHash)}
+	rawCount := &countingWriter{w: rawHash}
+
+	zw := gzip.NewWriter(compressedCount)
+	if _, err := io.Copy(io.MultiWriter(zw, rawCount), src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), compressedPath); err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(u.logger.Dir(), base)
+	if err != nil {
+		return err
+	}
+
+	rows := rawCount.lines
+	if strings.HasSuffix(base, COMPACT_SUFFIX) {
+		if rows, err = countCompactRows(claimedPath); err != nil {
+			return err
+		}
+	}
+
+	// the index goes with the compressed file, so a reopened file indexed again doesn't replace it
+	indexPath := IndexPath(compressedPath)
+	if err := os.Rename(IndexPath(base), indexPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var indexBytes int64
+	if info, err := os.Stat(indexPath); err == nil {
+		indexBytes = info.Size()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	sum := hexSum(rawHash)
+	manifest := &Manifest{
+		File:             filepath.ToSlash(rel),
+		Key:              u.objectKey(rel, sum),
+		Pod:              u.pod,
+		Rows:             rows,
+		Bytes:            rawCount.n,
+		Sha256:           sum,
+		CompressedBytes:  compressedCount.n,
+		CompressedSha256: hexSum(compressedHash),
+		CreatedAt:        time.Now().UTC(),
+	}
+	if indexBytes > 0 {
+		manifest.IndexKey = manifest.Key + INDEX_SUFFIX
+		manifest.IndexBytes = indexBytes
+	}
+	if err := writeJSONFile(base+MANIFEST_SUFFIX, manifest); err != nil {
+		return err
+	}
+	return os.Remove(claimedPath)
+}
+
+// objectKey returns the key of a file, like <prefix>/<pod>/24_03_01__09.<checksum>.log.gz. The checksum keeps
+// a file reopened for late events from replacing the one shipped before, it goes before the extension so
+// the object still ends in .log.gz or .relpb.gz.
+func (u *Uploader) objectKey(rel, sum string) string {
+	rel = filepath.ToSlash(rel)
+	ext := path.Ext(rel)
+	return path.Join(u.prefix, u.pod, strings.TrimSuffix(rel, ext)+"."+sum[:12]+ext) + COMPRESSED_SUFFIX
+}
+
+// upload ships the compressed file, its index and its manifest, local copies are deleted once the store confirms them.
+// The manifest goes last, so an object with a manifest is complete.
+func (u *Uploader) upload(ctx context.Context, base string) error {
+	compressedPath := base + COMPRESSED_SUFFIX
+	manifestPath := base + MANIFEST_SUFFIX
+
+	manifestJSON, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(manifestJSON, manifest); err != nil {
+		return fmt.Errorf("invalid manifest %s: %v", manifestPath, err)
+	}
+
+	file, err := os.Open(compressedPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := u.store.Put(ctx, manifest.Key, file, manifest.CompressedBytes); err != nil {
+		return err
+	}
+	if err := u.confirm(ctx, manifest.Key, manifest.CompressedBytes); err != nil {
+		return err
+	}
+
+	indexPath := IndexPath(compressedPath)
+	if manifest.IndexKey != "" {
+		index, err := os.Open(indexPath)
+		if err != nil {
+			return err
+		}
+		defer index.Close()
+		if err := u.store.Put(ctx, manifest.IndexKey, index, manifest.IndexBytes); err != nil {
+			return err
+		}
+		if err := u.confirm(ctx, manifest.IndexKey, manifest.IndexBytes); err != nil {
+			return err
+		}
+		index.Close()
+	}
+
+	manifestKey := manifest.Key + MANIFEST_SUFFIX
+	if err := u.store.Put(ctx, manifestKey, bytes.NewReader(manifestJSON), int64(len(manifestJSON))); err != nil {
+		return err
+	}
+	if err := u.confirm(ctx, manifestKey, int64(len(manifestJSON))); err != nil {
+		return err
+	}
+
+	file.Close()
+	if err := os.Remove(compressedPath); err != nil {
+		return err
+	}
+	if err := os.Remove(indexPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(manifestPath)
+}
+
+func (u *Uploader) confirm(ctx context.Context, key string, size int64) error {
+	info, err := u.store.Stat(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to confirm upload of '%s': %v", key, err)
+	}
+	if info.Size != size {
+		return fmt.Errorf("uploaded '%s' has %d bytes, expected %d", key, info.Size, size)
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w     io.Writer
+	n     int64
+	lines int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.lines += int64(bytes.Count(p[:n], []byte{'\n'}))
+	return n, err
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + TMP_SUFFIX
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func hexSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,168 @@
+package log
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/fx/fxtest"
+	"go.uber.org/zap"
+)
+
+// newTestUploader returns an uploader shipping the files of im to a local store, its loop isn't started
+func newTestUploader(t *testing.T, im *Impl, storeDir string) *Uploader {
+	u, err := NewUploader(UploaderParams{
+		Lifecycle: fxtest.NewLifecycle(t),
+		Config:    newTestConfig(t, nil),
+		Log:       im,
+		Store:     NewLocalStore(storeDir),
+		Logger:    zap.NewNop(),
+	})
+	require.NoError(t, err)
+	return u
+}
+
+func hooksDone(im *Impl) func() bool {
+	return func() bool {
+		im.mu.Lock()
+		defer im.mu.Unlock()
+		return len(im.hooksPending) == 0
+	}
+}
+
+func TestUploaderWaitsForCloseHooks(t *testing.T) {
+	// the clock is ahead of the file times, so only the pending hook keeps the file from being claimed
+	clock := &fakeClock{now: time.Date(2099, 3, 1, 9, 15, 0, 0, time.UTC)}
+	im := newTestLog(t, clock, map[string]interface{}{"LOG_TIMEZONE": "UTC"})
+	defer im.Close()
+	t.Setenv("K8S_POD_NAME", "pod")
+
+	release := make(chan struct{})
+	im.OnFileClosed(func(file ClosedFile) { <-release })
+	storeDir := t.TempDir()
+	u := newTestUploader(t, im, storeDir)
+
+	im.WriteLog("access", &RequestEvent{RequestCommon: &RequestCommon{VisitorId: "a"}})
+	clock.Add(time.Hour)
+	// the new hour closes the file of 09, its hook is still running
+	im.WriteLog("access", &RequestEvent{RequestCommon: &RequestCommon{VisitorId: "b"}})
+
+	path := filepath.Join(im.Dir(), "99_03_01__09.log")
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	u.Upload(context.Background())
+	assert.FileExists(t, path, "a file is not claimed before its close hooks are done")
+
+	close(release)
+	require.Eventually(t, hooksDone(im), time.Second, 10*time.Millisecond)
+	u.Upload(context.Background())
+
+	assert.NoFileExists(t, path)
+	assert.NoFileExists(t, path+COMPRESSED_SUFFIX)
+	assert.NoFileExists(t, path+MANIFEST_SUFFIX)
+
+	sum := sha256.Sum256(raw)
+	key := "pod/99_03_01__09." + hex.EncodeToString(sum[:])[:12] + ".log.gz"
+	assert.True(t, IsLogFile(key), "the tools read shipped objects")
+
+	manifestJSON, err := os.ReadFile(filepath.Join(storeDir, filepath.FromSlash(key+MANIFEST_SUFFIX)))
+	require.NoError(t, err)
+	manifest := &Manifest{}
+	require.NoError(t, json.Unmarshal(manifestJSON, manifest))
+	assert.Equal(t, key, manifest.Key)
+	assert.Equal(t, "99_03_01__09.log", manifest.File)
+	assert.Equal(t, int64(1), manifest.Rows)
+	assert.Equal(t, hex.EncodeToString(sum[:]), manifest.Sha256)
+
+	file, err := os.Open(filepath.Join(storeDir, filepath.FromSlash(key)))
+	require.NoError(t, err)
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	require.NoError(t, err)
+	shipped, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, raw, shipped)
+}
+
+func TestUploaderKeepsReopenedFilesApart(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 9, 15, 0, 0, time.UTC)}
+	im := newTestLog(t, clock, map[string]interface{}{"LOG_TIMEZONE": "UTC"})
+	defer im.Close()
+	storeDir := t.TempDir()
+	u := newTestUploader(t, im, storeDir)
+
+	late := float64(time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC).UnixMilli())
+	for _, visitorId := range []string{"a", "b"} {
+		im.WriteLog("access", &RequestEvent{RequestCommon: &RequestCommon{VisitorId: visitorId, MicroTimestamp: late}})
+		clock.Add(time.Hour)
+		// the next hour closes the file of 09 again
+		im.WriteLog("access", &RequestEvent{RequestCommon: &RequestCommon{VisitorId: "x"}})
+		require.Eventually(t, hooksDone(im), time.Second, 10*time.Millisecond)
+		u.Upload(context.Background())
+	}
+
+	objects, err := filepath.Glob(filepath.Join(storeDir, "24_03_01__09.*.log.gz"))
+	require.NoError(t, err)
+	assert.Len(t, objects, 2, "a late piece of an hour doesn't replace the one shipped before")
+}
+
+func TestUploaderShipsIndex(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 9, 15, 0, 0, time.UTC)}
+	im := newTestLog(t, clock, map[string]interface{}{"LOG_TIMEZONE": "UTC", "LOG_INDEX": true})
+	defer im.Close()
+	storeDir := t.TempDir()
+	u := newTestUploader(t, im, storeDir)
+
+	im.WriteLog("access", &RequestEvent{RequestCommon: &RequestCommon{VisitorId: "a"}})
+	clock.Add(time.Hour)
+	im.WriteLog("access", &RequestEvent{RequestCommon: &RequestCommon{VisitorId: "b"}})
+	require.Eventually(t, hooksDone(im), time.Second, 10*time.Millisecond)
+	u.Upload(context.Background())
+
+	path := filepath.Join(im.Dir(), "24_03_01__09.log")
+	assert.NoFileExists(t, IndexPath(path))
+	assert.NoFileExists(t, IndexPath(path+COMPRESSED_SUFFIX))
+
+	manifests, err := filepath.Glob(filepath.Join(storeDir, "24_03_01__09.*.log.gz"+MANIFEST_SUFFIX))
+	require.NoError(t, err)
+	require.Len(t, manifests, 1)
+	manifestJSON, err := os.ReadFile(manifests[0])
+	require.NoError(t, err)
+	manifest := &Manifest{}
+	require.NoError(t, json.Unmarshal(manifestJSON, manifest))
+	assert.Equal(t, manifest.Key+INDEX_SUFFIX, manifest.IndexKey)
+
+	// the shipped pair is looked up like a local file
+	objectPath := filepath.Join(storeDir, filepath.FromSlash(manifest.Key))
+	info, err := os.Stat(IndexPath(objectPath))
+	require.NoError(t, err)
+	assert.Equal(t, manifest.IndexBytes, info.Size())
+	visitorIds, indexed := lookupVisitors(t, objectPath, IndexQuery{VisitorId: "a"})
+	assert.True(t, indexed)
+	assert.Equal(t, []string{"a"}, visitorIds)
+}
+
+func TestDisabledUploader(t *testing.T) {
+	lifecycle := fxtest.NewLifecycle(t)
+	u, err := NewUploader(UploaderParams{
+		Lifecycle: lifecycle,
+		Config:    newTestConfig(t, nil),
+		Log:       NewMemoryLog(1),
+		Store:     NewLocalStore(t.TempDir()),
+	})
+	require.NoError(t, err)
+
+	lifecycle.RequireStart().RequireStop()
+	assert.NotPanics(t, func() { u.Upload(context.Background()) })
+	assert.NotPanics(t, func() { (&Uploader{}).Upload(context.Background()) })
+}
@@ -0,0 +1,238 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	// OVERFLOW_VALUE replaces label values beyond the cardinality limits or outside the allowed values
+	OVERFLOW_VALUE = "__overflow__"
+
+	METRIC_CARDINALITY_OVERFLOW = "metrics_cardinality_overflow_total"
+
+	DEFAULT_MAX_SERIES_PER_METRIC = 10000
+	DEFAULT_MAX_SERIES            = 100000
+
+	// a metric over its limit warns at most once per period
+	OVERFLOW_WARN_PERIOD = time.Minute
+)
+
+// seriesLimit keeps track of the label combinations of one metric
+type seriesLimit struct {
+	mu            sync.Mutex
+	max           int
+	allowedValues map[string]map[string]struct{}
+	series        map[string]struct{}
+	lastWarn      time.Time
+}
+
+func newSeriesLimit(definition Definition, defaultMax int) *seriesLimit {
+	limit := &seriesLimit{
+		max:    defaultMax,
+		series: map[string]struct{}{},
+	}
+	if definition.MaxSeries != 0 {
+		limit.max = definition.MaxSeries
+	}
+	if len(definition.AllowedValues) > 0 {
+		limit.allowedValues = map[string]map[string]struct{}{}
+		for label, values := range definition.AllowedValues {
+			allowed := map[string]struct{}{}
+			for _, value := range values {
+				allowed[value] = struct{}{}
+			}
+			limit.allowedValues[label] = allowed
+		}
+	}
+	return limit
+}
+
+// disallowed returns the labels whose values the limit doesn't allow, sorted
+func (limit *seriesLimit) disallowed(labels prometheus.Labels) []string {
+	disallowed := []string{}
+	for label, allowed := range limit.allowedValues {
+		if value, ok := labels[label]; ok {
+			if _, ok := allowed[value]; !ok {
+				disallowed = append(disallowed, label)
+			}
+		}
+	}
+	sort.Strings(disallowed)
+	return disallowed
+}
+
+// seriesId identifies the label combination of labels, names gives the order of the values
+func seriesId(names []string, labels prometheus.Labels) string {
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = labels[name]
+	}
+	return strings.Join(values, "\xff")
+}
+
+// limiter applies the cardinality limits of a backend, it counts the series of the whole service
+type limiter struct {
+	maxSeries          int
+	maxSeriesPerMetric int
+	seriesCount        atomic.Int64
+	// countOverflow counts a use of key beyond the limits in the overflow counter of the backend
+	countOverflow   func(key string)
+	gaugeFuncLimits map[string]*seriesLimit
+	gaugeFuncMutex  sync.Mutex
+	sugar           *zap.SugaredLogger
+}
+
+func newLimiter(s settings, countOverflow func(key string)) *limiter {
+	return &limiter{
+		maxSeries:          s.maxSeries,
+		maxSeriesPerMetric: s.maxSeriesPerMetric,
+		countOverflow:      countOverflow,
+		gaugeFuncLimits:    map[string]*seriesLimit{},
+		sugar:              s.sugar,
+	}
+}
+
+// newSeriesLimit returns the limit of a metric of definition
+func (l *limiter) newSeriesLimit(definition Definition) *seriesLimit {
+	return newSeriesLimit(definition, l.maxSeriesPerMetric)
+}
+
+// cardinality folds labels into OVERFLOW_VALUE when they aren't allowed, or when they'd add a series
+// beyond the limit of the metric or of the whole service. The overflowed combination is always accepted.
+// names are the label keys of the metric.
+func (l *limiter) cardinality(key string, limit *seriesLimit, names []string, labels prometheus.Labels) prometheus.Labels {
+	for _, label := range limit.disallowed(labels) {
+		labels[label] = OVERFLOW_VALUE
+		l.countOverflow(key)
+	}
+
+	if l.admit(key, limit, seriesId(names, labels)) {
+		return labels
+	}
+	for label := range labels {
+		labels[label] = OVERFLOW_VALUE
+	}
+	return labels
+}
+
+// admitGaugeFunc checks a new gauge func of key against the limits, it can't be folded so it's an error
+// beyond them. release forgets the series when the gauge func isn't registered after all.
+func (l *limiter) admitGaugeFunc(key string, definition Definition, labels prometheus.Labels) (release func(), err error) {
+	l.gaugeFuncMutex.Lock()
+	limit, ok := l.gaugeFuncLimits[key]
+	if !ok {
+		limit = l.newSeriesLimit(definition)
+		l.gaugeFuncLimits[key] = limit
+	}
+	l.gaugeFuncMutex.Unlock()
+
+	if disallowed := limit.disallowed(labels); len(disallowed) > 0 {
+		l.countOverflow(key)
+		return nil, fmt.Errorf("metric %s: values of labels %v aren't allowed", key, disallowed)
+	}
+	id := seriesId(definition.Labels, labels)
+	if !l.admit(key, limit, id) {
+		return nil, fmt.Errorf("metric %s reached the series limit, the gauge func with labels %v isn't registered", key, labels)
+	}
+	return func() { l.release(limit, id) }, nil
+}
+
+// admit reports whether the series id is within the limits, adding it when it's new. A series beyond
+// the limit of the metric or of the service is counted as an overflow.
+func (l *limiter) admit(key string, limit *seriesLimit, id string) bool {
+	limit.mu.Lock()
+	defer limit.mu.Unlock()
+
+	if _, ok := limit.series[id]; ok {
+		return true
+	}
+
+	overLimit := limit.max > 0 && len(limit.series) >= limit.max
+	if !overLimit && l.reserveSeries() {
+		limit.series[id] = struct{}{}
+		return true
+	}
+	l.overflow(key, limit, overLimit)
+	return false
+}
+
+// reserveSeries counts one more series of the service, unless it would go beyond METRICS_MAX_SERIES
+func (l *limiter) reserveSeries() bool {
+	for {
+		count := l.seriesCount.Load()
+		if l.maxSeries > 0 && count >= int64(l.maxSeries) {
+			return false
+		}
+		if l.seriesCount.CompareAndSwap(count, count+1) {
+			return true
+		}
+	}
+}
+
+// release forgets a series admitted but never created
+func (l *limiter) release(limit *seriesLimit, id string) {
+	limit.mu.Lock()
+	defer limit.mu.Unlock()
+
+	if _, ok := limit.series[id]; ok {
+		delete(limit.series, id)
+		l.seriesCount.Add(-1)
+	}
+}
+
+// overflow counts a folded series and warns about it, limit.mu is held
+func (l *limiter) overflow(key string, limit *seriesLimit, overLimit bool) {
+	l.countOverflow(key)
+
+	now := time.Now()
+	if now.Sub(limit.lastWarn) < OVERFLOW_WARN_PERIOD {
+		return
+	}
+	limit.lastWarn = now
+
+	if overLimit {
+		l.sugar.Warnw("metric reached its series limit, new label combinations are folded into "+OVERFLOW_VALUE,
+			"metric", key, "limit", limit.max)
+	} else {
+		l.sugar.Warnw("metrics reached the series limit of the service, new label combinations are folded into "+OVERFLOW_VALUE,
+			"metric", key, "limit", l.maxSeries)
+	}
+}
+
+// newOverflowCounter registers the overflow counter of the service, or reuses the one registered by another instance
+func newOverflowCounter(registerer prometheus.Registerer, namespace string) (*prometheus.CounterVec, error) {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      METRIC_CARDINALITY_OVERFLOW,
+		Help:      "Uses of a metric folded into " + OVERFLOW_VALUE + " by the cardinality limits",
+	}, []string{"metric"})
+
+	if err := registerer.Register(counter); err != nil {
+		are := prometheus.AlreadyRegisteredError{}
+		if !errors.As(err, &are) {
+			return nil, err
+		}
+		existing, ok := are.ExistingCollector.(*prometheus.CounterVec)
+		if !ok {
+			return nil, fmt.Errorf("%s is already registered as another type", METRIC_CARDINALITY_OVERFLOW)
+		}
+		return existing, nil
+	}
+	return counter, nil
+}
+
+func newMetricsLogger(logger *zap.Logger) *zap.SugaredLogger {
+	if logger == nil {
+		return zap.NewNop().Sugar()
+	}
+	return logger.Named("metrics").Sugar()
+}
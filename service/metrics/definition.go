@@ -0,0 +1,266 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/fx"
+)
+
+const (
+	TYPE_HISTOGRAM = "histogram"
+	TYPE_COUNTER   = "counter"
+	TYPE_GAUGE     = "gauge"
+	TYPE_SUMMARY   = "summary"
+)
+
+var (
+	// LinearBuckets returns count buckets, width apart, the first one at start
+	LinearBuckets = prometheus.LinearBuckets
+	// ExponentialBuckets returns count buckets, each factor times the previous one, the first one at start
+	ExponentialBuckets = prometheus.ExponentialBuckets
+)
+
+// Definition describes a metric before it's used. The key passed to BumpTime, BumpCount and the rest is the Name.
+type Definition struct {
+	Name string
+	Help string
+	// Unit is appended to the exposed name, e.g. a "seconds" unit exposes redis_call as redis_call_seconds
+	Unit string
+	// Labels are the label keys, when set the metric is created with them instead of the keys of the first tags
+	Labels []string
+	// Buckets of a histogram, see LinearBuckets and ExponentialBuckets
+	Buckets []float64
+	// Objectives of a summary, quantiles and their allowed errors
+	Objectives map[float64]float64
+	// MaxSeries limits the label combinations of the metric, beyond it they're folded into OVERFLOW_VALUE.
+	// 0 uses METRICS_MAX_SERIES_PER_METRIC, a negative value turns the limit off.
+	MaxSeries int
+	// AllowedValues are the values permitted per label key, others are replaced by OVERFLOW_VALUE
+	AllowedValues map[string][]string
+	// Type registers the metric up front with one of the TYPE_ constants, so it's exposed before its first use.
+	// Labels have to be declared then.
+	Type string
+}
+
+// Definitions adds metric definitions to the container, they're registered by New
+func Definitions(definitions ...Definition) fx.Option {
+	options := []fx.Option{}
+	for _, definition := range definitions {
+		definition := definition
+		options = append(options, fx.Supply(fx.Annotate(definition, fx.ResultTags(`group:"metricDefinitions"`))))
+	}
+	return fx.Options(options...)
+}
+
+// exposedName returns the name a metric is exposed under, without the namespace
+func (d Definition) exposedName(key string) string {
+	if d.Unit == "" || strings.HasSuffix(key, "_"+d.Unit) {
+		return key
+	}
+	return key + "_" + d.Unit
+}
+
+func (d Definition) validate() error {
+	if d.Name == "" {
+		return errors.New("metric definition without a name")
+	}
+	switch d.Type {
+	case "", TYPE_HISTOGRAM, TYPE_COUNTER, TYPE_GAUGE, TYPE_SUMMARY:
+	default:
+		return fmt.Errorf("metric %s has unknown type '%s'", d.Name, d.Type)
+	}
+	if err := validateLabelNames(d.Labels); err != nil {
+		return fmt.Errorf("metric %s: %v", d.Name, err)
+	}
+	for label := range d.AllowedValues {
+		if d.Labels != nil && !containsString(d.Labels, label) {
+			return fmt.Errorf("metric %s allows values of label %s it doesn't have", d.Name, label)
+		}
+	}
+	if !sort.Float64sAreSorted(d.Buckets) {
+		return fmt.Errorf("metric %s has buckets out of order", d.Name)
+	}
+	for quantile := range d.Objectives {
+		if quantile <= 0 || quantile >= 1 {
+			return fmt.Errorf("metric %s has invalid quantile %v", d.Name, quantile)
+		}
+	}
+	return nil
+}
+
+// ParseDefinitions reads definitions from config, a map from metric name to its fields:
+//
+//	redis_call:
+//	  help: Redis call latency
+//	  unit: seconds
+//	  labels: [command]
+//	  buckets: {exponential: {start: 0.0005, factor: 2, count: 10}}
+//	  maxSeries: 100
+//	  allowedValues: {command: [get, set, del]}
+//
+// buckets is either a list of bounds, {linear: {start, width, count}} or {exponential: {start, factor, count}}
+func ParseDefinitions(val interface{}) ([]Definition, error) {
+	definitionMap, ok := toStringMap(val)
+	if !ok {
+		return nil, errors.New("metric definitions must be a map of name to definition")
+	}
+
+	names := make([]string, 0, len(definitionMap))
+	for name := range definitionMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	definitions := []Definition{}
+	for _, name := range names {
+		fields, ok := toStringMap(definitionMap[name])
+		if !ok {
+			return nil, fmt.Errorf("metric %s: definition must be a map", name)
+		}
+
+		definition := Definition{Name: name}
+		for field, value := range fields {
+			var err error
+			switch field {
+			case "help":
+				definition.Help, ok = value.(string)
+			case "unit":
+				definition.Unit, ok = value.(string)
+			case "type":
+				definition.Type, ok = value.(string)
+			case "labels":
+				definition.Labels, ok = toStringList(value)
+			case "buckets":
+				definition.Buckets, err = parseBuckets(value)
+			case "objectives":
+				definition.Objectives, err = parseObjectives(value)
+			case "maxSeries":
+				definition.MaxSeries, ok = value.(int)
+			case "allowedValues":
+				definition.AllowedValues, ok = toAllowedValues(value)
+			default:
+				err = fmt.Errorf("unknown field '%s'", field)
+			}
+			if err == nil && !ok {
+				err = fmt.Errorf("invalid %s", field)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("metric %s: %v", name, err)
+			}
+		}
+
+		if err := definition.validate(); err != nil {
+			return nil, err
+		}
+		definitions = append(definitions, definition)
+	}
+	return definitions, nil
+}
+
+func parseBuckets(val interface{}) ([]float64, error) {
+	if list, ok := val.([]interface{}); ok {
+		buckets := []float64{}
+		for _, item := range list {
+			bound, ok := toFloat(item)
+			if !ok {
+				return nil, fmt.Errorf("invalid bucket %v", item)
+			}
+			buckets = append(buckets, bound)
+		}
+		return buckets, nil
+	}
+
+	spec, ok := toStringMap(val)
+	if !ok || len(spec) != 1 {
+		return nil, errors.New("buckets must be a list, linear or exponential")
+	}
+	for kind, paramsVal := range spec {
+		params, ok := toStringMap(paramsVal)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s buckets", kind)
+		}
+		start, okStart := toFloat(params["start"])
+		count, okCount := toFloat(params["count"])
+		if !okStart || !okCount || count < 1 {
+			return nil, fmt.Errorf("%s buckets need a start and a count", kind)
+		}
+
+		switch kind {
+		case "linear":
+			width, ok := toFloat(params["width"])
+			if !ok || width <= 0 {
+				return nil, errors.New("linear buckets need a positive width")
+			}
+			return LinearBuckets(start, width, int(count)), nil
+		case "exponential":
+			factor, ok := toFloat(params["factor"])
+			if !ok || factor <= 1 || start <= 0 {
+				return nil, errors.New("exponential buckets need a positive start and a factor above 1")
+			}
+			return ExponentialBuckets(start, factor, int(count)), nil
+		default:
+			return nil, fmt.Errorf("unknown buckets '%s'", kind)
+		}
+	}
+	return nil, nil
+}
+
+func toStringMap(val interface{}) (map[string]interface{}, bool) {
+	switch valTyped := val.(type) {
+	case map[string]interface{}:
+		return valTyped, true
+	case map[interface{}]interface{}:
+		stringMap := map[string]interface{}{}
+		for key, value := range valTyped {
+			stringMap[fmt.Sprint(key)] = value
+		}
+		return stringMap, true
+	default:
+		return nil, false
+	}
+}
+
+func toStringList(val interface{}) ([]string, bool) {
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	strs := []string{}
+	for _, item := range list {
+		str, ok := item.(string)
+		if !ok {
+			return nil, false
+		}
+		strs = append(strs, str)
+	}
+	return strs, true
+}
+
+func toAllowedValues(val interface{}) (map[string][]string, bool) {
+	valueMap, ok := toStringMap(val)
+	if !ok {
+		return nil, false
+	}
+	allowedValues := map[string][]string{}
+	for label, values := range valueMap {
+		list, ok := toStringList(values)
+		if !ok {
+			return nil, false
+		}
+		allowedValues[label] = list
+	}
+	return allowedValues, true
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
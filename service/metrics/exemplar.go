@@ -0,0 +1,26 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/smallhouse123/go-library/internal/tracectx"
+)
+
+const (
+	EXEMPLAR_TRACE_ID = "trace_id"
+	EXEMPLAR_SPAN_ID  = "span_id"
+)
+
+// exemplarLabels returns the sampled span of ctx as exemplar labels, nil without one. Unsampled traces
+// aren't kept by the tracing backend, an exemplar would point nowhere.
+func exemplarLabels(ctx context.Context) prometheus.Labels {
+	ids, ok := tracectx.FromContext(ctx)
+	if !ok || !ids.Sampled {
+		return nil
+	}
+	return prometheus.Labels{
+		EXEMPLAR_TRACE_ID: ids.TraceId,
+		EXEMPLAR_SPAN_ID:  ids.SpanId,
+	}
+}
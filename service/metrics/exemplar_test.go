@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	testTraceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanId  = "00f067aa0ba902b7"
+)
+
+// spanContext returns ctx with a span of the test trace, sampled or not
+func spanContext(t *testing.T, sampled bool) context.Context {
+	traceId, err := trace.TraceIDFromHex(testTraceId)
+	require.NoError(t, err)
+	spanId, err := trace.SpanIDFromHex(testSpanId)
+	require.NoError(t, err)
+	flags := trace.TraceFlags(0)
+	if sampled {
+		flags = trace.FlagsSampled
+	}
+	return trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceId,
+		SpanID:     spanId,
+		TraceFlags: flags,
+	}))
+}
+
+// scrapeLines returns the lines of /metrics in the OpenMetrics format starting with prefix
+func scrapeLines(t *testing.T, s *Server, prefix string) []string {
+	res, body := get(s, "/metrics", func(r *http.Request) {
+		r.Header.Set("Accept", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.True(t, strings.HasPrefix(res.Header.Get("Content-Type"), "application/openmetrics-text"))
+
+	lines := []string{}
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// hasExemplar reports whether an OpenMetrics line has the exemplar of the test span, its labels in any order
+func hasExemplar(line string) bool {
+	parts := strings.SplitN(line, " # {", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	labels := strings.Split(strings.SplitN(parts[1], "}", 2)[0], ",")
+	sort.Strings(labels)
+	return strings.Join(labels, ",") == `span_id="`+testSpanId+`",trace_id="`+testTraceId+`"`
+}
+
+func TestExemplarsAreScraped(t *testing.T) {
+	pm, _ := newTestProm(t, nil, Definition{Name: "latency", Labels: []string{"route"}, Buckets: []float64{1, 10}})
+	s, _ := newTestServer(t, map[string]interface{}{}, pm)
+
+	timer, err := pm.BumpTimeContext(spanContext(t, true), "latency", "route", "/a")
+	require.NoError(t, err)
+	timer.End()
+	require.NoError(t, pm.BumpCountContext(spanContext(t, true), "requests", 2, "code", "200"))
+	// an unsampled trace isn't kept by the tracing backend, it gets no exemplar
+	require.NoError(t, pm.BumpCountContext(spanContext(t, false), "requests", 1, "code", "500"))
+	require.NoError(t, pm.BumpCountContext(context.Background(), "requests", 1, "code", "404"))
+
+	buckets := scrapeLines(t, s, `svc_latency_bucket{route="/a",le="1.0"}`)
+	require.Len(t, buckets, 1)
+	assert.True(t, hasExemplar(buckets[0]), "the timing lands in the first bucket with its exemplar: %s", buckets[0])
+	for _, bucket := range scrapeLines(t, s, `svc_latency_bucket{route="/a",le="10.0"}`) {
+		assert.NotContains(t, bucket, "# {", "an exemplar is only on the bucket of the observation")
+	}
+
+	counters := scrapeLines(t, s, "svc_requests")
+	require.NotEmpty(t, counters)
+	found := false
+	for _, line := range counters {
+		switch {
+		case strings.Contains(line, `code="200"`) && !strings.HasPrefix(line, "svc_requests_created"):
+			assert.True(t, hasExemplar(line), line)
+			assert.Regexp(t, `"\} 2\.0 \S+$`, line, "the exemplar has the added value and a timestamp")
+			found = true
+		case strings.Contains(line, `code="500"`), strings.Contains(line, `code="404"`):
+			assert.NotContains(t, line, "# {", line)
+		}
+	}
+	assert.True(t, found, "the counter is scraped: %v", counters)
+
+	// the text format has no exemplars
+	_, body := get(s, "/metrics", nil)
+	assert.NotContains(t, body, testTraceId)
+}
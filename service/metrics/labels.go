@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// validateLabelName checks a label key against the prometheus rules, keys starting with __ are reserved
+func validateLabelName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty label name")
+	}
+	if strings.HasPrefix(name, "__") {
+		return fmt.Errorf("label name %q is reserved", name)
+	}
+	for i, b := range name {
+		if !((b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || b == '_' || (b >= '0' && b <= '9' && i > 0)) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	return nil
+}
+
+func validateLabelNames(names []string) error {
+	seen := map[string]struct{}{}
+	for _, name := range names {
+		if err := validateLabelName(name); err != nil {
+			return err
+		}
+		if _, ok := seen[name]; ok {
+			return fmt.Errorf("label %q is given twice", name)
+		}
+		seen[name] = struct{}{}
+	}
+	return nil
+}
+
+// checkLabels returns the labels of tags, which must have exactly the label keys of the metric, in any order
+func checkLabels(names []string, tags []string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	for i := 0; i+1 < len(tags); i += 2 {
+		if err := validateLabelName(tags[i]); err != nil {
+			return nil, err
+		}
+		if _, ok := labels[tags[i]]; ok {
+			return nil, fmt.Errorf("label %q is given twice", tags[i])
+		}
+		labels[tags[i]] = tags[i+1]
+	}
+
+	missing := []string{}
+	for _, name := range names {
+		if _, ok := labels[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	unexpected := []string{}
+	if len(labels) != len(names)-len(missing) {
+		known := map[string]struct{}{}
+		for _, name := range names {
+			known[name] = struct{}{}
+		}
+		for name := range labels {
+			if _, ok := known[name]; !ok {
+				unexpected = append(unexpected, name)
+			}
+		}
+		sort.Strings(unexpected)
+	}
+
+	switch {
+	case len(missing) > 0 && len(unexpected) > 0:
+		return nil, fmt.Errorf("labels %v are missing and %v are unexpected, the metric has %v", missing, unexpected, names)
+	case len(missing) > 0:
+		return nil, fmt.Errorf("labels %v are missing, the metric has %v", missing, names)
+	case len(unexpected) > 0:
+		return nil, fmt.Errorf("labels %v are unexpected, the metric has %v", unexpected, names)
+	}
+	return labels, nil
+}
+
+// sameLabels reports whether both have the same label keys, in any order
+func sameLabels(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sortedA := append([]string{}, a...)
+	sortedB := append([]string{}, b...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+	for i := range sortedA {
+		if sortedA[i] != sortedB[i] {
+			return false
+		}
+	}
+	return true
+}
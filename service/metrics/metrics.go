@@ -1,14 +1,112 @@
 package metrics
 
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	BACKEND_PROMETHEUS = "prometheus"
+	BACKEND_OTEL       = "otel"
+	BACKEND_BOTH       = "both"
+	BACKEND_STATSD     = "statsd"
+)
+
 type Metrics interface {
 	// BunpTime wrap prometheus histogram for meaturing func time
 	BumpTime(key string, tags ...string) (Endable, error)
 
+	// BumpTimeContext is BumpTime with the trace of ctx attached as an exemplar
+	BumpTimeContext(ctx context.Context, key string, tags ...string) (Endable, error)
+
+	// Observe records a duration measured elsewhere into the histogram of key, like a timer of BumpTime
+	Observe(key string, duration time.Duration, tags ...string) error
+
+	// ObserveContext is Observe with the trace of ctx attached as an exemplar
+	ObserveContext(ctx context.Context, key string, duration time.Duration, tags ...string) error
+
 	// BumpCount warp prometheus counter for key counting, like request count
 	BumpCount(key string, val float64, tags ...string) error
+
+	// BumpCountContext is BumpCount with the trace of ctx attached as an exemplar
+	BumpCountContext(ctx context.Context, key string, val float64, tags ...string) error
+
+	// SetGauge wrap prometheus gauge for values going up and down, like queue depth
+	SetGauge(key string, val float64, tags ...string) error
+
+	// AddGauge adds val to the gauge, like an up down counter of in-flight requests
+	AddGauge(key string, val float64, tags ...string) error
+
+	// SubGauge subtracts val from the gauge
+	SubGauge(key string, val float64, tags ...string) error
+
+	// RegisterGaugeFunc wrap prometheus gauge func, fn is called at scrape time, like pool size
+	RegisterGaugeFunc(key string, fn func() float64, tags ...string) error
+
+	// BumpSummary wrap prometheus summary for observing values with quantiles, like payload size
+	BumpSummary(key string, val float64, tags ...string) error
 }
 
 type Endable interface {
-	// End close the timer
+	// End close the timer, a timer ended twice is only recorded once
 	End()
 }
+
+// TimedEndable is an Endable reporting its duration, the timers of every backend here are one
+type TimedEndable interface {
+	Endable
+
+	// EndWith close the timer with tags replacing the values of the ones it started with, like status=error,
+	// and returns the measured duration. Tags the timer didn't start with are added and checked only then.
+	EndWith(tags ...string) time.Duration
+
+	// Elapsed returns the time since the start, or the measured duration once ended
+	Elapsed() time.Duration
+}
+
+// New returns the metrics backend chosen by METRICS_BACKEND, prometheus by default, otel,
+// both of them at once while migrating, or statsd
+func New(p Params) (Metrics, error) {
+	backend := BACKEND_PROMETHEUS
+	if p.Config != nil {
+		if val, err := p.Config.Get("METRICS_BACKEND"); err == nil {
+			if valStr, ok := val.(string); ok && valStr != "" {
+				backend = valStr
+			}
+		}
+	}
+
+	switch backend {
+	case BACKEND_PROMETHEUS:
+		pm, err := NewProm(p)
+		if err != nil {
+			return nil, err
+		}
+		return pm, nil
+	case BACKEND_OTEL:
+		om, err := NewOtel(p)
+		if err != nil {
+			return nil, err
+		}
+		return om, nil
+	case BACKEND_BOTH:
+		pm, err := NewProm(p)
+		if err != nil {
+			return nil, err
+		}
+		om, err := NewOtel(p)
+		if err != nil {
+			return nil, err
+		}
+		return NewMulti(pm, om), nil
+	case BACKEND_STATSD:
+		sm, err := NewStatsd(p)
+		if err != nil {
+			return nil, err
+		}
+		return sm, nil
+	default:
+		return nil, fmt.Errorf("unknown METRICS_BACKEND '%s'", backend)
+	}
+}
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/fx/fxtest"
+)
+
+func TestNewPicksBackend(t *testing.T) {
+	receiver, url := newOtlpReceiver(t)
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer listener.Close()
+
+	for _, test := range []struct {
+		backend string
+		want    interface{}
+	}{
+		{"", &PromMetric{}},
+		{BACKEND_PROMETHEUS, &PromMetric{}},
+		{BACKEND_OTEL, &OtelMetric{}},
+		{BACKEND_BOTH, Multi{}},
+		{BACKEND_STATSD, &StatsdMetric{}},
+	} {
+		registry := prometheus.NewRegistry()
+		lifecycle := fxtest.NewLifecycle(t)
+		m, err := New(Params{
+			ServiceName: "svc",
+			Config: newTestConfig(t, map[string]interface{}{
+				"METRICS_BACKEND":       test.backend,
+				"METRICS_OTEL_ENDPOINT": url,
+				"METRICS_STATSD_ADDR":   listener.LocalAddr().String(),
+			}),
+			Registerer: registry,
+			Lifecycle:  lifecycle,
+		})
+		require.NoError(t, err, test.backend)
+		assert.IsType(t, test.want, m, test.backend)
+
+		require.NoError(t, lifecycle.Start(context.Background()))
+		require.NoError(t, m.BumpCount("requests_"+test.backend, 1, "code", "200"), test.backend)
+		require.NoError(t, lifecycle.Stop(context.Background()))
+
+		exported, _ := receiver.metrics()
+		_, toOtel := exported["svc_requests_"+test.backend]
+		assert.Equal(t, test.backend == BACKEND_OTEL || test.backend == BACKEND_BOTH, toOtel, "%q exports over OTLP", test.backend)
+		count, err := testutil.GatherAndCount(registry, "svc_requests_"+test.backend)
+		require.NoError(t, err)
+		assert.Equal(t, test.backend == "" || test.backend == BACKEND_PROMETHEUS || test.backend == BACKEND_BOTH, count == 1,
+			"%q goes to the registry", test.backend)
+	}
+
+	_, err = New(Params{ServiceName: "svc", Config: newTestConfig(t, map[string]interface{}{"METRICS_BACKEND": "graphite"})})
+	assert.ErrorContains(t, err, "unknown METRICS_BACKEND 'graphite'")
+}
+
+func TestMultiTimerIsAllOrNothing(t *testing.T) {
+	pm, registry := newTestProm(t, nil, Definition{Name: "latency", Labels: []string{"route"}})
+	sm, listener := newTestStatsd(t, map[string]interface{}{})
+	m := NewMulti(pm, sm)
+
+	timer, err := m.BumpTime("latency", "code", "200")
+	assert.ErrorContains(t, err, "labels [route] are missing and [code] are unexpected")
+	assert.Nil(t, timer, "no timer when a backend fails")
+
+	timer, err = m.BumpTime("latency", "route", "/a")
+	require.NoError(t, err)
+	timer.End()
+	require.NoError(t, sm.Close())
+
+	lines := readLines(t, listener)
+	require.Len(t, lines, 1, "only the timer returned is recorded")
+	assert.True(t, strings.HasPrefix(lines[0], "svc.latency:"), lines[0])
+	assert.Contains(t, lines[0], "route:/a")
+	count, err := testutil.GatherAndCount(registry, "svc_latency")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/smallhouse123/go-library/service/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	METRIC_GRPC_REQUESTS      = "grpc_server_requests_total"
+	METRIC_GRPC_ERRORS        = "grpc_server_errors_total"
+	METRIC_GRPC_DURATION      = "grpc_server_request_duration_seconds"
+	METRIC_GRPC_IN_FLIGHT     = "grpc_server_requests_in_flight"
+	METRIC_GRPC_REQUEST_SIZE  = "grpc_server_request_size_bytes"
+	METRIC_GRPC_RESPONSE_SIZE = "grpc_server_response_size_bytes"
+
+	// status classes of gRPC codes, the counterparts of 2xx, 4xx and 5xx
+	STATUS_CLASS_OK           = "ok"
+	STATUS_CLASS_CLIENT_ERROR = "client_error"
+	STATUS_CLASS_SERVER_ERROR = "server_error"
+
+	// methods of gRPC calls, by their kind of streaming
+	GRPC_UNARY         = "unary"
+	GRPC_CLIENT_STREAM = "client_stream"
+	GRPC_SERVER_STREAM = "server_stream"
+	GRPC_BIDI_STREAM   = "bidi_stream"
+)
+
+var (
+	errPanicked = status.Error(codes.Internal, "handler panicked")
+
+	// GRPCDefinitions describes the metrics of the gRPC interceptors, they're required with METRICS_STRICT
+	GRPCDefinitions = metrics.Definitions(
+		metrics.Definition{Name: METRIC_GRPC_REQUESTS, Help: "gRPC calls served", Labels: []string{"route", "method", "status_class"}},
+		metrics.Definition{Name: METRIC_GRPC_ERRORS, Help: "gRPC calls failed with a server error", Labels: []string{"route", "method", "status_class"}},
+		metrics.Definition{Name: METRIC_GRPC_DURATION, Help: "Time to serve gRPC calls", Labels: []string{"route", "method", "status_class"}},
+		metrics.Definition{Name: METRIC_GRPC_IN_FLIGHT, Help: "gRPC calls being served", Labels: []string{"route", "method"}},
+		metrics.Definition{Name: METRIC_GRPC_REQUEST_SIZE, Help: "Size of received gRPC messages", Labels: []string{"route", "method"}},
+		metrics.Definition{Name: METRIC_GRPC_RESPONSE_SIZE, Help: "Size of sent gRPC messages", Labels: []string{"route", "method"}},
+	)
+)
+
+// UnaryServerInterceptor records the unary calls of a gRPC server, the route is the full method name
+func UnaryServerInterceptor(m metrics.Metrics) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		done := begin(ctx, m, info.FullMethod, GRPC_UNARY)
+		defer finish(done, &err)
+		resp, err = handler(ctx, req)
+
+		recordMessage(m, METRIC_GRPC_REQUEST_SIZE, info.FullMethod, GRPC_UNARY, req)
+		if err == nil {
+			recordMessage(m, METRIC_GRPC_RESPONSE_SIZE, info.FullMethod, GRPC_UNARY, resp)
+		}
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor records the streaming calls of a gRPC server, with the size of every message
+func StreamServerInterceptor(m metrics.Metrics) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		method := GRPC_BIDI_STREAM
+		switch {
+		case info.IsClientStream && !info.IsServerStream:
+			method = GRPC_CLIENT_STREAM
+		case !info.IsClientStream && info.IsServerStream:
+			method = GRPC_SERVER_STREAM
+		}
+
+		done := begin(ss.Context(), m, info.FullMethod, method)
+		defer finish(done, &err)
+		return handler(srv, &serverStream{ServerStream: ss, metrics: m, route: info.FullMethod, method: method})
+	}
+}
+
+// finish records the end of a call with its error. A panicking handler is recorded as a server error,
+// then the panic goes on to the server or to a recovery interceptor.
+func finish(done func(err error), err *error) {
+	if p := recover(); p != nil {
+		done(errPanicked)
+		panic(p)
+	}
+	done(*err)
+}
+
+// begin counts a call in flight, the returned func records its end
+func begin(ctx context.Context, m metrics.Metrics, route, method string) func(err error) {
+	start := time.Now()
+	m.AddGauge(METRIC_GRPC_IN_FLIGHT, 1, "route", route, "method", method)
+
+	return func(err error) {
+		m.SubGauge(METRIC_GRPC_IN_FLIGHT, 1, "route", route, "method", method)
+
+		statusClass := StatusClass(status.Code(err))
+		m.BumpCountContext(ctx, METRIC_GRPC_REQUESTS, 1, "route", route, "method", method, "status_class", statusClass)
+		if statusClass == STATUS_CLASS_SERVER_ERROR {
+			m.BumpCountContext(ctx, METRIC_GRPC_ERRORS, 1, "route", route, "method", method, "status_class", statusClass)
+		}
+		m.ObserveContext(ctx, METRIC_GRPC_DURATION, time.Since(start), "route", route, "method", method, "status_class", statusClass)
+	}
+}
+
+// StatusClass groups gRPC codes like HTTP status classes, errors caused by the caller are client errors
+func StatusClass(code codes.Code) string {
+	switch code {
+	case codes.OK:
+		return STATUS_CLASS_OK
+	case codes.Canceled, codes.InvalidArgument, codes.NotFound, codes.AlreadyExists, codes.PermissionDenied,
+		codes.ResourceExhausted, codes.FailedPrecondition, codes.Aborted, codes.OutOfRange, codes.Unauthenticated:
+		return STATUS_CLASS_CLIENT_ERROR
+	default:
+		return STATUS_CLASS_SERVER_ERROR
+	}
+}
+
+// recordMessage records the size of a protobuf message, other messages are skipped
+func recordMessage(m metrics.Metrics, key, route, method string, msg interface{}) {
+	if message, ok := msg.(proto.Message); ok {
+		m.BumpSummary(key, float64(proto.Size(message)), "route", route, "method", method)
+	}
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	metrics metrics.Metrics
+	route   string
+	method  string
+}
+
+func (s *serverStream) RecvMsg(msg interface{}) error {
+	err := s.ServerStream.RecvMsg(msg)
+	if err == nil {
+		recordMessage(s.metrics, METRIC_GRPC_REQUEST_SIZE, s.route, s.method, msg)
+	}
+	return err
+}
+
+func (s *serverStream) SendMsg(msg interface{}) error {
+	err := s.ServerStream.SendMsg(msg)
+	if err == nil {
+		recordMessage(s.metrics, METRIC_GRPC_RESPONSE_SIZE, s.route, s.method, msg)
+	}
+	return err
+}
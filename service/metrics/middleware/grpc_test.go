@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type testServerStream struct {
+	grpc.ServerStream
+}
+
+func (s testServerStream) Context() context.Context {
+	return context.Background()
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	m, registry := newTestMetrics(t)
+	interceptor := UnaryServerInterceptor(m)
+	info := &grpc.UnaryServerInfo{FullMethod: "/users.Users/Get"}
+
+	resp, err := interceptor(context.Background(), wrapperspb.String("42"), info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return wrapperspb.String("alice"), nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", resp.(*wrapperspb.StringValue).GetValue())
+
+	_, err = interceptor(context.Background(), wrapperspb.String("43"), info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "no such user")
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	route := map[string]string{"route": "/users.Users/Get", "method": GRPC_UNARY}
+	assert.Equal(t, 1.0, seriesValue(t, registry, METRIC_GRPC_REQUESTS, map[string]string{"status_class": STATUS_CLASS_OK}))
+	assert.Equal(t, 1.0, seriesValue(t, registry, METRIC_GRPC_REQUESTS, map[string]string{"status_class": STATUS_CLASS_CLIENT_ERROR}))
+	assert.Equal(t, 0.0, seriesValue(t, registry, METRIC_GRPC_ERRORS, nil))
+	assert.Equal(t, 2.0, seriesValue(t, registry, METRIC_GRPC_REQUEST_SIZE, route))
+	assert.Equal(t, 1.0, seriesValue(t, registry, METRIC_GRPC_RESPONSE_SIZE, route))
+	assert.Equal(t, 0.0, seriesValue(t, registry, METRIC_GRPC_IN_FLIGHT, route))
+}
+
+func TestUnaryServerInterceptorRecordsPanics(t *testing.T) {
+	m, registry := newTestMetrics(t)
+	interceptor := UnaryServerInterceptor(m)
+	info := &grpc.UnaryServerInfo{FullMethod: "/users.Users/Get"}
+
+	assert.PanicsWithValue(t, "boom", func() {
+		interceptor(context.Background(), wrapperspb.String("42"), info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			panic("boom")
+		})
+	}, "the panic goes on to the server")
+
+	failed := map[string]string{"route": "/users.Users/Get", "status_class": STATUS_CLASS_SERVER_ERROR}
+	assert.Equal(t, 1.0, seriesValue(t, registry, METRIC_GRPC_REQUESTS, failed))
+	assert.Equal(t, 1.0, seriesValue(t, registry, METRIC_GRPC_ERRORS, failed))
+	assert.Equal(t, 1.0, seriesValue(t, registry, METRIC_GRPC_DURATION, failed))
+	assert.Equal(t, 0.0, seriesValue(t, registry, METRIC_GRPC_IN_FLIGHT, nil))
+}
+
+func TestStreamServerInterceptorRecordsPanics(t *testing.T) {
+	m, registry := newTestMetrics(t)
+	interceptor := StreamServerInterceptor(m)
+	info := &grpc.StreamServerInfo{FullMethod: "/users.Users/Watch", IsServerStream: true}
+
+	assert.Panics(t, func() {
+		interceptor(nil, testServerStream{}, info, func(srv interface{}, stream grpc.ServerStream) error {
+			panic("boom")
+		})
+	})
+	err := interceptor(nil, testServerStream{}, info, func(srv interface{}, stream grpc.ServerStream) error {
+		return status.Error(codes.Unavailable, "draining")
+	})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	failed := map[string]string{"route": "/users.Users/Watch", "method": GRPC_SERVER_STREAM, "status_class": STATUS_CLASS_SERVER_ERROR}
+	assert.Equal(t, 2.0, seriesValue(t, registry, METRIC_GRPC_ERRORS, failed))
+	assert.Equal(t, 0.0, seriesValue(t, registry, METRIC_GRPC_IN_FLIGHT, nil))
+}
+
+func TestStatusClass(t *testing.T) {
+	assert.Equal(t, STATUS_CLASS_OK, StatusClass(codes.OK))
+	assert.Equal(t, STATUS_CLASS_CLIENT_ERROR, StatusClass(codes.InvalidArgument))
+	assert.Equal(t, STATUS_CLASS_SERVER_ERROR, StatusClass(codes.Internal))
+	assert.Equal(t, STATUS_CLASS_SERVER_ERROR, StatusClass(codes.Unknown))
+}
@@ -0,0 +1,168 @@
+// Package middleware records the requests, errors and duration of HTTP and gRPC servers
+// through metrics.Metrics, labeled by route template, method and status class.
+package middleware
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/smallhouse123/go-library/service/metrics"
+)
+
+const (
+	METRIC_HTTP_REQUESTS      = "http_server_requests_total"
+	METRIC_HTTP_ERRORS        = "http_server_errors_total"
+	METRIC_HTTP_DURATION      = "http_server_request_duration_seconds"
+	METRIC_HTTP_IN_FLIGHT     = "http_server_requests_in_flight"
+	METRIC_HTTP_REQUEST_SIZE  = "http_server_request_size_bytes"
+	METRIC_HTTP_RESPONSE_SIZE = "http_server_response_size_bytes"
+)
+
+var (
+	// HTTPDefinitions describes the metrics of HTTPMiddleware, they're required with METRICS_STRICT
+	HTTPDefinitions = metrics.Definitions(
+		metrics.Definition{Name: METRIC_HTTP_REQUESTS, Help: "HTTP requests served", Labels: []string{"route", "method", "status_class"}},
+		metrics.Definition{Name: METRIC_HTTP_ERRORS, Help: "HTTP requests answered with a 5xx status", Labels: []string{"route", "method", "status_class"}},
+		metrics.Definition{Name: METRIC_HTTP_DURATION, Help: "Time to serve HTTP requests", Labels: []string{"route", "method", "status_class"}},
+		metrics.Definition{Name: METRIC_HTTP_IN_FLIGHT, Help: "HTTP requests being served", Labels: []string{"method"}},
+		metrics.Definition{Name: METRIC_HTTP_REQUEST_SIZE, Help: "Size of HTTP request bodies", Labels: []string{"route", "method"}},
+		metrics.Definition{Name: METRIC_HTTP_RESPONSE_SIZE, Help: "Size of HTTP response bodies", Labels: []string{"route", "method", "status_class"}},
+	)
+)
+
+// Options tune how requests are labeled
+type Options struct {
+	// Route returns the route template of a request, the route set with SetRoute wins over it
+	// and the normalized path is used when both are empty
+	Route func(r *http.Request) string
+	// Normalize turns a raw path into a route, NormalizePath by default
+	Normalize func(path string) string
+	// MaxRoutes caps the routes taken from normalized paths, later new ones are labeled OTHER_ROUTE.
+	// It's DEFAULT_MAX_ROUTES when 0, a negative value turns the cap off.
+	MaxRoutes int
+}
+
+// HTTPMiddleware wraps a handler to record its requests. Metrics failing to record never fail a request.
+// A panicking handler is recorded as a 500 and keeps panicking.
+func HTTPMiddleware(m metrics.Metrics, opts Options) func(http.Handler) http.Handler {
+	normalize := opts.Normalize
+	if normalize == nil {
+		normalize = NormalizePath
+	}
+	maxRoutes := opts.MaxRoutes
+	if maxRoutes == 0 {
+		maxRoutes = DEFAULT_MAX_ROUTES
+	}
+	routes := newRouteLimiter(maxRoutes)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			method := normalizeMethod(r.Method)
+
+			m.AddGauge(METRIC_HTTP_IN_FLIGHT, 1, "method", method)
+			defer m.SubGauge(METRIC_HTTP_IN_FLIGHT, 1, "method", method)
+
+			ctx, routeHolder := withRouteHolder(r.Context())
+			r = r.WithContext(ctx)
+			body := &countingBody{ReadCloser: r.Body}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = body
+			}
+			rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+
+			// a panicking handler is recorded as a 500, then the panic goes on to the server
+			defer func() {
+				p := recover()
+				if p != nil {
+					rw.status = http.StatusInternalServerError
+				}
+
+				route := *routeHolder
+				if route == "" && opts.Route != nil {
+					route = opts.Route(r)
+				}
+				if route == "" {
+					if rw.status == http.StatusNotFound {
+						route = NOT_FOUND_ROUTE
+					} else {
+						route = routes.route(normalize(r.URL.Path))
+					}
+				}
+
+				statusClass := strconv.Itoa(rw.status/100) + "xx"
+				m.BumpCountContext(ctx, METRIC_HTTP_REQUESTS, 1, "route", route, "method", method, "status_class", statusClass)
+				if rw.status >= 500 {
+					m.BumpCountContext(ctx, METRIC_HTTP_ERRORS, 1, "route", route, "method", method, "status_class", statusClass)
+				}
+				m.ObserveContext(ctx, METRIC_HTTP_DURATION, time.Since(start), "route", route, "method", method, "status_class", statusClass)
+				m.BumpSummary(METRIC_HTTP_REQUEST_SIZE, float64(body.size), "route", route, "method", method)
+				m.BumpSummary(METRIC_HTTP_RESPONSE_SIZE, float64(rw.size), "route", route, "method", method, "status_class", statusClass)
+
+				if p != nil {
+					panic(p)
+				}
+			}()
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+type countingBody struct {
+	io.ReadCloser
+	size int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.size += int64(n)
+	return n, err
+}
+
+// responseWriter records the status and the size of a response
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	size        int64
+	wroteHeader bool
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	n, err := rw.ResponseWriter.Write(b)
+	rw.size += int64(n)
+	return n, err
+}
+
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer doesn't support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the original writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/smallhouse123/go-library/service/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMetrics(t *testing.T) (metrics.Metrics, *prometheus.Registry) {
+	registry := prometheus.NewRegistry()
+	m, err := metrics.NewProm(metrics.Params{Registerer: registry, Gatherer: registry})
+	require.NoError(t, err)
+	return m, registry
+}
+
+// seriesValue returns the value of the series of name with labels, the count of a histogram or a summary.
+// The series have to carry every given label, other labels are summed over.
+func seriesValue(t *testing.T, registry *prometheus.Registry, name string, labels map[string]string) float64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	var value float64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	series:
+		for _, metric := range family.GetMetric() {
+			matched := 0
+			for _, label := range metric.GetLabel() {
+				if want, ok := labels[label.GetName()]; ok {
+					if label.GetValue() != want {
+						continue series
+					}
+					matched++
+				}
+			}
+			if matched != len(labels) {
+				continue
+			}
+			switch {
+			case metric.Counter != nil:
+				value += metric.Counter.GetValue()
+			case metric.Gauge != nil:
+				value += metric.Gauge.GetValue()
+			case metric.Histogram != nil:
+				value += float64(metric.Histogram.GetSampleCount())
+			case metric.Summary != nil:
+				value += float64(metric.Summary.GetSampleCount())
+			}
+		}
+	}
+	return value
+}
+
+func serve(handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+func TestHTTPMiddlewareRecordsRequests(t *testing.T) {
+	m, registry := newTestMetrics(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/", func(w http.ResponseWriter, r *http.Request) {
+		SetRoute(r.Context(), "/users/{id}")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+	mux.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	})
+	handler := HTTPMiddleware(m, Options{})(mux)
+
+	serve(handler, http.MethodPost, "/users/42", "body")
+	serve(handler, http.MethodPost, "/users/43", "")
+	serve(handler, http.MethodGet, "/fail", "")
+	serve(handler, http.MethodGet, "/missing/42", "")
+	serve(handler, "PURGE", "/fail", "")
+
+	created := map[string]string{"route": "/users/{id}", "method": "POST", "status_class": "2xx"}
+	assert.Equal(t, 2.0, seriesValue(t, registry, METRIC_HTTP_REQUESTS, created))
+	assert.Equal(t, 2.0, seriesValue(t, registry, METRIC_HTTP_DURATION, created))
+	assert.Equal(t, 2.0, seriesValue(t, registry, METRIC_HTTP_RESPONSE_SIZE, created))
+
+	failed := map[string]string{"route": "/fail", "method": "GET", "status_class": "5xx"}
+	assert.Equal(t, 1.0, seriesValue(t, registry, METRIC_HTTP_ERRORS, failed))
+	assert.Equal(t, 1.0, seriesValue(t, registry, METRIC_HTTP_REQUESTS, map[string]string{"route": NOT_FOUND_ROUTE}))
+	assert.Equal(t, 1.0, seriesValue(t, registry, METRIC_HTTP_REQUESTS, map[string]string{"method": OTHER_METHOD}))
+	assert.Equal(t, 0.0, seriesValue(t, registry, METRIC_HTTP_IN_FLIGHT, nil))
+}
+
+func TestHTTPMiddlewareRecordsPanics(t *testing.T) {
+	m, registry := newTestMetrics(t)
+	handler := HTTPMiddleware(m, Options{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	assert.PanicsWithValue(t, "boom", func() {
+		serve(handler, http.MethodGet, "/orders/7", "")
+	}, "the panic goes on to the server")
+
+	failed := map[string]string{"route": "/orders/{id}", "method": "GET", "status_class": "5xx"}
+	assert.Equal(t, 1.0, seriesValue(t, registry, METRIC_HTTP_REQUESTS, failed))
+	assert.Equal(t, 1.0, seriesValue(t, registry, METRIC_HTTP_ERRORS, failed))
+	assert.Equal(t, 0.0, seriesValue(t, registry, METRIC_HTTP_IN_FLIGHT, nil))
+}
+
+func TestHTTPMiddlewareCapsRoutes(t *testing.T) {
+	m, registry := newTestMetrics(t)
+	handler := HTTPMiddleware(m, Options{MaxRoutes: 2})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// slugs aren't recognized as ids, every one would be a route
+	for i := 0; i < 5; i++ {
+		serve(handler, http.MethodGet, fmt.Sprintf("/posts/hello-world-%c", 'a'+i), "")
+	}
+	serve(handler, http.MethodGet, "/posts/hello-world-a", "")
+	// a route set by the router isn't capped
+	serve(HTTPMiddleware(m, Options{MaxRoutes: 2, Route: func(r *http.Request) string { return "/posts/{slug}" }})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})), http.MethodGet, "/posts/x", "")
+
+	assert.Equal(t, 2.0, seriesValue(t, registry, METRIC_HTTP_REQUESTS, map[string]string{"route": "/posts/hello-world-a"}))
+	assert.Equal(t, 1.0, seriesValue(t, registry, METRIC_HTTP_REQUESTS, map[string]string{"route": "/posts/hello-world-b"}))
+	assert.Equal(t, 3.0, seriesValue(t, registry, METRIC_HTTP_REQUESTS, map[string]string{"route": OTHER_ROUTE}))
+	assert.Equal(t, 1.0, seriesValue(t, registry, METRIC_HTTP_REQUESTS, map[string]string{"route": "/posts/{slug}"}))
+}
+
+func TestNormalizePath(t *testing.T) {
+	for path, want := range map[string]string{
+		"":           "/",
+		"/users/42":  "/users/{id}",
+		"/users/42/": "/users/{id}/",
+		"/orders/6f1c0b52-51c4-4c1e-9a4e-3f4b7c1e2d10/items": "/orders/{uuid}/items",
+		"/files/0123456789abcdef":                            "/files/{token}",
+		"/health":                                            "/health",
+	} {
+		assert.Equal(t, want, NormalizePath(path), path)
+	}
+}
@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	// NOT_FOUND_ROUTE is the route of requests answered 404 without a route set, so scanners don't add series
+	NOT_FOUND_ROUTE = "not_found"
+	// OTHER_METHOD replaces the HTTP methods that aren't standard
+	OTHER_METHOD = "other"
+	// OTHER_ROUTE replaces the normalized paths past Options.MaxRoutes
+	OTHER_ROUTE = "other"
+
+	DEFAULT_MAX_ROUTES = 500
+)
+
+type routeKey struct{}
+
+// SetRoute records the route template of the request being served, like /users/{id}.
+// Routers call it once they matched, it takes precedence over Options.Route and the normalized path.
+func SetRoute(ctx context.Context, route string) {
+	if holder, ok := ctx.Value(routeKey{}).(*string); ok {
+		*holder = route
+	}
+}
+
+func withRouteHolder(ctx context.Context) (context.Context, *string) {
+	holder := new(string)
+	return context.WithValue(ctx, routeKey{}, holder), holder
+}
+
+// NormalizePath replaces the segments of a path that look like ids with placeholders,
+// /users/42/orders/6f1c0b52-51c4-4c1e-9a4e-3f4b7c1e2d10 becomes /users/{id}/orders/{uuid}
+func NormalizePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		switch {
+		case segment == "":
+		case isNumber(segment):
+			segments[i] = "{id}"
+		case isUUID(segment):
+			segments[i] = "{uuid}"
+		case len(segment) >= 16 && isHex(segment), len(segment) > 32:
+			segments[i] = "{token}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isNumber(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		if i == 8 || i == 13 || i == 18 || i == 23 {
+			if c != '-' {
+				return false
+			}
+		} else if !isHex(string(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return OTHER_METHOD
+	}
+}
+
+// routeLimiter caps the distinct routes taken from raw paths, a path with ids NormalizePath doesn't recognize,
+// like slugs, would otherwise add series for every value
+type routeLimiter struct {
+	max    int
+	mutex  sync.RWMutex
+	routes map[string]struct{}
+}
+
+func newRouteLimiter(max int) *routeLimiter {
+	return &routeLimiter{max: max, routes: map[string]struct{}{}}
+}
+
+// route returns route while it's known or there is room for it, OTHER_ROUTE otherwise
+func (l *routeLimiter) route(route string) string {
+	if l.max < 0 {
+		return route
+	}
+
+	l.mutex.RLock()
+	_, known := l.routes[route]
+	full := len(l.routes) >= l.max
+	l.mutex.RUnlock()
+	if known {
+		return route
+	}
+	if full {
+		return OTHER_ROUTE
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, known := l.routes[route]; !known {
+		if len(l.routes) >= l.max {
+			return OTHER_ROUTE
+		}
+		l.routes[route] = struct{}{}
+	}
+	return route
+}
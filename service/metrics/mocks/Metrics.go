@@ -3,8 +3,12 @@
 package mocks
 
 import (
+	context "context"
+
 	metrics "github.com/smallhouse123/go-library/service/metrics"
 	mock "github.com/stretchr/testify/mock"
+
+	time "time"
 )
 
 // Metrics is an autogenerated mock type for the Metrics type
@@ -12,6 +16,31 @@ type Metrics struct {
 	mock.Mock
 }
 
+// AddGauge provides a mock function with given fields: key, val, tags
+func (_m *Metrics) AddGauge(key string, val float64, tags ...string) error {
+	_va := make([]interface{}, len(tags))
+	for _i := range tags {
+		_va[_i] = tags[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, key, val)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	if len(ret) == 0 {
+		panic("no return value specified for AddGauge")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, float64, ...string) error); ok {
+		r0 = rf(key, val, tags...)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // BumpCount provides a mock function with given fields: key, val, tags
 func (_m *Metrics) BumpCount(key string, val float64, tags ...string) error {
 	_va := make([]interface{}, len(tags))
@@ -37,6 +66,56 @@ func (_m *Metrics) BumpCount(key string, val float64, tags ...string) error {
 	return r0
 }
 
+// BumpCountContext provides a mock function with given fields: ctx, key, val, tags
+func (_m *Metrics) BumpCountContext(ctx context.Context, key string, val float64, tags ...string) error {
+	_va := make([]interface{}, len(tags))
+	for _i := range tags {
+		_va[_i] = tags[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, key, val)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	if len(ret) == 0 {
+		panic("no return value specified for BumpCountContext")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, float64, ...string) error); ok {
+		r0 = rf(ctx, key, val, tags...)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// BumpSummary provides a mock function with given fields: key, val, tags
+func (_m *Metrics) BumpSummary(key string, val float64, tags ...string) error {
+	_va := make([]interface{}, len(tags))
+	for _i := range tags {
+		_va[_i] = tags[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, key, val)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	if len(ret) == 0 {
+		panic("no return value specified for BumpSummary")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, float64, ...string) error); ok {
+		r0 = rf(key, val, tags...)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // BumpTime provides a mock function with given fields: key, tags
 func (_m *Metrics) BumpTime(key string, tags ...string) (metrics.Endable, error) {
 	_va := make([]interface{}, len(tags))
@@ -74,6 +153,168 @@ func (_m *Metrics) BumpTime(key string, tags ...string) (metrics.Endable, error)
 	return r0, r1
 }
 
+// BumpTimeContext provides a mock function with given fields: ctx, key, tags
+func (_m *Metrics) BumpTimeContext(ctx context.Context, key string, tags ...string) (metrics.Endable, error) {
+	_va := make([]interface{}, len(tags))
+	for _i := range tags {
+		_va[_i] = tags[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, key)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	if len(ret) == 0 {
+		panic("no return value specified for BumpTimeContext")
+	}
+
+	var r0 metrics.Endable
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, ...string) (metrics.Endable, error)); ok {
+		return rf(ctx, key, tags...)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string, ...string) metrics.Endable); ok {
+		r0 = rf(ctx, key, tags...)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(metrics.Endable)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string, ...string) error); ok {
+		r1 = rf(ctx, key, tags...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Observe provides a mock function with given fields: key, duration, tags
+func (_m *Metrics) Observe(key string, duration time.Duration, tags ...string) error {
+	_va := make([]interface{}, len(tags))
+	for _i := range tags {
+		_va[_i] = tags[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, key, duration)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Observe")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, time.Duration, ...string) error); ok {
+		r0 = rf(key, duration, tags...)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ObserveContext provides a mock function with given fields: ctx, key, duration, tags
+func (_m *Metrics) ObserveContext(ctx context.Context, key string, duration time.Duration, tags ...string) error {
+	_va := make([]interface{}, len(tags))
+	for _i := range tags {
+		_va[_i] = tags[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, key, duration)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	if len(ret) == 0 {
+		panic("no return value specified for ObserveContext")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, time.Duration, ...string) error); ok {
+		r0 = rf(ctx, key, duration, tags...)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RegisterGaugeFunc provides a mock function with given fields: key, fn, tags
+func (_m *Metrics) RegisterGaugeFunc(key string, fn func() float64, tags ...string) error {
+	_va := make([]interface{}, len(tags))
+	for _i := range tags {
+		_va[_i] = tags[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, key, fn)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	if len(ret) == 0 {
+		panic("no return value specified for RegisterGaugeFunc")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, func() float64, ...string) error); ok {
+		r0 = rf(key, fn, tags...)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SetGauge provides a mock function with given fields: key, val, tags
+func (_m *Metrics) SetGauge(key string, val float64, tags ...string) error {
+	_va := make([]interface{}, len(tags))
+	for _i := range tags {
+		_va[_i] = tags[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, key, val)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	if len(ret) == 0 {
+		panic("no return value specified for SetGauge")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, float64, ...string) error); ok {
+		r0 = rf(key, val, tags...)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SubGauge provides a mock function with given fields: key, val, tags
+func (_m *Metrics) SubGauge(key string, val float64, tags ...string) error {
+	_va := make([]interface{}, len(tags))
+	for _i := range tags {
+		_va[_i] = tags[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, key, val)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	if len(ret) == 0 {
+		panic("no return value specified for SubGauge")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, float64, ...string) error); ok {
+		r0 = rf(key, val, tags...)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // NewMetrics creates a new instance of Metrics. It also registers a testing interface on the mock and a cleanup function to assert the mocks expectations.
 // The first argument is typically a *testing.T value.
 func NewMetrics(t interface {
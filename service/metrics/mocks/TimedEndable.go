@@ -0,0 +1,75 @@
+// Code generated by mockery v2.53.4. DO NOT EDIT.
+
+package mocks
+
+import (
+	time "time"
+
+	mock "github.com/stretchr/testify/mock"
+)
+
+// TimedEndable is an autogenerated mock type for the TimedEndable type
+type TimedEndable struct {
+	mock.Mock
+}
+
+// Elapsed provides a mock function with no fields
+func (_m *TimedEndable) Elapsed() time.Duration {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for Elapsed")
+	}
+
+	var r0 time.Duration
+	if rf, ok := ret.Get(0).(func() time.Duration); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(time.Duration)
+	}
+
+	return r0
+}
+
+// End provides a mock function with no fields
+func (_m *TimedEndable) End() {
+	_m.Called()
+}
+
+// EndWith provides a mock function with given fields: tags
+func (_m *TimedEndable) EndWith(tags ...string) time.Duration {
+	_va := make([]interface{}, len(tags))
+	for _i := range tags {
+		_va[_i] = tags[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	if len(ret) == 0 {
+		panic("no return value specified for EndWith")
+	}
+
+	var r0 time.Duration
+	if rf, ok := ret.Get(0).(func(...string) time.Duration); ok {
+		r0 = rf(tags...)
+	} else {
+		r0 = ret.Get(0).(time.Duration)
+	}
+
+	return r0
+}
+
+// NewTimedEndable creates a new instance of TimedEndable. It also registers a testing interface on the mock and a cleanup function to assert the mocks expectations.
+// The first argument is typically a *testing.T value.
+func NewTimedEndable(t interface {
+	mock.TestingT
+	Cleanup(func())
+}) *TimedEndable {
+	mock := &TimedEndable{}
+	mock.Mock.Test(t)
+
+	t.Cleanup(func() { mock.AssertExpectations(t) })
+
+	return mock
+}
@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Multi sends every metric to all of its backends, like prometheus and otel while migrating
+type Multi []Metrics
+
+func NewMulti(backends ...Metrics) Multi {
+	return Multi(backends)
+}
+
+// Gatherer returns the registry of the first backend having one, so the metrics server keeps working
+func (m Multi) Gatherer() prometheus.Gatherer {
+	for _, backend := range m {
+		if g, ok := backend.(interface{ Gatherer() prometheus.Gatherer }); ok {
+			return g.Gatherer()
+		}
+	}
+	return nil
+}
+
+// BumpTime starts a timer on every backend. When any of them fails, no timer is returned, the errors are,
+// and the timers started on the other backends are dropped without recording.
+func (m Multi) BumpTime(key string, tags ...string) (Endable, error) {
+	return m.BumpTimeContext(context.Background(), key, tags...)
+}
+
+func (m Multi) BumpTimeContext(ctx context.Context, key string, tags ...string) (Endable, error) {
+	timers := multiTimer{}
+	errs := []error{}
+	for _, backend := range m {
+		timer, err := backend.BumpTimeContext(ctx, key, tags...)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		timers = append(timers, timer)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return timers, nil
+}
+
+func (m Multi) Observe(key string, duration time.Duration, tags ...string) error {
+	return m.each(func(backend Metrics) error { return backend.Observe(key, duration, tags...) })
+}
+
+func (m Multi) ObserveContext(ctx context.Context, key string, duration time.Duration, tags ...string) error {
+	return m.each(func(backend Metrics) error { return backend.ObserveContext(ctx, key, duration, tags...) })
+}
+
+func (m Multi) BumpCount(key string, val float64, tags ...string) error {
+	return m.each(func(backend Metrics) error { return backend.BumpCount(key, val, tags...) })
+}
+
+func (m Multi) BumpCountContext(ctx context.Context, key string, val float64, tags ...string) error {
+	return m.each(func(backend Metrics) error { return backend.BumpCountContext(ctx, key, val, tags...) })
+}
+
+func (m Multi) SetGauge(key string, val float64, tags ...string) error {
+	return m.each(func(backend Metrics) error { return backend.SetGauge(key, val, tags...) })
+}
+
+func (m Multi) AddGauge(key string, val float64, tags ...string) error {
+	return m.each(func(backend Metrics) error { return backend.AddGauge(key, val, tags...) })
+}
+
+func (m Multi) SubGauge(key string, val float64, tags ...string) error {
+	return m.each(func(backend Metrics) error { return backend.SubGauge(key, val, tags...) })
+}
+
+func (m Multi) RegisterGaugeFunc(key string, fn func() float64, tags ...string) error {
+	return m.each(func(backend Metrics) error { return backend.RegisterGaugeFunc(key, fn, tags...) })
+}
+
+func (m Multi) BumpSummary(key string, val float64, tags ...string) error {
+	return m.each(func(backend Metrics) error { return backend.BumpSummary(key, val, tags...) })
+}
+
+// each calls fn with every backend, even after one failed
+func (m Multi) each(fn func(backend Metrics) error) error {
+	errs := []error{}
+	for _, backend := range m {
+		if err := fn(backend); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// multiTimer ends the timers of every backend, the durations are the ones of the first timer reporting them
+type multiTimer []Endable
+
+func (m multiTimer) End() {
+	m.EndWith()
+}
+
+// EndWith ends every timer, one that isn't a TimedEndable, like the timer of an outside backend, ends without the tags
+func (m multiTimer) EndWith(tags ...string) time.Duration {
+	var duration time.Duration
+	reported := false
+	for _, timer := range m {
+		timed, ok := timer.(TimedEndable)
+		if !ok {
+			timer.End()
+			continue
+		}
+		if d := timed.EndWith(tags...); !reported {
+			duration = d
+			reported = true
+		}
+	}
+	return duration
+}
+
+func (m multiTimer) Elapsed() time.Duration {
+	for _, timer := range m {
+		if timed, ok := timer.(TimedEndable); ok {
+			return timed.Elapsed()
+		}
+	}
+	return 0
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"context"
+	"time"
+)
+
+// Nop discards every metric, it stands in for services running without a metrics backend.
+type Nop struct{}
+
+func NewNop() Metrics {
+	return Nop{}
+}
+
+// BumpTime returns a timer that measures but records nothing
+func (Nop) BumpTime(key string, tags ...string) (Endable, error) {
+	return newTimer(tags, nil), nil
+}
+
+func (Nop) BumpTimeContext(ctx context.Context, key string, tags ...string) (Endable, error) {
+	return newTimer(tags, nil), nil
+}
+
+func (Nop) Observe(key string, duration time.Duration, tags ...string) error {
+	return nil
+}
+
+func (Nop) ObserveContext(ctx context.Context, key string, duration time.Duration, tags ...string) error {
+	return nil
+}
+
+func (Nop) BumpCountContext(ctx context.Context, key string, val float64, tags ...string) error {
+	return nil
+}
+
+func (Nop) BumpCount(key string, val float64, tags ...string) error {
+	return nil
+}
+
+func (Nop) SetGauge(key string, val float64, tags ...string) error {
+	return nil
+}
+
+func (Nop) AddGauge(key string, val float64, tags ...string) error {
+	return nil
+}
+
+func (Nop) SubGauge(key string, val float64, tags ...string) error {
+	return nil
+}
+
+func (Nop) RegisterGaugeFunc(key string, fn func() float64, tags ...string) error {
+	return nil
+}
+
+func (Nop) BumpSummary(key string, val float64, tags ...string) error {
+	return nil
+}
@@ -0,0 +1,455 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_OTEL_INTERVAL = 15 // seconds
+	DEFAULT_OTEL_TIMEOUT  = 10 // seconds
+
+	OTEL_METER_NAME = "github.com/smallhouse123/go-library/service/metrics"
+)
+
+var (
+	// DEFAULT_OTEL_SUMMARY_BUCKETS are the buckets of the histograms summaries are sent as, the defaults
+	// of the otel SDK, meant for sizes and counts rather than seconds
+	DEFAULT_OTEL_SUMMARY_BUCKETS = []float64{0, 5, 10, 25, 50, 75, 100, 250, 500, 750, 1000, 2500, 5000, 7500, 10000}
+)
+
+// OtelMetric sends the metrics to an OpenTelemetry collector over OTLP/HTTP. Metrics keep the names
+// they have in prometheus, summaries are sent as histograms since otel has no summary.
+type OtelMetric struct {
+	service          string
+	provider         *sdkmetric.MeterProvider
+	meter            metric.Meter
+	strict           bool
+	summaryBuckets   []float64
+	limits           *limiter
+	instruments      sync.Map
+	gaugeFuncs       sync.Map
+	definitions      map[string]Definition
+	definitionsMutex sync.RWMutex
+	mutex            sync.Mutex
+	sugar            *zap.SugaredLogger
+}
+
+// otelInstrument is a created instrument with the label keys every use of it has to give
+type otelInstrument struct {
+	metricType string
+	labels     []string
+	limit      *seriesLimit
+	histogram  metric.Float64Histogram
+	counter    metric.Float64Counter
+	gauge      *otelGauge
+}
+
+// otelGauge keeps the values of a gauge, otel observes them when it collects
+type otelGauge struct {
+	mutex  sync.Mutex
+	series map[attribute.Distinct]*gaugeSeries
+}
+
+type gaugeSeries struct {
+	attributes attribute.Set
+	value      float64
+}
+
+// NewOtel returns the otel metrics. METRICS_OTEL_ENDPOINT is the collector URL, like http://otel-collector:4318,
+// the OTEL_EXPORTER_OTLP_ variables apply without it. METRICS_CONST_LABELS become resource attributes.
+// METRICS_OTEL_SUMMARY_BUCKETS are the buckets of summaries, DEFAULT_OTEL_SUMMARY_BUCKETS without it.
+func NewOtel(p Params) (*OtelMetric, error) {
+	s, err := loadSettings(p)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []otlpmetrichttp.Option{}
+	timeout := DEFAULT_OTEL_TIMEOUT
+	interval := DEFAULT_OTEL_INTERVAL
+	summaryBuckets := DEFAULT_OTEL_SUMMARY_BUCKETS
+	if p.Config != nil {
+		if val, err := p.Config.Get("METRICS_OTEL_ENDPOINT"); err == nil {
+			if endpoint, ok := val.(string); ok && endpoint != "" {
+				options = append(options, otlpmetrichttp.WithEndpointURL(endpoint))
+			}
+		}
+		if val, err := p.Config.Get("METRICS_OTEL_HEADERS"); err == nil {
+			headerMap, ok := toStringMap(val)
+			if !ok {
+				return nil, fmt.Errorf("METRICS_OTEL_HEADERS must be a map")
+			}
+			headers := map[string]string{}
+			for key, value := range headerMap {
+				headers[key] = fmt.Sprint(value)
+			}
+			options = append(options, otlpmetrichttp.WithHeaders(headers))
+		}
+		if val, err := p.Config.Get("METRICS_OTEL_SUMMARY_BUCKETS"); err == nil {
+			buckets, err := parseBuckets(val)
+			if err == nil && !sort.Float64sAreSorted(buckets) {
+				err = errors.New("buckets are out of order")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid METRICS_OTEL_SUMMARY_BUCKETS: %v", err)
+			}
+			summaryBuckets = buckets
+		}
+		timeout = getConfigInt(p.Config, "METRICS_OTEL_TIMEOUT", DEFAULT_OTEL_TIMEOUT)
+		interval = getConfigInt(p.Config, "METRICS_OTEL_INTERVAL", DEFAULT_OTEL_INTERVAL)
+	}
+	options = append(options, otlpmetrichttp.WithTimeout(time.Duration(timeout)*time.Second))
+
+	// the exporter connects on its first export, not here
+	exporter, err := otlpmetrichttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the otlp exporter: %v", err)
+	}
+
+	attributes := []attribute.KeyValue{attribute.String("service.name", p.ServiceName)}
+	for key, value := range s.constLabels {
+		attributes = append(attributes, attribute.String(key, value))
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attributes...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the otel resource: %v", err)
+	}
+
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter,
+			sdkmetric.WithInterval(time.Duration(interval)*time.Second))),
+	)
+
+	meter := provider.Meter(OTEL_METER_NAME)
+	overflowCounter, err := meter.Float64Counter(prometheus.BuildFQName(p.ServiceName, "", METRIC_CARDINALITY_OVERFLOW),
+		metric.WithDescription("Uses of a metric folded into "+OVERFLOW_VALUE+" by the cardinality limits"))
+	if err != nil {
+		provider.Shutdown(context.Background())
+		return nil, fmt.Errorf("failed to create the overflow counter: %v", err)
+	}
+	limits := newLimiter(s, func(key string) {
+		overflowCounter.Add(context.Background(), 1, metric.WithAttributes(attribute.String("metric", key)))
+	})
+
+	om := &OtelMetric{
+		service:        p.ServiceName,
+		provider:       provider,
+		meter:          meter,
+		strict:         s.strict,
+		summaryBuckets: summaryBuckets,
+		limits:         limits,
+		definitions:    map[string]Definition{},
+		sugar:          s.sugar,
+	}
+
+	if err := s.defineAll(om.Define); err != nil {
+		provider.Shutdown(context.Background())
+		return nil, err
+	}
+
+	// the last values are exported on stop
+	if p.Lifecycle != nil {
+		p.Lifecycle.Append(fx.Hook{
+			OnStop: om.Shutdown,
+		})
+	}
+
+	return om, nil
+}
+
+// Shutdown exports what's left and stops the exports
+func (om *OtelMetric) Shutdown(ctx context.Context) error {
+	return om.provider.Shutdown(ctx)
+}
+
+// Define sets how a metric is created. It has to come before the first use of the metric,
+// a definition with a Type is created right away.
+func (om *OtelMetric) Define(definition Definition) error {
+	if err := definition.validate(); err != nil {
+		return err
+	}
+
+	om.definitionsMutex.Lock()
+	om.definitions[definition.Name] = definition
+	om.definitionsMutex.Unlock()
+
+	if definition.Type == "" {
+		return nil
+	}
+	if _, err := om.instrument(definition.Type, definition.Name, nil); err != nil {
+		return fmt.Errorf("metric %s: %v", definition.Name, err)
+	}
+	return nil
+}
+
+func (om *OtelMetric) definition(key string, tags []string) (Definition, error) {
+	om.definitionsMutex.RLock()
+	definition, ok := om.definitions[key]
+	om.definitionsMutex.RUnlock()
+	return resolveDefinition(definition, ok, om.strict, key, tags)
+}
+
+// instrument returns the instrument of key with the given type, it's created on first use
+func (om *OtelMetric) instrument(metricType, key string, tags []string) (*otelInstrument, error) {
+	inst, ok := om.instruments.Load(key)
+	if !ok {
+		om.mutex.Lock()
+		if inst, ok = om.instruments.Load(key); !ok {
+			created, err := om.newInstrument(metricType, key, tags)
+			if err != nil {
+				om.mutex.Unlock()
+				return nil, err
+			}
+			om.instruments.Store(key, created)
+			inst = created
+		}
+		om.mutex.Unlock()
+	}
+
+	instrument := inst.(*otelInstrument)
+	if instrument.metricType != metricType {
+		return nil, fmt.Errorf("metric %s is already registered as another type", key)
+	}
+	return instrument, nil
+}
+
+func (om *OtelMetric) newInstrument(metricType, key string, tags []string) (*otelInstrument, error) {
+	definition, err := om.definition(key, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	name := prometheus.BuildFQName(om.service, "", definition.exposedName(key))
+	instrument := &otelInstrument{
+		metricType: metricType,
+		labels:     definition.Labels,
+		limit:      om.limits.newSeriesLimit(definition),
+	}
+
+	switch metricType {
+	case TYPE_HISTOGRAM, TYPE_SUMMARY:
+		// timings use the prometheus buckets, the otel defaults are meant for milliseconds,
+		// summaries the configured ones since otel has no quantiles
+		buckets := definition.Buckets
+		if buckets == nil {
+			buckets = prometheus.DefBuckets
+			if metricType == TYPE_SUMMARY {
+				buckets = om.summaryBuckets
+			}
+		}
+		instrument.histogram, err = om.meter.Float64Histogram(name,
+			metric.WithDescription(definition.Help),
+			metric.WithExplicitBucketBoundaries(buckets...))
+	case TYPE_COUNTER:
+		instrument.counter, err = om.meter.Float64Counter(name, metric.WithDescription(definition.Help))
+	case TYPE_GAUGE:
+		gauge := &otelGauge{series: map[attribute.Distinct]*gaugeSeries{}}
+		_, err = om.meter.Float64ObservableGauge(name,
+			metric.WithDescription(definition.Help),
+			metric.WithFloat64Callback(gauge.observe))
+		instrument.gauge = gauge
+	default:
+		return nil, fmt.Errorf("unknown metric type '%s'", metricType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return instrument, nil
+}
+
+// labels returns the instrument of key and the labels of tags, checked against the label keys of the metric
+func (om *OtelMetric) labels(metricType, key string, tags []string) (*otelInstrument, prometheus.Labels, error) {
+	if len(tags)%2 != 0 {
+		return nil, nil, fmt.Errorf("metric %s: tags must be a multiplier of 2", key)
+	}
+
+	instrument, err := om.instrument(metricType, key, tags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	labels, err := checkLabels(instrument.labels, tags)
+	if err != nil {
+		return nil, nil, fmt.Errorf("metric %s: %v", key, err)
+	}
+	return instrument, labels, nil
+}
+
+// use returns the instrument of key and the attributes of tags, folded by the cardinality limits
+func (om *OtelMetric) use(metricType, key string, tags []string) (*otelInstrument, attribute.Set, error) {
+	instrument, labels, err := om.labels(metricType, key, tags)
+	if err != nil {
+		return nil, attribute.Set{}, err
+	}
+	labels = om.limits.cardinality(key, instrument.limit, instrument.labels, labels)
+	return instrument, labelsToAttributes(labels), nil
+}
+
+func labelsToAttributes(labels prometheus.Labels) attribute.Set {
+	attributes := make([]attribute.KeyValue, 0, len(labels))
+	for key, value := range labels {
+		attributes = append(attributes, attribute.String(key, value))
+	}
+	return attribute.NewSet(attributes...)
+}
+
+// BumpTime starts a timer recorded into the histogram of key when it ends. The tags are checked against
+// the labels of the metric right away, tags EndWith adds are checked at the end and a failing end is logged.
+func (om *OtelMetric) BumpTime(key string, tags ...string) (Endable, error) {
+	return om.BumpTimeContext(context.Background(), key, tags...)
+}
+
+// BumpTimeContext is BumpTime recorded with ctx, the SDK takes its exemplars from the span in it
+func (om *OtelMetric) BumpTimeContext(ctx context.Context, key string, tags ...string) (Endable, error) {
+	if _, _, err := om.labels(TYPE_HISTOGRAM, key, tags); err != nil {
+		return nil, err
+	}
+
+	return newTimer(tags, func(duration time.Duration, tags []string) {
+		if err := om.ObserveContext(ctx, key, duration, tags...); err != nil {
+			om.sugar.Warnw("failed to observe timer", "metric", key, "err", err)
+		}
+	}), nil
+}
+
+func (om *OtelMetric) Observe(key string, duration time.Duration, tags ...string) error {
+	return om.ObserveContext(context.Background(), key, duration, tags...)
+}
+
+func (om *OtelMetric) ObserveContext(ctx context.Context, key string, duration time.Duration, tags ...string) error {
+	instrument, attributes, err := om.use(TYPE_HISTOGRAM, key, tags)
+	if err != nil {
+		return err
+	}
+	instrument.histogram.Record(ctx, duration.Seconds(), metric.WithAttributeSet(attributes))
+	return nil
+}
+
+func (om *OtelMetric) BumpCount(key string, val float64, tags ...string) error {
+	return om.BumpCountContext(context.Background(), key, val, tags...)
+}
+
+func (om *OtelMetric) BumpCountContext(ctx context.Context, key string, val float64, tags ...string) error {
+	instrument, attributes, err := om.use(TYPE_COUNTER, key, tags)
+	if err != nil {
+		return err
+	}
+	if val < 0 {
+		return fmt.Errorf("metric %s: counters can't decrease, got %v", key, val)
+	}
+	instrument.counter.Add(ctx, val, metric.WithAttributeSet(attributes))
+	return nil
+}
+
+func (om *OtelMetric) SetGauge(key string, val float64, tags ...string) error {
+	return om.updateGauge(key, tags, func(float64) float64 { return val })
+}
+
+func (om *OtelMetric) AddGauge(key string, val float64, tags ...string) error {
+	return om.updateGauge(key, tags, func(current float64) float64 { return current + val })
+}
+
+func (om *OtelMetric) SubGauge(key string, val float64, tags ...string) error {
+	return om.updateGauge(key, tags, func(current float64) float64 { return current - val })
+}
+
+func (om *OtelMetric) updateGauge(key string, tags []string, update func(current float64) float64) error {
+	instrument, attributes, err := om.use(TYPE_GAUGE, key, tags)
+	if err != nil {
+		return err
+	}
+
+	gauge := instrument.gauge
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+
+	series, ok := gauge.series[attributes.Equivalent()]
+	if !ok {
+		series = &gaugeSeries{attributes: attributes}
+		gauge.series[attributes.Equivalent()] = series
+	}
+	series.value = update(series.value)
+	return nil
+}
+
+func (g *otelGauge) observe(ctx context.Context, observer metric.Float64Observer) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, series := range g.series {
+		observer.Observe(series.value, metric.WithAttributeSet(series.attributes))
+	}
+	return nil
+}
+
+// RegisterGaugeFunc registers fn once per key and tags, the tags become attributes of the gauge.
+// A gauge func can't be folded into OVERFLOW_VALUE, one beyond the cardinality limits is an error.
+func (om *OtelMetric) RegisterGaugeFunc(key string, fn func() float64, tags ...string) error {
+	if len(tags)%2 != 0 {
+		return fmt.Errorf("metric %s: tags must be a multiplier of 2", key)
+	}
+
+	definition, err := om.definition(key, tags)
+	if err != nil {
+		return err
+	}
+	labels, err := checkLabels(definition.Labels, tags)
+	if err != nil {
+		return fmt.Errorf("metric %s: %v", key, err)
+	}
+
+	id := key + "\xff" + seriesId(definition.Labels, labels)
+	if _, loaded := om.gaugeFuncs.LoadOrStore(id, struct{}{}); loaded {
+		return fmt.Errorf("gauge func %s is already registered with these tags", key)
+	}
+	release, err := om.limits.admitGaugeFunc(key, definition, labels)
+	if err != nil {
+		om.gaugeFuncs.Delete(id)
+		return err
+	}
+
+	name := prometheus.BuildFQName(om.service, "", definition.exposedName(key))
+	gauge, err := om.meter.Float64ObservableGauge(name, metric.WithDescription(definition.Help))
+	if err != nil {
+		release()
+		om.gaugeFuncs.Delete(id)
+		return fmt.Errorf("metric %s: %v", key, err)
+	}
+
+	attributes := labelsToAttributes(labels)
+	_, err = om.meter.RegisterCallback(func(ctx context.Context, observer metric.Observer) error {
+		observer.ObserveFloat64(gauge, fn(), metric.WithAttributeSet(attributes))
+		return nil
+	}, gauge)
+	if err != nil {
+		release()
+		om.gaugeFuncs.Delete(id)
+		return fmt.Errorf("metric %s: %v", key, err)
+	}
+	return nil
+}
+
+// BumpSummary records val into a histogram, otel has no summary. Its buckets are the ones of the definition,
+// or METRICS_OTEL_SUMMARY_BUCKETS, DEFAULT_OTEL_SUMMARY_BUCKETS by default.
+func (om *OtelMetric) BumpSummary(key string, val float64, tags ...string) error {
+	instrument, attributes, err := om.use(TYPE_SUMMARY, key, tags)
+	if err != nil {
+		return err
+	}
+	instrument.histogram.Record(context.Background(), val, metric.WithAttributeSet(attributes))
+	return nil
+}
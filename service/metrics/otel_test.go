@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpReceiver is an OTLP/HTTP endpoint keeping the metrics exported to it
+type otlpReceiver struct {
+	t        *testing.T
+	mu       sync.Mutex
+	requests []*colmetricspb.ExportMetricsServiceRequest
+	headers  http.Header
+}
+
+func newOtlpReceiver(t *testing.T) (*otlpReceiver, string) {
+	receiver := &otlpReceiver{t: t}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	return receiver, server.URL + "/v1/metrics"
+}
+
+func (o *otlpReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(o.t, err)
+		body = gz
+	}
+	b, err := io.ReadAll(body)
+	require.NoError(o.t, err)
+	request := &colmetricspb.ExportMetricsServiceRequest{}
+	if r.URL.Path != "/v1/metrics" || proto.Unmarshal(b, request) != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	o.mu.Lock()
+	o.requests = append(o.requests, request)
+	o.headers = r.Header.Clone()
+	o.mu.Unlock()
+
+	response, _ := proto.Marshal(&colmetricspb.ExportMetricsServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(response)
+}
+
+// metrics returns the last exported metrics by name, and the attributes of the resource they came with
+func (o *otlpReceiver) metrics() (map[string]*metricspb.Metric, map[string]string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	metrics := map[string]*metricspb.Metric{}
+	resource := map[string]string{}
+	for _, request := range o.requests {
+		for _, resourceMetrics := range request.GetResourceMetrics() {
+			for name, value := range attributeMap(resourceMetrics.GetResource().GetAttributes()) {
+				resource[name] = value
+			}
+			for _, scopeMetrics := range resourceMetrics.GetScopeMetrics() {
+				for _, m := range scopeMetrics.GetMetrics() {
+					metrics[m.GetName()] = m
+				}
+			}
+		}
+	}
+	return metrics, resource
+}
+
+func attributeMap(attributes []*commonpb.KeyValue) map[string]string {
+	values := map[string]string{}
+	for _, attribute := range attributes {
+		values[attribute.GetKey()] = attribute.GetValue().GetStringValue()
+	}
+	return values
+}
+
+// attributeKey is the attributes of a data point as name=value, sorted and joined by commas
+func attributeKey(attributes []*commonpb.KeyValue) string {
+	pairs := []string{}
+	for name, value := range attributeMap(attributes) {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// points returns the values of the data points of m by attributeKey, the count of a histogram
+func points(m *metricspb.Metric) map[string]float64 {
+	values := map[string]float64{}
+	if m == nil {
+		return values
+	}
+	for _, point := range m.GetSum().GetDataPoints() {
+		values[attributeKey(point.GetAttributes())] = point.GetAsDouble()
+	}
+	for _, point := range m.GetGauge().GetDataPoints() {
+		values[attributeKey(point.GetAttributes())] = point.GetAsDouble()
+	}
+	for _, point := range m.GetHistogram().GetDataPoints() {
+		values[attributeKey(point.GetAttributes())] = float64(point.GetCount())
+	}
+	return values
+}
+
+// newTestOtel returns the otel metrics of svc exporting to url, only on shutdown
+func newTestOtel(t *testing.T, url string, values map[string]interface{}, definitions ...Definition) *OtelMetric {
+	values["METRICS_OTEL_ENDPOINT"] = url
+	values["METRICS_OTEL_INTERVAL"] = int(time.Hour / time.Second)
+	om, err := NewOtel(Params{ServiceName: "svc", Config: newTestConfig(t, values), Definitions: definitions})
+	require.NoError(t, err)
+	return om
+}
+
+func TestOtelExportsOverOTLP(t *testing.T) {
+	receiver, url := newOtlpReceiver(t)
+	om := newTestOtel(t, url, map[string]interface{}{
+		"METRICS_CONST_LABELS": map[string]interface{}{"cluster": "tw-1"},
+		"METRICS_OTEL_HEADERS": map[string]interface{}{"X-Scope-OrgID": "team-a"},
+	}, Definition{Name: "latency", Unit: "seconds", Labels: []string{"route"}})
+
+	require.NoError(t, om.BumpCount("requests", 2, "code", "200"))
+	require.NoError(t, om.BumpCount("requests", 1, "code", "200"))
+	require.NoError(t, om.SetGauge("temperature", 3))
+	require.NoError(t, om.SubGauge("temperature", 1))
+	require.NoError(t, om.RegisterGaugeFunc("balance", func() float64 { return 1.5 }, "currency", "twd"))
+	require.NoError(t, om.Observe("latency", 20*time.Millisecond, "route", "/a"))
+	timer, err := om.BumpTime("latency", "route", "unknown")
+	require.NoError(t, err)
+	EndWith(timer, "route", "/b")
+	require.NoError(t, om.BumpSummary("size", 300))
+	assert.Error(t, om.BumpCount("requests", -1, "code", "200"), "counters can't decrease")
+	require.NoError(t, om.Shutdown(context.Background()))
+
+	metrics, resource := receiver.metrics()
+	assert.Equal(t, "svc", resource["service.name"])
+	assert.Equal(t, "tw-1", resource["cluster"], "constant labels are resource attributes")
+	assert.Equal(t, "team-a", receiver.headers.Get("X-Scope-OrgID"))
+
+	assert.Equal(t, map[string]float64{"code=200": 3}, points(metrics["svc_requests"]))
+	assert.True(t, metrics["svc_requests"].GetSum().GetIsMonotonic())
+	assert.Equal(t, map[string]float64{"": 2}, points(metrics["svc_temperature"]))
+	assert.Equal(t, map[string]float64{"currency=twd": 1.5}, points(metrics["svc_balance"]))
+	assert.Equal(t, map[string]float64{"route=/a": 1, "route=/b": 1}, points(metrics["svc_latency_seconds"]))
+
+	latency := metrics["svc_latency_seconds"].GetHistogram().GetDataPoints()[0]
+	assert.Equal(t, prometheus.DefBuckets, latency.GetExplicitBounds(), "timings use the prometheus buckets")
+	size := metrics["svc_size"].GetHistogram().GetDataPoints()[0]
+	assert.Equal(t, DEFAULT_OTEL_SUMMARY_BUCKETS, size.GetExplicitBounds(), "summaries are histograms")
+	assert.Equal(t, 300.0, size.GetSum())
+}
+
+func TestOtelSummaryBuckets(t *testing.T) {
+	receiver, url := newOtlpReceiver(t)
+	om := newTestOtel(t, url, map[string]interface{}{
+		"METRICS_OTEL_SUMMARY_BUCKETS": map[string]interface{}{"linear": map[string]interface{}{"start": 1, "width": 1, "count": 3}},
+	}, Definition{Name: "batch", Buckets: []float64{10, 100}})
+
+	require.NoError(t, om.BumpSummary("size", 2))
+	require.NoError(t, om.BumpSummary("batch", 50))
+	require.NoError(t, om.Shutdown(context.Background()))
+
+	metrics, _ := receiver.metrics()
+	assert.Equal(t, []float64{1, 2, 3}, metrics["svc_size"].GetHistogram().GetDataPoints()[0].GetExplicitBounds())
+	assert.Equal(t, []float64{10, 100}, metrics["svc_batch"].GetHistogram().GetDataPoints()[0].GetExplicitBounds(),
+		"the buckets of a definition come first")
+
+	for _, buckets := range []interface{}{"many", []interface{}{3, 1}} {
+		_, err := NewOtel(Params{ServiceName: "svc", Config: newTestConfig(t, map[string]interface{}{
+			"METRICS_OTEL_SUMMARY_BUCKETS": buckets,
+		})})
+		assert.ErrorContains(t, err, "invalid METRICS_OTEL_SUMMARY_BUCKETS")
+	}
+}
+
+func TestOtelCardinalityLimits(t *testing.T) {
+	receiver, url := newOtlpReceiver(t)
+	om := newTestOtel(t, url, map[string]interface{}{"METRICS_MAX_SERIES": 4},
+		Definition{Name: "requests", Labels: []string{"code"}, MaxSeries: 2},
+		Definition{Name: "calls", Labels: []string{"command"}, AllowedValues: map[string][]string{"command": {"get"}}},
+	)
+
+	for _, code := range []string{"200", "404", "500", "200"} {
+		require.NoError(t, om.BumpCount("requests", 1, "code", code))
+	}
+	require.NoError(t, om.BumpCount("calls", 1, "command", "get"))
+	require.NoError(t, om.BumpCount("calls", 1, "command", "flushall"))
+	// the service reached its 4 series
+	require.NoError(t, om.SetGauge("temperature", 1, "room", "a"))
+	assert.ErrorContains(t, om.RegisterGaugeFunc("balance", func() float64 { return 1 }), "reached the series limit")
+	require.NoError(t, om.Shutdown(context.Background()))
+
+	metrics, _ := receiver.metrics()
+	assert.Equal(t, map[string]float64{"code=200": 2, "code=404": 1, "code=__overflow__": 1}, points(metrics["svc_requests"]))
+	assert.Equal(t, map[string]float64{"command=get": 1, "command=__overflow__": 1}, points(metrics["svc_calls"]))
+	assert.Equal(t, map[string]float64{"room=__overflow__": 1}, points(metrics["svc_temperature"]))
+	assert.Equal(t, map[string]float64{
+		"metric=requests":    1,
+		"metric=calls":       1,
+		"metric=temperature": 1,
+		"metric=balance":     1,
+	}, points(metrics["svc_metrics_cardinality_overflow_total"]))
+}
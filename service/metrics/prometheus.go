@@ -1,53 +1,378 @@
 package metrics
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/smallhouse123/go-library/service/config"
 	"go.uber.org/fx"
+	"go.uber.org/zap"
 )
 
 var (
 	Service = fx.Provide(New)
+
+	// RegistryService gives the metrics service a registry of its own instead of the global default one
+	RegistryService = fx.Provide(NewRegistry)
+
+	// DEFAULT_SUMMARY_OBJECTIVES are the quantiles of a summary and their allowed errors
+	DEFAULT_SUMMARY_OBJECTIVES = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
 )
 
 type Params struct {
 	fx.In
 
-	ServiceName string `name:"serviceName"`
+	ServiceName string        `name:"serviceName"`
+	Config      config.Config `optional:"true"`
+	Definitions []Definition  `group:"metricDefinitions"`
+	// Registerer and Gatherer default to the global prometheus registry
+	Registerer prometheus.Registerer `optional:"true"`
+	Gatherer   prometheus.Gatherer   `optional:"true"`
+	Logger     *zap.Logger           `optional:"true"`
+	// Lifecycle flushes the otel backend on stop
+	Lifecycle fx.Lifecycle `optional:"true"`
+}
+
+type RegistryResult struct {
+	fx.Out
+
+	Registerer prometheus.Registerer
+	Gatherer   prometheus.Gatherer
+}
+
+// NewRegistry returns a new registry with the Go runtime and process collectors the global one has as well
+func NewRegistry() RegistryResult {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return RegistryResult{
+		Registerer: registry,
+		Gatherer:   registry,
+	}
 }
 
 type PromMetric struct {
 	service            string
 	histogramCollector sync.Map
 	counterCollector   sync.Map
+	gaugeCollector     sync.Map
+	summaryCollector   sync.Map
+	gaugeFuncCollector sync.Map
+	registerer         prometheus.Registerer
+	gatherer           prometheus.Gatherer
+	summaryObjectives  map[float64]float64
+	strict             bool
+	limits             *limiter
+	overflowCounter    *prometheus.CounterVec
+	sugar              *zap.SugaredLogger
+	definitions        map[string]Definition
+	definitionsMutex   sync.RWMutex
 	mutex              sync.Mutex
 }
 
-func New(p Params) Metrics {
-	return &PromMetric{
+// promVec is a registered metric with the label keys every use of it has to give
+type promVec struct {
+	collector prometheus.Collector
+	labels    []string
+	limit     *seriesLimit
+}
+
+// settings are the config shared by the backends
+type settings struct {
+	strict             bool
+	constLabels        prometheus.Labels
+	summaryObjectives  map[float64]float64
+	maxSeries          int
+	maxSeriesPerMetric int
+	definitions        []Definition
+	sugar              *zap.SugaredLogger
+}
+
+// loadSettings reads the config of the metrics. With METRICS_STRICT a broken setting is an error,
+// otherwise it's reported and skipped.
+func loadSettings(p Params) (settings, error) {
+	s := settings{
+		maxSeries:          DEFAULT_MAX_SERIES,
+		maxSeriesPerMetric: DEFAULT_MAX_SERIES_PER_METRIC,
+		summaryObjectives:  DEFAULT_SUMMARY_OBJECTIVES,
+		definitions:        p.Definitions,
+		sugar:              newMetricsLogger(p.Logger),
+	}
+	if p.Config == nil {
+		return s, nil
+	}
+
+	if val, err := p.Config.Get("METRICS_STRICT"); err == nil {
+		s.strict, _ = val.(bool)
+	}
+	// limits on the label combinations, 0 turns a limit off
+	if val, err := p.Config.Get("METRICS_MAX_SERIES"); err == nil {
+		if valInt, ok := val.(int); ok {
+			s.maxSeries = valInt
+		}
+	}
+	if val, err := p.Config.Get("METRICS_MAX_SERIES_PER_METRIC"); err == nil {
+		if valInt, ok := val.(int); ok {
+			s.maxSeriesPerMetric = valInt
+		}
+	}
+	// in strict mode a broken setting fails the start, otherwise it's reported and skipped
+	report := func(msg string, err error) error {
+		if s.strict {
+			return fmt.Errorf("%s: %v", msg, err)
+		}
+		s.sugar.Warnw(msg, "err", err)
+		return nil
+	}
+
+	// constant labels are added to every metric of this service, e.g. {cluster: tw-1}
+	if val, err := p.Config.Get("METRICS_CONST_LABELS"); err == nil {
+		constLabels, err := parseConstLabels(val)
+		if err != nil {
+			if err := report("invalid METRICS_CONST_LABELS, ignoring them", err); err != nil {
+				return s, err
+			}
+		} else {
+			s.constLabels = constLabels
+		}
+	}
+	if val, err := p.Config.Get("METRICS_SUMMARY_OBJECTIVES"); err == nil {
+		objectives, err := parseObjectives(val)
+		if err != nil {
+			if err := report("invalid METRICS_SUMMARY_OBJECTIVES, using the defaults", err); err != nil {
+				return s, err
+			}
+		} else {
+			s.summaryObjectives = objectives
+		}
+	}
+	// definitions from config come last, so they can tune the ones made in code
+	if val, err := p.Config.Get("METRICS_DEFINITIONS"); err == nil {
+		configDefinitions, err := ParseDefinitions(val)
+		if err != nil {
+			if err := report("invalid METRICS_DEFINITIONS, ignoring them", err); err != nil {
+				return s, err
+			}
+		} else {
+			s.definitions = append(s.definitions, configDefinitions...)
+		}
+	}
+	return s, nil
+}
+
+// defineAll passes the definitions to define, a later definition of a name replaces an earlier one
+func (s settings) defineAll(define func(Definition) error) error {
+	defined := map[string]Definition{}
+	for _, definition := range s.definitions {
+		if previous, ok := defined[definition.Name]; ok && previous.Labels != nil && definition.Labels != nil &&
+			!sameLabels(previous.Labels, definition.Labels) {
+			err := fmt.Errorf("metric %s is defined with labels %v and %v", definition.Name, previous.Labels, definition.Labels)
+			if s.strict {
+				return err
+			}
+			s.sugar.Warnw("conflicting metric definitions, using the last one", "err", err)
+		}
+		defined[definition.Name] = definition
+
+		if err := define(definition); err != nil {
+			if s.strict {
+				return err
+			}
+			s.sugar.Warnw("failed to define metric", "err", err)
+		}
+	}
+	return nil
+}
+
+// NewProm returns the prometheus metrics. With METRICS_STRICT every metric has to be defined,
+// and invalid or conflicting definitions fail the start instead of being skipped.
+// METRICS_MAX_SERIES and METRICS_MAX_SERIES_PER_METRIC limit the label combinations.
+func NewProm(p Params) (*PromMetric, error) {
+	registerer := p.Registerer
+	gatherer := p.Gatherer
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+		if gatherer == nil {
+			gatherer = prometheus.DefaultGatherer
+		}
+	}
+	if gatherer == nil {
+		if registry, ok := registerer.(prometheus.Gatherer); ok {
+			gatherer = registry
+		} else {
+			gatherer = prometheus.Gatherers{}
+		}
+	}
+
+	s, err := loadSettings(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.constLabels) > 0 {
+		registerer = prometheus.WrapRegistererWith(s.constLabels, registerer)
+	}
+
+	overflowCounter, err := newOverflowCounter(registerer, p.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+
+	limits := newLimiter(s, func(key string) {
+		overflowCounter.WithLabelValues(key).Inc()
+	})
+
+	pm := &PromMetric{
 		service:            p.ServiceName,
 		histogramCollector: sync.Map{},
+		registerer:         registerer,
+		gatherer:           gatherer,
+		summaryObjectives:  s.summaryObjectives,
+		strict:             s.strict,
+		limits:             limits,
+		overflowCounter:    overflowCounter,
+		sugar:              s.sugar,
+		definitions:        map[string]Definition{},
 		mutex:              sync.Mutex{},
 	}
+
+	if err := s.defineAll(pm.Define); err != nil {
+		return nil, err
+	}
+	return pm, nil
 }
 
-func (p *PromMetric) BumpTime(key string, tags ...string) (Endable, error) {
-	if len(tags)%2 != 0 {
-		return nil, errors.New("tags must be a multiplier of 2")
+// Gatherer returns the registry the metrics of this service are collected from
+func (p *PromMetric) Gatherer() prometheus.Gatherer {
+	return p.gatherer
+}
+
+// Registerer returns the registry the metrics of this service are registered to, with their constant labels
+func (p *PromMetric) Registerer() prometheus.Registerer {
+	return p.registerer
+}
+
+// Define sets how a metric is created. It has to come before the first use of the metric,
+// a definition with a Type is registered right away.
+func (p *PromMetric) Define(definition Definition) error {
+	if err := definition.validate(); err != nil {
+		return err
 	}
 
-	id := p.service + key
+	p.definitionsMutex.Lock()
+	p.definitions[definition.Name] = definition
+	p.definitionsMutex.Unlock()
+
+	if definition.Type == "" {
+		return nil
+	}
+	if _, err := p.vec(definition.Type, definition.Name, nil); err != nil {
+		return fmt.Errorf("metric %s: %v", definition.Name, err)
+	}
+	return nil
+}
+
+// definition returns the definition of key, labels are taken from tags when it doesn't declare them
+func (p *PromMetric) definition(key string, tags []string) (Definition, error) {
+	p.definitionsMutex.RLock()
+	definition, ok := p.definitions[key]
+	p.definitionsMutex.RUnlock()
+	return resolveDefinition(definition, ok, p.strict, key, tags)
+}
+
+// resolveDefinition completes the definition of key, found or not, for a use with tags
+func resolveDefinition(definition Definition, found bool, strict bool, key string, tags []string) (Definition, error) {
+	if !found {
+		if strict {
+			return Definition{}, fmt.Errorf("metric %s is not defined, METRICS_STRICT requires a definition", key)
+		}
+		definition = Definition{Name: key}
+	}
+	if definition.Labels == nil {
+		definition.Labels, _ = tagsToKeyAndVals(tags)
+		if err := validateLabelNames(definition.Labels); err != nil {
+			return Definition{}, fmt.Errorf("metric %s: %v", key, err)
+		}
+	}
+	return definition, nil
+}
 
+func parseConstLabels(val interface{}) (prometheus.Labels, error) {
+	labelMap, ok := toStringMap(val)
+	if !ok {
+		return nil, errors.New("constant labels must be a map")
+	}
+	constLabels := prometheus.Labels{}
+	for key, value := range labelMap {
+		if err := validateLabelName(key); err != nil {
+			return nil, err
+		}
+		constLabels[key] = fmt.Sprint(value)
+	}
+	return constLabels, nil
+}
+
+// parseObjectives reads a map of quantile to allowed error, such as {"0.5": 0.05, "0.99": 0.001}
+func parseObjectives(val interface{}) (map[float64]float64, error) {
+	objectives := map[float64]float64{}
+	add := func(quantile, allowedError interface{}) error {
+		q, ok := toFloat(quantile)
+		if !ok || q <= 0 || q >= 1 {
+			return fmt.Errorf("invalid quantile %v", quantile)
+		}
+		e, ok := toFloat(allowedError)
+		if !ok || e < 0 || e >= 1 {
+			return fmt.Errorf("invalid error %v for quantile %v", allowedError, quantile)
+		}
+		objectives[q] = e
+		return nil
+	}
+
+	switch valTyped := val.(type) {
+	case map[string]interface{}:
+		for quantile, allowedError := range valTyped {
+			if err := add(quantile, allowedError); err != nil {
+				return nil, err
+			}
+		}
+	case map[interface{}]interface{}:
+		for quantile, allowedError := range valTyped {
+			if err := add(quantile, allowedError); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errors.New("objectives must be a map of quantile to error")
+	}
+	return objectives, nil
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	switch valTyped := val.(type) {
+	case float64:
+		return valTyped, true
+	case int:
+		return float64(valTyped), true
+	case string:
+		f, err := strconv.ParseFloat(valTyped, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// loadOrRegister returns the metric stored under id, it's created and registered by create on first use
+func (p *PromMetric) loadOrRegister(collectors *sync.Map, id string, create func() (*promVec, error)) (*promVec, error) {
 	// First check without a lock
-	if collector, ok := p.histogramCollector.Load(id); ok {
-		duration := collector.(*prometheus.HistogramVec)
-		labels := tagsToLabels(tags)
-		timer := prometheus.NewTimer(duration.With(labels))
-		return &promTimer{
-			timer: timer,
-		}, nil
+	if vec, ok := collectors.Load(id); ok {
+		return vec.(*promVec), nil
 	}
 
 	// Lock to handle concurrent registrations
@@ -55,37 +380,181 @@ func (p *PromMetric) BumpTime(key string, tags ...string) (Endable, error) {
 	defer p.mutex.Unlock()
 
 	// Double-check after acquiring the lock
-	if collector, ok := p.histogramCollector.Load(id); ok {
-		duration := collector.(*prometheus.HistogramVec)
-		labels := tagsToLabels(tags)
-		timer := prometheus.NewTimer(duration.With(labels))
-		return &promTimer{
-			timer: timer,
+	if vec, ok := collectors.Load(id); ok {
+		return vec.(*promVec), nil
+	}
+
+	// Create and register the new metric, one registered by another instance
+	// sharing the registry is used instead
+	vec, err := create()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.registerer.Register(vec.collector); err != nil {
+		are := prometheus.AlreadyRegisteredError{}
+		if !errors.As(err, &are) {
+			return nil, err
+		}
+		vec.collector = are.ExistingCollector
+	}
+
+	// Store the metric in the map
+	collectors.Store(id, vec)
+	return vec, nil
+}
+
+// vec returns the metric of key with the given type, it's created with the labels of its definition or tags
+func (p *PromMetric) vec(metricType, key string, tags []string) (*promVec, error) {
+	var collectors *sync.Map
+	switch metricType {
+	case TYPE_HISTOGRAM:
+		collectors = &p.histogramCollector
+	case TYPE_COUNTER:
+		collectors = &p.counterCollector
+	case TYPE_GAUGE:
+		collectors = &p.gaugeCollector
+	case TYPE_SUMMARY:
+		collectors = &p.summaryCollector
+	default:
+		return nil, fmt.Errorf("unknown metric type '%s'", metricType)
+	}
+
+	vec, err := p.loadOrRegister(collectors, p.service+key, func() (*promVec, error) {
+		definition, err := p.definition(key, tags)
+		if err != nil {
+			return nil, err
+		}
+		return &promVec{
+			collector: p.newCollector(metricType, key, definition),
+			labels:    definition.Labels,
+			limit:     p.limits.newSeriesLimit(definition),
 		}, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// Create and register the new metric
-	promOpts := prometheus.HistogramOpts{
-		Namespace: p.service,
-		Name:      key,
+	ok := false
+	switch vec.collector.(type) {
+	case *prometheus.HistogramVec:
+		ok = metricType == TYPE_HISTOGRAM
+	case *prometheus.CounterVec:
+		ok = metricType == TYPE_COUNTER
+	case *prometheus.GaugeVec:
+		ok = metricType == TYPE_GAUGE
+	case *prometheus.SummaryVec:
+		ok = metricType == TYPE_SUMMARY
 	}
+	if !ok {
+		return nil, fmt.Errorf("metric %s is already registered as another type", key)
+	}
+	return vec, nil
+}
+
+func (p *PromMetric) newCollector(metricType, key string, definition Definition) prometheus.Collector {
+	name := definition.exposedName(key)
+	switch metricType {
+	case TYPE_HISTOGRAM:
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: p.service,
+			Name:      name,
+			Help:      definition.Help,
+			Buckets:   definition.Buckets,
+		}, definition.Labels)
+	case TYPE_COUNTER:
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: p.service,
+			Name:      name,
+			Help:      definition.Help,
+		}, definition.Labels)
+	case TYPE_GAUGE:
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: p.service,
+			Name:      name,
+			Help:      definition.Help,
+		}, definition.Labels)
+	default:
+		objectives := definition.Objectives
+		if objectives == nil {
+			objectives = p.summaryObjectives
+		}
+		return prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace:  p.service,
+			Name:       name,
+			Help:       definition.Help,
+			Objectives: objectives,
+		}, definition.Labels)
+	}
+}
 
-	keyArr, _ := tagsToKeyAndVals(tags)
-	labels := tagsToLabels(tags)
+// labels returns the metric of key and the labels of tags, checked against the label keys of the metric
+func (p *PromMetric) labels(metricType, key string, tags []string) (*promVec, prometheus.Labels, error) {
+	if len(tags)%2 != 0 {
+		return nil, nil, fmt.Errorf("metric %s: tags must be a multiplier of 2", key)
+	}
+
+	vec, err := p.vec(metricType, key, tags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	labels, err := checkLabels(vec.labels, tags)
+	if err != nil {
+		return nil, nil, fmt.Errorf("metric %s: %v", key, err)
+	}
+	return vec, labels, nil
+}
+
+// use returns the metric of key and the labels of tags, folded by the cardinality limits
+func (p *PromMetric) use(metricType, key string, tags []string) (*promVec, prometheus.Labels, error) {
+	vec, labels, err := p.labels(metricType, key, tags)
+	if err != nil {
+		return nil, nil, err
+	}
+	return vec, p.limits.cardinality(key, vec.limit, vec.labels, labels), nil
+}
 
-	duration := prometheus.NewHistogramVec(promOpts, keyArr)
-	if err := prometheus.Register(duration); err != nil {
+// BumpTime starts a timer observed into the histogram of key when it ends. The tags are checked against
+// the labels of the metric right away, tags EndWith adds are checked at the end and a failing end is logged.
+func (p *PromMetric) BumpTime(key string, tags ...string) (Endable, error) {
+	return p.BumpTimeContext(context.Background(), key, tags...)
+}
+
+// BumpTimeContext is BumpTime with the trace of ctx attached to the observation as an exemplar
+func (p *PromMetric) BumpTimeContext(ctx context.Context, key string, tags ...string) (Endable, error) {
+	if _, _, err := p.labels(TYPE_HISTOGRAM, key, tags); err != nil {
 		return nil, err
 	}
 
-	// Store the metric in the map
-	p.histogramCollector.Store(id, duration)
+	return newTimer(tags, func(duration time.Duration, tags []string) {
+		if err := p.ObserveContext(ctx, key, duration, tags...); err != nil {
+			p.sugar.Warnw("failed to observe timer", "metric", key, "err", err)
+		}
+	}), nil
+}
+
+func (p *PromMetric) Observe(key string, duration time.Duration, tags ...string) error {
+	return p.ObserveContext(context.Background(), key, duration, tags...)
+}
+
+func (p *PromMetric) ObserveContext(ctx context.Context, key string, duration time.Duration, tags ...string) error {
+	vec, labels, err := p.use(TYPE_HISTOGRAM, key, tags)
+	if err != nil {
+		return err
+	}
 
-	// Start the timer
-	timer := prometheus.NewTimer(duration.With(labels))
-	return &promTimer{
-		timer: timer,
-	}, nil
+	observer, err := vec.collector.(*prometheus.HistogramVec).GetMetricWith(labels)
+	if err != nil {
+		return fmt.Errorf("metric %s: %v", key, err)
+	}
+	if exemplar := exemplarLabels(ctx); exemplar != nil {
+		if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok {
+			exemplarObserver.ObserveWithExemplar(duration.Seconds(), exemplar)
+			return nil
+		}
+	}
+	observer.Observe(duration.Seconds())
+	return nil
 }
 
 func tagsToKeyAndVals(tags []string) ([]string, []string) {
@@ -121,60 +590,131 @@ func tagsToLabels(tags []string) prometheus.Labels {
 	return newLabels
 }
 
-type promTimer struct {
-	timer *prometheus.Timer
+func (p *PromMetric) BumpCount(key string, val float64, tags ...string) error {
+	return p.BumpCountContext(context.Background(), key, val, tags...)
+}
+
+// BumpCountContext is BumpCount with the trace of ctx attached to the increment as an exemplar
+func (p *PromMetric) BumpCountContext(ctx context.Context, key string, val float64, tags ...string) error {
+	vec, labels, err := p.use(TYPE_COUNTER, key, tags)
+	if err != nil {
+		return err
+	}
+
+	counter, err := vec.collector.(*prometheus.CounterVec).GetMetricWith(labels)
+	if err != nil {
+		return fmt.Errorf("metric %s: %v", key, err)
+	}
+
+	// Increment the counter with the given value, a negative one is an error rather than a panic
+	if val < 0 {
+		return fmt.Errorf("metric %s: counters can't decrease, got %v", key, val)
+	}
+	if exemplar := exemplarLabels(ctx); exemplar != nil {
+		if exemplarAdder, ok := counter.(prometheus.ExemplarAdder); ok {
+			exemplarAdder.AddWithExemplar(val, exemplar)
+			return nil
+		}
+	}
+	counter.Add(val)
+	return nil
+}
+
+func (p *PromMetric) gauge(key string, tags []string) (prometheus.Gauge, error) {
+	vec, labels, err := p.use(TYPE_GAUGE, key, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	gauge, err := vec.collector.(*prometheus.GaugeVec).GetMetricWith(labels)
+	if err != nil {
+		return nil, fmt.Errorf("metric %s: %v", key, err)
+	}
+	return gauge, nil
 }
 
-func (p *promTimer) End() {
-	p.timer.ObserveDuration()
+func (p *PromMetric) SetGauge(key string, val float64, tags ...string) error {
+	gauge, err := p.gauge(key, tags)
+	if err != nil {
+		return err
+	}
+	gauge.Set(val)
+	return nil
 }
 
-func (p *PromMetric) BumpCount(key string, val float64, tags ...string) error {
-	if len(tags)%2 != 0 {
-		return errors.New("tags must be a multiplier of 2")
+func (p *PromMetric) AddGauge(key string, val float64, tags ...string) error {
+	gauge, err := p.gauge(key, tags)
+	if err != nil {
+		return err
 	}
+	gauge.Add(val)
+	return nil
+}
 
-	id := p.service + key
+func (p *PromMetric) SubGauge(key string, val float64, tags ...string) error {
+	gauge, err := p.gauge(key, tags)
+	if err != nil {
+		return err
+	}
+	gauge.Sub(val)
+	return nil
+}
 
-	// First check without a lock
-	if collector, ok := p.counterCollector.Load(id); ok {
-		counter := collector.(*prometheus.CounterVec)
-		labels := tagsToLabels(tags)
-		counter.With(labels).Add(val)
-		return nil
+// RegisterGaugeFunc registers fn once per key and tags, the tags become constant labels of the gauge.
+// A gauge func can't be folded into OVERFLOW_VALUE, one beyond the cardinality limits is an error.
+func (p *PromMetric) RegisterGaugeFunc(key string, fn func() float64, tags ...string) error {
+	if len(tags)%2 != 0 {
+		return fmt.Errorf("metric %s: tags must be a multiplier of 2", key)
 	}
 
-	// Lock to handle concurrent registrations
+	definition, err := p.definition(key, tags)
+	if err != nil {
+		return err
+	}
+	labels, err := checkLabels(definition.Labels, tags)
+	if err != nil {
+		return fmt.Errorf("metric %s: %v", key, err)
+	}
+
+	id := p.service + key + "\xff" + seriesId(definition.Labels, labels)
+
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	// Double-check after acquiring the lock
-	if collector, ok := p.counterCollector.Load(id); ok {
-		counter := collector.(*prometheus.CounterVec)
-		labels := tagsToLabels(tags)
-		counter.With(labels).Add(val)
-		return nil
+	if _, ok := p.gaugeFuncCollector.Load(id); ok {
+		return fmt.Errorf("gauge func %s is already registered with tags %v", key, tags)
+	}
+	release, err := p.limits.admitGaugeFunc(key, definition, labels)
+	if err != nil {
+		return err
 	}
 
-	// Create and register the new metric
-	promOpts := prometheus.CounterOpts{
-		Namespace: p.service,
-		Name:      key,
+	// unlike the other metrics, a gauge func registered elsewhere can't be reused, it reads another value
+	gaugeFunc := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   p.service,
+		Name:        definition.exposedName(key),
+		Help:        definition.Help,
+		ConstLabels: labels,
+	}, fn)
+	if err := p.registerer.Register(gaugeFunc); err != nil {
+		release()
+		return fmt.Errorf("metric %s: %v", key, err)
 	}
 
-	keyArr, _ := tagsToKeyAndVals(tags)
+	p.gaugeFuncCollector.Store(id, gaugeFunc)
+	return nil
+}
 
-	counter := prometheus.NewCounterVec(promOpts, keyArr)
-	if err := prometheus.Register(counter); err != nil {
+func (p *PromMetric) BumpSummary(key string, val float64, tags ...string) error {
+	vec, labels, err := p.use(TYPE_SUMMARY, key, tags)
+	if err != nil {
 		return err
 	}
 
-	// Store the metric in the map
-	p.counterCollector.Store(id, counter)
-
-	// Increment the counter with the given value
-	labels := tagsToLabels(tags)
-	counter.With(labels).Add(val)
-
+	summary, err := vec.collector.(*prometheus.SummaryVec).GetMetricWith(labels)
+	if err != nil {
+		return fmt.Errorf("metric %s: %v", key, err)
+	}
+	summary.Observe(val)
 	return nil
 }
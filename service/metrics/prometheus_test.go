@@ -0,0 +1,270 @@
+package metrics
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestProm returns the prometheus metrics of svc registered to a registry of their own
+func newTestProm(t *testing.T, values map[string]interface{}, definitions ...Definition) (*PromMetric, *prometheus.Registry) {
+	registry := prometheus.NewRegistry()
+	pm, err := NewProm(Params{
+		ServiceName: "svc",
+		Config:      newTestConfig(t, values),
+		Definitions: definitions,
+		Registerer:  registry,
+	})
+	require.NoError(t, err)
+	return pm, registry
+}
+
+func TestPromUsesInjectedRegistry(t *testing.T) {
+	pm, registry := newTestProm(t, map[string]interface{}{
+		"METRICS_CONST_LABELS": map[string]interface{}{"cluster": "tw-1"},
+	})
+	assert.Same(t, registry, pm.Gatherer(), "the registerer is gathered when no gatherer is given")
+
+	require.NoError(t, pm.BumpCount("requests", 2, "code", "200"))
+	require.NoError(t, testutil.GatherAndCompare(pm.Gatherer(), strings.NewReader(`
+# HELP svc_requests
+# TYPE svc_requests counter
+svc_requests{cluster="tw-1",code="200"} 2
+`), "svc_requests"))
+
+	count, err := testutil.GatherAndCount(prometheus.DefaultGatherer, "svc_requests")
+	require.NoError(t, err)
+	assert.Zero(t, count, "nothing goes to the global registry")
+}
+
+func TestPromKeepsGivenGatherer(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gatherer := prometheus.Gatherers{registry}
+	pm, err := NewProm(Params{ServiceName: "svc", Registerer: registry, Gatherer: gatherer})
+	require.NoError(t, err)
+	assert.Equal(t, gatherer, pm.Gatherer())
+	assert.Same(t, registry, pm.Registerer())
+}
+
+func TestPromReusesRegisteredCollectors(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	first, err := NewProm(Params{ServiceName: "svc", Registerer: registry})
+	require.NoError(t, err)
+	// the overflow counter is already registered by first, and so are the metrics once first uses them
+	second, err := NewProm(Params{ServiceName: "svc", Registerer: registry})
+	require.NoError(t, err)
+
+	require.NoError(t, first.BumpCount("requests", 1, "code", "200"))
+	require.NoError(t, second.BumpCount("requests", 2, "code", "200"))
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP svc_requests
+# TYPE svc_requests counter
+svc_requests{code="200"} 3
+`), "svc_requests"))
+
+	// a collector of another type under the same name isn't reused
+	registry.MustRegister(prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: "svc", Name: "jobs"}, []string{"queue"}))
+	assert.ErrorContains(t, first.BumpCount("jobs", 1, "queue", "q"), "already registered as another type")
+}
+
+func TestPromStrictDefinitions(t *testing.T) {
+	strict := map[string]interface{}{"METRICS_STRICT": true}
+	pm, registry := newTestProm(t, strict,
+		Definition{Name: "requests", Labels: []string{"code"}},
+		Definition{Name: "latency", Unit: "seconds", Labels: []string{"route"}, Buckets: []float64{0.1, 1}},
+	)
+
+	assert.ErrorContains(t, pm.BumpCount("undefined", 1), "METRICS_STRICT requires a definition")
+	_, err := pm.BumpTime("undefined")
+	assert.ErrorContains(t, err, "METRICS_STRICT requires a definition")
+
+	require.NoError(t, pm.BumpCount("requests", 1, "code", "200"))
+	timer, err := pm.BumpTime("latency", "route", "/a")
+	require.NoError(t, err)
+	timer.End()
+	count, err := testutil.GatherAndCount(registry, "svc_requests", "svc_latency_seconds")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// an invalid or conflicting definition fails the start
+	for name, definitions := range map[string][]Definition{
+		"unknown type":  {{Name: "jobs", Type: "meter"}},
+		"invalid label": {{Name: "jobs", Labels: []string{"queue-name"}}},
+		"conflicting":   {{Name: "jobs", Labels: []string{"queue"}}, {Name: "jobs", Labels: []string{"worker"}}},
+	} {
+		_, err := NewProm(Params{
+			ServiceName: "svc",
+			Config:      newTestConfig(t, strict),
+			Definitions: definitions,
+			Registerer:  prometheus.NewRegistry(),
+		})
+		assert.Error(t, err, name)
+	}
+	_, err = NewProm(Params{
+		ServiceName: "svc",
+		Config:      newTestConfig(t, map[string]interface{}{"METRICS_STRICT": true, "METRICS_DEFINITIONS": []interface{}{"jobs"}}),
+		Registerer:  prometheus.NewRegistry(),
+	})
+	assert.ErrorContains(t, err, "invalid METRICS_DEFINITIONS")
+}
+
+func TestPromLenientDefinitions(t *testing.T) {
+	pm, registry := newTestProm(t, map[string]interface{}{"METRICS_DEFINITIONS": []interface{}{"jobs"}},
+		Definition{Name: "jobs", Type: "meter"},
+		Definition{Name: "requests", Labels: []string{"code"}},
+		Definition{Name: "requests", Labels: []string{"code", "method"}},
+	)
+
+	// an undefined metric takes the labels of its first use
+	require.NoError(t, pm.BumpCount("undefined", 1, "queue", "q"))
+	assert.ErrorContains(t, pm.BumpCount("undefined", 1, "worker", "w"), "labels [queue] are missing and [worker] are unexpected")
+
+	// broken definitions are skipped, and the last of conflicting ones is used
+	require.NoError(t, pm.BumpCount("jobs", 1))
+	require.NoError(t, pm.BumpCount("requests", 1, "code", "200", "method", "GET"))
+	assert.ErrorContains(t, pm.BumpCount("requests", 1, "code", "200"), "labels [method] are missing")
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP svc_requests
+# TYPE svc_requests counter
+svc_requests{code="200",method="GET"} 1
+`), "svc_requests"))
+}
+
+func TestPromLabelValidation(t *testing.T) {
+	pm, registry := newTestProm(t, nil, Definition{Name: "latency", Labels: []string{"route"}})
+
+	for name, tags := range map[string][]string{
+		"odd tags":      {"route"},
+		"invalid name":  {"route-name", "/a"},
+		"reserved name": {"__route", "/a"},
+		"given twice":   {"route", "/a", "route", "/b"},
+		"missing":       {},
+		"unexpected":    {"route", "/a", "code", "200"},
+	} {
+		assert.Error(t, pm.Observe("latency", time.Millisecond, tags...), name)
+		_, err := pm.BumpTime("latency", tags...)
+		assert.Error(t, err, "%s: the tags of a timer are checked when it starts", name)
+		_, err = pm.BumpTimeContext(context.Background(), "latency", tags...)
+		assert.Error(t, err, name)
+	}
+	count, err := testutil.GatherAndCount(registry, "svc_latency")
+	require.NoError(t, err)
+	assert.Zero(t, count)
+
+	// the end can only replace the values of the start tags, another label fails and is logged
+	timer, err := pm.BumpTime("latency", "route", "unknown")
+	require.NoError(t, err)
+	EndWith(timer, "route", "/a")
+	timer, err = pm.BumpTime("latency", "route", "/b")
+	require.NoError(t, err)
+	EndWith(timer, "code", "200")
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	routes := []string{}
+	for _, family := range families {
+		if family.GetName() == "svc_latency" {
+			for _, metric := range family.GetMetric() {
+				routes = append(routes, metric.GetLabel()[0].GetValue())
+			}
+		}
+	}
+	assert.Equal(t, []string{"/a"}, routes)
+
+	// a metric timed with Time has the status label, a plain timer without it is rejected up front
+	require.NoError(t, Time(pm, "job_duration", func() error { return nil }, "queue", "q"))
+	_, err = pm.BumpTime("job_duration", "queue", "q")
+	assert.ErrorContains(t, err, "labels [status] are missing")
+}
+
+func TestPromFoldsOverflowingSeries(t *testing.T) {
+	pm, registry := newTestProm(t, nil,
+		Definition{Name: "requests", Labels: []string{"code"}, MaxSeries: 2},
+		Definition{Name: "calls", Labels: []string{"command"}, AllowedValues: map[string][]string{"command": {"get", "set"}}},
+	)
+
+	for _, code := range []string{"200", "404", "500", "503", "200"} {
+		require.NoError(t, pm.BumpCount("requests", 1, "code", code))
+	}
+	for _, command := range []string{"get", "flushall", "set", "keys"} {
+		require.NoError(t, pm.BumpCount("calls", 1, "command", command))
+	}
+
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP svc_calls
+# TYPE svc_calls counter
+svc_calls{command="__overflow__"} 2
+svc_calls{command="get"} 1
+svc_calls{command="set"} 1
+# HELP svc_metrics_cardinality_overflow_total Uses of a metric folded into __overflow__ by the cardinality limits
+# TYPE svc_metrics_cardinality_overflow_total counter
+svc_metrics_cardinality_overflow_total{metric="calls"} 2
+svc_metrics_cardinality_overflow_total{metric="requests"} 2
+# HELP svc_requests
+# TYPE svc_requests counter
+svc_requests{code="200"} 2
+svc_requests{code="404"} 1
+svc_requests{code="__overflow__"} 2
+`), "svc_calls", "svc_requests", "svc_metrics_cardinality_overflow_total"))
+}
+
+func TestPromServiceSeriesLimit(t *testing.T) {
+	pm, registry := newTestProm(t, map[string]interface{}{"METRICS_MAX_SERIES": 50, "METRICS_MAX_SERIES_PER_METRIC": 0})
+
+	// the metrics race for the last series of the service, the limit still holds
+	wg := sync.WaitGroup{}
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				assert.NoError(t, pm.BumpCount("requests_"+strconv.Itoa(worker), 1, "id", strconv.Itoa(i)))
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, 50, pm.limits.seriesCount.Load())
+	overflowed := 0.0
+	names := []string{}
+	for worker := 0; worker < 8; worker++ {
+		overflowed += testutil.ToFloat64(pm.overflowCounter.WithLabelValues("requests_" + strconv.Itoa(worker)))
+		names = append(names, "svc_requests_"+strconv.Itoa(worker))
+	}
+	assert.Equal(t, 8*20-50.0, overflowed)
+	count, err := testutil.GatherAndCount(registry, names...)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, count, 50+8, "every metric has at most one overflow series beyond the limit")
+}
+
+func TestPromGaugeFuncLimits(t *testing.T) {
+	pm, registry := newTestProm(t, map[string]interface{}{"METRICS_MAX_SERIES": 3},
+		Definition{Name: "queue_size", Labels: []string{"queue"}, MaxSeries: 2, AllowedValues: map[string][]string{"queue": {"a", "b", "c"}}},
+	)
+	size := func() float64 { return 1 }
+
+	require.NoError(t, pm.RegisterGaugeFunc("queue_size", size, "queue", "a"))
+	assert.ErrorContains(t, pm.RegisterGaugeFunc("queue_size", size, "queue", "a"), "already registered")
+	assert.ErrorContains(t, pm.RegisterGaugeFunc("queue_size", size, "queue", "d"), "values of labels [queue] aren't allowed")
+	require.NoError(t, pm.RegisterGaugeFunc("queue_size", size, "queue", "b"))
+	assert.ErrorContains(t, pm.RegisterGaugeFunc("queue_size", size, "queue", "c"), "reached the series limit")
+
+	// gauge funcs count towards the limit of the service
+	require.NoError(t, pm.BumpCount("requests", 1, "code", "200"))
+	require.NoError(t, pm.BumpCount("requests", 1, "code", "500"))
+	assert.EqualValues(t, 3, pm.limits.seriesCount.Load())
+	assert.Equal(t, 2.0, testutil.ToFloat64(pm.overflowCounter.WithLabelValues("queue_size")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(pm.overflowCounter.WithLabelValues("requests")))
+
+	// a gauge func failing to register doesn't keep its series
+	registry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Namespace: "svc", Name: "temperature"}))
+	assert.Error(t, pm.RegisterGaugeFunc("temperature", size))
+	assert.EqualValues(t, 3, pm.limits.seriesCount.Load())
+}
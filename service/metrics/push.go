@@ -0,0 +1,183 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/smallhouse123/go-library/service/config"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_PUSH_INTERVAL = 15 // seconds
+	DEFAULT_PUSH_RETRIES  = 3
+	DEFAULT_PUSH_TIMEOUT  = 10 // seconds
+	DEFAULT_PUSH_BACKOFF  = 500 * time.Millisecond
+)
+
+var (
+	// PushModule pushes the metrics to a Pushgateway on a schedule and once more on stop,
+	// for jobs that exit before they're scraped
+	PushModule = fx.Options(fx.Provide(NewPusher), fx.Invoke(func(*Pusher) {}))
+)
+
+type PushParams struct {
+	fx.In
+
+	Lifecycle   fx.Lifecycle
+	ServiceName string `name:"serviceName"`
+	Config      config.Config
+	Metrics     Metrics
+	Gatherer    prometheus.Gatherer `optional:"true"`
+	Logger      *zap.Logger         `optional:"true"`
+}
+
+// Pusher sends the gathered metrics to a Pushgateway, replacing the ones of its job and grouping
+type Pusher struct {
+	pusher   *push.Pusher
+	url      string
+	job      string
+	interval time.Duration
+	retries  int
+	backoff  time.Duration
+	timeout  time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+	// the underlying pusher isn't safe for concurrent pushes
+	mutex sync.Mutex
+	sugar *zap.SugaredLogger
+}
+
+func NewPusher(p PushParams) (*Pusher, error) {
+	url := getConfigString(p.Config, "METRICS_PUSH_URL", "")
+	if url == "" {
+		return nil, errors.New("METRICS_PUSH_URL is required to push metrics")
+	}
+
+	// the otel and statsd backends send their metrics themselves, pushing the global registry
+	// would only send the runtime metrics, so a registry has to be given explicitly then
+	gatherer := p.Gatherer
+	if backend, ok := p.Metrics.(interface{ Gatherer() prometheus.Gatherer }); ok && backend.Gatherer() != nil {
+		gatherer = backend.Gatherer()
+	}
+	if gatherer == nil {
+		return nil, fmt.Errorf("the %T metrics backend has no prometheus registry to push, "+
+			"use METRICS_BACKEND prometheus or both, or provide a prometheus.Gatherer", p.Metrics)
+	}
+
+	pr := &Pusher{
+		url:      url,
+		job:      getConfigString(p.Config, "METRICS_PUSH_JOB", p.ServiceName),
+		interval: time.Duration(getConfigInt(p.Config, "METRICS_PUSH_INTERVAL", DEFAULT_PUSH_INTERVAL)) * time.Second,
+		retries:  getConfigInt(p.Config, "METRICS_PUSH_RETRIES", DEFAULT_PUSH_RETRIES),
+		backoff:  DEFAULT_PUSH_BACKOFF,
+		timeout:  time.Duration(getConfigInt(p.Config, "METRICS_PUSH_TIMEOUT", DEFAULT_PUSH_TIMEOUT)) * time.Second,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		sugar:    newMetricsLogger(p.Logger),
+	}
+	if pr.job == "" {
+		return nil, errors.New("METRICS_PUSH_JOB is required without a service name")
+	}
+
+	pr.pusher = push.New(url, pr.job).
+		Gatherer(gatherer).
+		Client(&http.Client{Timeout: pr.timeout})
+
+	// grouping labels tell the instances of a job apart, values are expanded from the environment,
+	// e.g. {pod: ${HOSTNAME}, env: prod}
+	if val, err := p.Config.Get("METRICS_PUSH_GROUPING"); err == nil {
+		grouping, err := parseConstLabels(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid METRICS_PUSH_GROUPING: %v", err)
+		}
+		names := make([]string, 0, len(grouping))
+		for name := range grouping {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			pr.pusher.Grouping(name, os.ExpandEnv(grouping[name]))
+		}
+	}
+
+	username := getConfigString(p.Config, "METRICS_PUSH_USERNAME", "")
+	password := getConfigString(p.Config, "METRICS_PUSH_PASSWORD", "")
+	if username != "" || password != "" {
+		pr.pusher.BasicAuth(username, password)
+	}
+
+	p.Lifecycle.Append(fx.Hook{
+		OnStart: pr.start,
+		OnStop:  pr.close,
+	})
+
+	return pr, nil
+}
+
+// start pushes every METRICS_PUSH_INTERVAL seconds, 0 only pushes on stop
+func (pr *Pusher) start(ctx context.Context) error {
+	if pr.interval <= 0 {
+		close(pr.done)
+		return nil
+	}
+
+	go func() {
+		defer close(pr.done)
+		ticker := time.NewTicker(pr.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := pr.Push(context.Background()); err != nil {
+					pr.sugar.Errorw("failed to push metrics", "url", pr.url, "job", pr.job, "err", err)
+				}
+			case <-pr.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// close stops the schedule and pushes the final values
+func (pr *Pusher) close(ctx context.Context) error {
+	close(pr.stop)
+	<-pr.done
+	return pr.Push(ctx)
+}
+
+// Push sends the metrics now, retrying failures with a doubling backoff until ctx is done
+func (pr *Pusher) Push(ctx context.Context) error {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	backoff := pr.backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = pr.pusher.PushContext(ctx); err == nil {
+			return nil
+		}
+		if attempt >= pr.retries {
+			break
+		}
+
+		pr.sugar.Warnw("retrying metrics push", "url", pr.url, "job", pr.job, "attempt", attempt+1, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("failed to push metrics: %v", err)
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("failed to push metrics after %d attempts: %v", pr.retries+1, err)
+}
@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/fx/fxtest"
+)
+
+// pushGateway records the pushes it gets, the first failures requests fail with a 500
+type pushGateway struct {
+	mu       sync.Mutex
+	failures int
+	requests []string
+}
+
+func (g *pushGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.requests = append(g.requests, r.Method+" "+r.URL.Path)
+	if len(g.requests) <= g.failures {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (g *pushGateway) Requests() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string{}, g.requests...)
+}
+
+func newTestPusher(t *testing.T, lifecycle *fxtest.Lifecycle, url string, values map[string]interface{}) *Pusher {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "jobs_total"})
+	registry.MustRegister(counter)
+	counter.Inc()
+
+	values["METRICS_PUSH_URL"] = url
+	pr, err := NewPusher(PushParams{
+		Lifecycle:   lifecycle,
+		ServiceName: "svc",
+		Config:      newTestConfig(t, values),
+		Metrics:     NewNop(),
+		Gatherer:    registry,
+	})
+	require.NoError(t, err)
+	pr.backoff = time.Millisecond
+	return pr
+}
+
+func TestPushPathHasJobAndGrouping(t *testing.T) {
+	gateway := &pushGateway{}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+	t.Setenv("TEST_POD", "pod-1")
+
+	pr := newTestPusher(t, fxtest.NewLifecycle(t), server.URL, map[string]interface{}{
+		"METRICS_PUSH_GROUPING": map[string]interface{}{"pod": "${TEST_POD}", "env": "prod"},
+	})
+	require.NoError(t, pr.Push(context.Background()))
+
+	// the pushgateway client orders the grouping labels as it likes
+	requests := gateway.Requests()
+	require.Len(t, requests, 1)
+	require.True(t, strings.HasPrefix(requests[0], "PUT /metrics/job/svc/"), requests[0])
+	segments := strings.Split(strings.TrimPrefix(requests[0], "PUT /metrics/job/svc/"), "/")
+	require.Len(t, segments, 4)
+	grouping := map[string]string{segments[0]: segments[1], segments[2]: segments[3]}
+	assert.Equal(t, map[string]string{"pod": "pod-1", "env": "prod"}, grouping)
+}
+
+func TestPushRetriesServerErrors(t *testing.T) {
+	gateway := &pushGateway{failures: 2}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	pr := newTestPusher(t, fxtest.NewLifecycle(t), server.URL, map[string]interface{}{"METRICS_PUSH_RETRIES": 3})
+	require.NoError(t, pr.Push(context.Background()))
+	assert.Len(t, gateway.Requests(), 3)
+
+	// retries run out
+	gateway = &pushGateway{failures: 10}
+	server = httptest.NewServer(gateway)
+	defer server.Close()
+
+	pr = newTestPusher(t, fxtest.NewLifecycle(t), server.URL, map[string]interface{}{"METRICS_PUSH_RETRIES": 1})
+	assert.ErrorContains(t, pr.Push(context.Background()), "after 2 attempts")
+	assert.Len(t, gateway.Requests(), 2)
+}
+
+func TestPushOnStop(t *testing.T) {
+	gateway := &pushGateway{}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	lifecycle := fxtest.NewLifecycle(t)
+	newTestPusher(t, lifecycle, server.URL, map[string]interface{}{"METRICS_PUSH_INTERVAL": 0})
+
+	lifecycle.RequireStart()
+	assert.Empty(t, gateway.Requests(), "an interval of 0 only pushes on stop")
+	lifecycle.RequireStop()
+	assert.Equal(t, []string{"PUT /metrics/job/svc"}, gateway.Requests())
+}
+
+func TestPushRequiresPrometheusRegistry(t *testing.T) {
+	cfg := newTestConfig(t, map[string]interface{}{"METRICS_PUSH_URL": "http://pushgateway:9091"})
+	sm, _ := newTestStatsd(t, map[string]interface{}{})
+	for _, backend := range []Metrics{NewNop(), sm, NewMulti(sm)} {
+		_, err := NewPusher(PushParams{Lifecycle: fxtest.NewLifecycle(t), ServiceName: "svc", Config: cfg, Metrics: backend})
+		assert.ErrorContains(t, err, "no prometheus registry to push", "%T", backend)
+	}
+
+	pm, registry := newTestProm(t, nil)
+	require.NoError(t, pm.BumpCount("jobs", 1))
+	for _, backend := range []Metrics{pm, NewMulti(sm, pm)} {
+		pr, err := NewPusher(PushParams{Lifecycle: fxtest.NewLifecycle(t), ServiceName: "svc", Config: cfg, Metrics: backend})
+		require.NoError(t, err, "%T", backend)
+		assert.NotNil(t, pr)
+	}
+	_, err := NewPusher(PushParams{Lifecycle: fxtest.NewLifecycle(t), ServiceName: "svc", Config: cfg, Metrics: sm, Gatherer: registry})
+	assert.NoError(t, err, "an explicit registry is pushed whatever the backend")
+}
@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/smallhouse123/go-library/service/config"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_SERVER_ADDR         = ":9090"
+	DEFAULT_SERVER_METRICS_PATH = "/metrics"
+	DEFAULT_READINESS_TIMEOUT   = 5 // seconds
+)
+
+var (
+	// ServerModule serves /metrics, /healthz and /readyz while the app runs
+	ServerModule = fx.Options(fx.Provide(NewServer), fx.Invoke(func(*Server) {}))
+)
+
+// ReadinessCheck reports whether a part of the service can take traffic, /readyz fails while any check does
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// ReadinessChecks adds checks to /readyz
+func ReadinessChecks(checks ...ReadinessCheck) fx.Option {
+	options := []fx.Option{}
+	for _, check := range checks {
+		check := check
+		options = append(options, fx.Supply(fx.Annotate(check, fx.ResultTags(`group:"readinessChecks"`))))
+	}
+	return fx.Options(options...)
+}
+
+type ServerParams struct {
+	fx.In
+
+	Lifecycle fx.Lifecycle
+	Config    config.Config
+	Metrics   Metrics
+	Gatherer  prometheus.Gatherer `optional:"true"`
+	Logger    *zap.Logger         `optional:"true"`
+	Checks    []ReadinessCheck    `group:"readinessChecks"`
+}
+
+// Server is the metrics HTTP server. Only /metrics is behind basic auth when it's configured,
+// so probes keep working.
+type Server struct {
+	addr     string
+	certFile string
+	keyFile  string
+	server   *http.Server
+	listener net.Listener
+	checks   []ReadinessCheck
+	timeout  time.Duration
+	ready    atomic.Bool
+	sugar    *zap.SugaredLogger
+}
+
+func NewServer(p ServerParams) (*Server, error) {
+	// the metrics of the service are served from its own registry when it has one
+	gatherer := p.Gatherer
+	if backend, ok := p.Metrics.(interface{ Gatherer() prometheus.Gatherer }); ok && backend.Gatherer() != nil {
+		gatherer = backend.Gatherer()
+	}
+	if gatherer == nil {
+		gatherer = prometheus.DefaultGatherer
+	}
+
+	s := &Server{
+		addr:     getConfigString(p.Config, "METRICS_SERVER_ADDR", DEFAULT_SERVER_ADDR),
+		certFile: getConfigString(p.Config, "METRICS_SERVER_TLS_CERT", ""),
+		keyFile:  getConfigString(p.Config, "METRICS_SERVER_TLS_KEY", ""),
+		checks:   p.Checks,
+		timeout:  time.Duration(getConfigInt(p.Config, "METRICS_SERVER_READINESS_TIMEOUT", DEFAULT_READINESS_TIMEOUT)) * time.Second,
+		sugar:    newMetricsLogger(p.Logger),
+	}
+	if (s.certFile == "") != (s.keyFile == "") {
+		return nil, errors.New("METRICS_SERVER_TLS_CERT and METRICS_SERVER_TLS_KEY must be set together")
+	}
+
+	// OpenMetrics is negotiated through the Accept header, it's the format exposing exemplars
+	var metricsHandler http.Handler = promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})
+	username := getConfigString(p.Config, "METRICS_SERVER_USERNAME", "")
+	password := getConfigString(p.Config, "METRICS_SERVER_PASSWORD", "")
+	if username != "" || password != "" {
+		metricsHandler = basicAuth(metricsHandler, username, password)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(getConfigString(p.Config, "METRICS_SERVER_PATH", DEFAULT_SERVER_METRICS_PATH), metricsHandler)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", s.serveReady)
+
+	s.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	p.Lifecycle.Append(fx.Hook{
+		OnStart: s.start,
+		OnStop:  s.stop,
+	})
+
+	return s, nil
+}
+
+// start loads the certificate and binds the address before returning, so a bad certificate or a port in use fails the start
+func (s *Server) start(ctx context.Context) error {
+	if s.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		if err != nil {
+			return fmt.Errorf("metrics server can't load its TLS certificate: %v", err)
+		}
+		s.server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("metrics server can't listen on %s: %v", s.addr, err)
+	}
+	s.listener = listener
+
+	go func() {
+		var err error
+		if s.server.TLSConfig != nil {
+			// the certificate is already loaded in TLSConfig
+			err = s.server.ServeTLS(listener, "", "")
+		} else {
+			err = s.server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.sugar.Errorw("metrics server stopped", "addr", s.addr, "err", err)
+		}
+	}()
+
+	s.ready.Store(true)
+	return nil
+}
+
+// stop reports not ready first, then waits for the requests in flight
+func (s *Server) stop(ctx context.Context) error {
+	s.ready.Store(false)
+	return s.server.Shutdown(ctx)
+}
+
+// Addr returns the address the server listens on, useful with port 0
+func (s *Server) Addr() string {
+	if s.listener == nil {
+		return s.addr
+	}
+	return s.listener.Addr().String()
+}
+
+func (s *Server) serveReady(w http.ResponseWriter, r *http.Request) {
+	if !s.ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.timeout)
+	defer cancel()
+
+	for _, check := range s.checks {
+		if err := check.Check(ctx); err != nil {
+			http.Error(w, fmt.Sprintf("%s: %v", check.Name, err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func basicAuth(next http.Handler, username, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func getConfigString(configService config.Config, key string, defaultValue string) string {
+	if val, err := configService.Get(key); err == nil {
+		if valStr, ok := val.(string); ok {
+			return valStr
+		}
+	}
+	return defaultValue
+}
+
+func getConfigInt(configService config.Config, key string, defaultValue int) int {
+	if val, err := configService.Get(key); err == nil {
+		if valInt, ok := val.(int); ok {
+			return valInt
+		}
+	}
+	return defaultValue
+}
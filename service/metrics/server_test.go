@@ -0,0 +1,173 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/smallhouse123/go-library/service/config/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/fx/fxtest"
+)
+
+// newTestConfig returns a config holding values, other keys are not found
+func newTestConfig(t *testing.T, values map[string]interface{}) *mocks.Config {
+	cfg := mocks.NewConfig(t)
+	cfg.On("Get", mock.Anything).Return(func(key string) (interface{}, error) {
+		if val, ok := values[key]; ok {
+			return val, nil
+		}
+		return nil, errors.New("not found")
+	}).Maybe()
+	cfg.On("OnChange", mock.Anything).Maybe()
+	return cfg
+}
+
+func TestServerFailsStartWithBadCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	require.NoError(t, os.WriteFile(certFile, []byte("not a certificate"), 0600))
+	require.NoError(t, os.WriteFile(keyFile, []byte("not a key"), 0600))
+
+	lifecycle := fxtest.NewLifecycle(t)
+	s, err := NewServer(ServerParams{
+		Lifecycle: lifecycle,
+		Config: newTestConfig(t, map[string]interface{}{
+			"METRICS_SERVER_ADDR":     "127.0.0.1:0",
+			"METRICS_SERVER_TLS_CERT": certFile,
+			"METRICS_SERVER_TLS_KEY":  keyFile,
+		}),
+		Metrics: NewNop(),
+	})
+	require.NoError(t, err)
+
+	err = lifecycle.Start(context.Background())
+	assert.ErrorContains(t, err, "TLS certificate")
+	assert.Nil(t, s.listener, "the port isn't bound")
+}
+
+// newTestServer returns a server of the metrics of pm, on a free local port, and its lifecycle
+func newTestServer(t *testing.T, values map[string]interface{}, pm *PromMetric, checks ...ReadinessCheck) (*Server, *fxtest.Lifecycle) {
+	values["METRICS_SERVER_ADDR"] = "127.0.0.1:0"
+	lifecycle := fxtest.NewLifecycle(t)
+	s, err := NewServer(ServerParams{
+		Lifecycle: lifecycle,
+		Config:    newTestConfig(t, values),
+		Metrics:   pm,
+		Checks:    checks,
+	})
+	require.NoError(t, err)
+	return s, lifecycle
+}
+
+// get sends a request to the handler of s and returns the response
+func get(s *Server, path string, setup func(r *http.Request)) (*http.Response, string) {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	if setup != nil {
+		setup(r)
+	}
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, r)
+	body, _ := io.ReadAll(w.Result().Body)
+	return w.Result(), string(body)
+}
+
+func TestServerNegotiatesFormat(t *testing.T) {
+	pm, _ := newTestProm(t, nil)
+	require.NoError(t, pm.BumpCount("requests", 1, "code", "200"))
+	s, _ := newTestServer(t, map[string]interface{}{}, pm)
+
+	res, body := get(s, "/metrics", nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.True(t, strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain; version=0.0.4"), res.Header.Get("Content-Type"))
+	assert.Contains(t, body, `svc_requests{code="200"} 1`)
+	assert.NotContains(t, body, "# EOF")
+
+	res, body = get(s, "/metrics", func(r *http.Request) {
+		r.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.True(t, strings.HasPrefix(res.Header.Get("Content-Type"), "application/openmetrics-text"), res.Header.Get("Content-Type"))
+	assert.Contains(t, body, `svc_requests{code="200"} 1.0`)
+	assert.True(t, strings.HasSuffix(body, "# EOF\n"))
+}
+
+func TestServerBasicAuth(t *testing.T) {
+	pm, _ := newTestProm(t, nil)
+	require.NoError(t, pm.BumpCount("requests", 1))
+	s, _ := newTestServer(t, map[string]interface{}{
+		"METRICS_SERVER_USERNAME": "prometheus",
+		"METRICS_SERVER_PASSWORD": "secret",
+		"METRICS_SERVER_PATH":     "/internal/metrics",
+	}, pm)
+
+	for name, setup := range map[string]func(r *http.Request){
+		"no credentials": nil,
+		"wrong password": func(r *http.Request) { r.SetBasicAuth("prometheus", "guess") },
+		"wrong username": func(r *http.Request) { r.SetBasicAuth("admin", "secret") },
+		"empty password": func(r *http.Request) { r.SetBasicAuth("prometheus", "") },
+		"bearer instead": func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") },
+	} {
+		res, _ := get(s, "/internal/metrics", setup)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode, name)
+		assert.Equal(t, `Basic realm="metrics"`, res.Header.Get("WWW-Authenticate"), name)
+	}
+
+	res, body := get(s, "/internal/metrics", func(r *http.Request) { r.SetBasicAuth("prometheus", "secret") })
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, body, "svc_requests 1")
+
+	// the probes aren't behind the auth
+	res, _ = get(s, "/healthz", nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestServerProbes(t *testing.T) {
+	pm, _ := newTestProm(t, nil)
+	var checkErr error
+	s, lifecycle := newTestServer(t, map[string]interface{}{}, pm, ReadinessCheck{
+		Name:  "database",
+		Check: func(ctx context.Context) error { return checkErr },
+	})
+
+	res, body := get(s, "/healthz", nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "ok\n", body)
+	res, body = get(s, "/readyz", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode, "not ready before the start")
+	assert.Equal(t, "not ready\n", body)
+
+	require.NoError(t, lifecycle.Start(context.Background()))
+	probe := func(path string) (int, string) {
+		res, err := http.Get("http://" + s.Addr() + path)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(body)
+	}
+	status, body := probe("/readyz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ok\n", body)
+	status, _ = probe("/healthz")
+	assert.Equal(t, http.StatusOK, status)
+
+	checkErr = errors.New("connection refused")
+	status, body = probe("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "database: connection refused\n", body)
+
+	checkErr = nil
+	require.NoError(t, lifecycle.Stop(context.Background()))
+	res, _ = get(s, "/readyz", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode, "not ready once stopped")
+}
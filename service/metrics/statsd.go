@@ -0,0 +1,462 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+const (
+	STATSD_FORMAT_STATSD    = "statsd"
+	STATSD_FORMAT_DOGSTATSD = "dogstatsd"
+
+	DEFAULT_STATSD_ADDR         = "127.0.0.1:8125"
+	DEFAULT_STATSD_MTU          = 1432 // bytes, fits an ethernet frame with the IP and UDP headers
+	DEFAULT_STATSD_FLUSH_PERIOD = 100  // milliseconds
+	DEFAULT_STATSD_GAUGE_PERIOD = 10   // seconds between reports of the gauge funcs
+)
+
+// StatsdMetric sends the metrics as StatsD or DogStatsD packets over UDP. Lines are batched up to the MTU
+// and flushed every METRICS_STATSD_FLUSH_PERIOD milliseconds and on Close. Tags are only sent with DogStatsD.
+type StatsdMetric struct {
+	prefix           string
+	dogstatsd        bool
+	conn             net.Conn
+	mtu              int
+	constTags        []string
+	sampleRate       float64
+	sampleRates      map[string]float64
+	flushPeriod      time.Duration
+	gaugePeriod      time.Duration
+	strict           bool
+	definitions      map[string]Definition
+	definitionsMutex sync.RWMutex
+	gauges           map[string]float64
+	gaugeFuncs       map[string]statsdGaugeFunc
+	gaugesMutex      sync.Mutex
+	buffer           []byte
+	bufferMutex      sync.Mutex
+	stop             chan struct{}
+	done             chan struct{}
+	closeOnce        sync.Once
+	sugar            *zap.SugaredLogger
+}
+
+type statsdGaugeFunc struct {
+	name string
+	tags []string
+	fn   func() float64
+}
+
+// NewStatsd returns the statsd metrics. METRICS_STATSD_SAMPLE_RATE samples counters, timings and summaries
+// on the client, METRICS_STATSD_SAMPLE_RATES overrides it per metric.
+func NewStatsd(p Params) (*StatsdMetric, error) {
+	s, err := loadSettings(p)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := DEFAULT_STATSD_ADDR
+	format := STATSD_FORMAT_DOGSTATSD
+	prefix := ""
+	if p.ServiceName != "" {
+		prefix = p.ServiceName + "."
+	}
+	mtu := DEFAULT_STATSD_MTU
+	flushPeriod := DEFAULT_STATSD_FLUSH_PERIOD
+	gaugePeriod := DEFAULT_STATSD_GAUGE_PERIOD
+	sampleRate := 1.0
+	sampleRates := map[string]float64{}
+	if p.Config != nil {
+		addr = getConfigString(p.Config, "METRICS_STATSD_ADDR", addr)
+		format = getConfigString(p.Config, "METRICS_STATSD_FORMAT", format)
+		prefix = getConfigString(p.Config, "METRICS_STATSD_PREFIX", prefix)
+		mtu = getConfigInt(p.Config, "METRICS_STATSD_MTU", mtu)
+		flushPeriod = getConfigInt(p.Config, "METRICS_STATSD_FLUSH_PERIOD", flushPeriod)
+		gaugePeriod = getConfigInt(p.Config, "METRICS_STATSD_GAUGE_PERIOD", gaugePeriod)
+		if val, err := p.Config.Get("METRICS_STATSD_SAMPLE_RATE"); err == nil {
+			rate, ok := toFloat(val)
+			if !ok || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("METRICS_STATSD_SAMPLE_RATE must be in (0, 1], got %v", val)
+			}
+			sampleRate = rate
+		}
+		if val, err := p.Config.Get("METRICS_STATSD_SAMPLE_RATES"); err == nil {
+			rateMap, ok := toStringMap(val)
+			if !ok {
+				return nil, errors.New("METRICS_STATSD_SAMPLE_RATES must be a map of metric to rate")
+			}
+			for key, rateVal := range rateMap {
+				rate, ok := toFloat(rateVal)
+				if !ok || rate <= 0 || rate > 1 {
+					return nil, fmt.Errorf("sample rate of %s must be in (0, 1], got %v", key, rateVal)
+				}
+				sampleRates[key] = rate
+			}
+		}
+	}
+	if format != STATSD_FORMAT_STATSD && format != STATSD_FORMAT_DOGSTATSD {
+		return nil, fmt.Errorf("unknown METRICS_STATSD_FORMAT '%s'", format)
+	}
+	if mtu <= 0 || flushPeriod <= 0 || gaugePeriod <= 0 {
+		return nil, errors.New("METRICS_STATSD_MTU, METRICS_STATSD_FLUSH_PERIOD and METRICS_STATSD_GAUGE_PERIOD must be positive")
+	}
+
+	// a connected UDP socket only resolves the address, nothing is sent yet
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial statsd at %s: %v", addr, err)
+	}
+
+	constTags := []string{}
+	for key, value := range s.constLabels {
+		constTags = append(constTags, key, value)
+	}
+	constTags = sortedTags(constTags)
+
+	sm := &StatsdMetric{
+		prefix:      prefix,
+		dogstatsd:   format == STATSD_FORMAT_DOGSTATSD,
+		conn:        conn,
+		mtu:         mtu,
+		constTags:   constTags,
+		sampleRate:  sampleRate,
+		sampleRates: sampleRates,
+		strict:      s.strict,
+		definitions: map[string]Definition{},
+		gauges:      map[string]float64{},
+		gaugeFuncs:  map[string]statsdGaugeFunc{},
+		buffer:      make([]byte, 0, mtu),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		sugar:       s.sugar,
+		flushPeriod: time.Duration(flushPeriod) * time.Millisecond,
+		gaugePeriod: time.Duration(gaugePeriod) * time.Second,
+	}
+
+	if err := s.defineAll(sm.Define); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go sm.run()
+
+	if p.Lifecycle != nil {
+		p.Lifecycle.Append(fx.Hook{
+			OnStop: func(ctx context.Context) error {
+				return sm.Close()
+			},
+		})
+	}
+
+	return sm, nil
+}
+
+// Define sets the help, unit and labels of a metric, the statsd backend has nothing to register
+func (sm *StatsdMetric) Define(definition Definition) error {
+	if err := definition.validate(); err != nil {
+		return err
+	}
+	sm.definitionsMutex.Lock()
+	sm.definitions[definition.Name] = definition
+	sm.definitionsMutex.Unlock()
+	return nil
+}
+
+// Close sends the gauge funcs and whatever is buffered, then closes the socket
+func (sm *StatsdMetric) Close() error {
+	var err error
+	sm.closeOnce.Do(func() {
+		close(sm.stop)
+		<-sm.done
+		sm.reportGaugeFuncs()
+		err = errors.Join(sm.Flush(), sm.conn.Close())
+	})
+	return err
+}
+
+func (sm *StatsdMetric) run() {
+	defer close(sm.done)
+
+	flushTicker := time.NewTicker(sm.flushPeriod)
+	defer flushTicker.Stop()
+	gaugeTicker := time.NewTicker(sm.gaugePeriod)
+	defer gaugeTicker.Stop()
+
+	for {
+		select {
+		case <-flushTicker.C:
+			if err := sm.Flush(); err != nil {
+				sm.sugar.Warnw("failed to send statsd packet", "err", err)
+			}
+		case <-gaugeTicker.C:
+			sm.reportGaugeFuncs()
+		case <-sm.stop:
+			return
+		}
+	}
+}
+
+// Flush sends the buffered lines now
+func (sm *StatsdMetric) Flush() error {
+	sm.bufferMutex.Lock()
+	defer sm.bufferMutex.Unlock()
+	return sm.flushLocked()
+}
+
+func (sm *StatsdMetric) flushLocked() error {
+	if len(sm.buffer) == 0 {
+		return nil
+	}
+	_, err := sm.conn.Write(sm.buffer)
+	sm.buffer = sm.buffer[:0]
+	return err
+}
+
+// send buffers lines in order, a packet is sent first when a line wouldn't fit in it
+func (sm *StatsdMetric) send(lines ...string) {
+	sm.bufferMutex.Lock()
+	defer sm.bufferMutex.Unlock()
+
+	for _, line := range lines {
+		if len(sm.buffer) > 0 && len(sm.buffer)+1+len(line) > sm.mtu {
+			if err := sm.flushLocked(); err != nil {
+				sm.sugar.Warnw("failed to send statsd packet", "err", err)
+			}
+		}
+		if len(sm.buffer) > 0 {
+			sm.buffer = append(sm.buffer, '\n')
+		}
+		sm.buffer = append(sm.buffer, line...)
+	}
+}
+
+// line formats a metric, like svc.requests:1|c|@0.5|#code:200
+func (sm *StatsdMetric) line(name string, value float64, metricType string, rate float64, tags []string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	b.WriteByte('|')
+	b.WriteString(metricType)
+	if rate < 1 {
+		b.WriteString("|@")
+		b.WriteString(strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+	if sm.dogstatsd && len(tags)+len(sm.constTags) > 0 {
+		b.WriteString("|#")
+		first := true
+		for _, pairs := range [][]string{sm.constTags, tags} {
+			for i := 0; i+1 < len(pairs); i += 2 {
+				if !first {
+					b.WriteByte(',')
+				}
+				first = false
+				b.WriteString(sanitizeStatsd(pairs[i]))
+				b.WriteByte(':')
+				b.WriteString(sanitizeStatsd(pairs[i+1]))
+			}
+		}
+	}
+	return b.String()
+}
+
+var statsdReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", ",", "_", "#", "_", "\n", "_")
+
+func sanitizeStatsd(s string) string {
+	return statsdReplacer.Replace(s)
+}
+
+func (sm *StatsdMetric) definition(key string, tags []string) (Definition, error) {
+	sm.definitionsMutex.RLock()
+	definition, ok := sm.definitions[key]
+	sm.definitionsMutex.RUnlock()
+	return resolveDefinition(definition, ok, sm.strict, key, tags)
+}
+
+// use checks tags against the labels of key and returns the name the metric is sent under
+func (sm *StatsdMetric) use(key string, tags []string) (string, error) {
+	if len(tags)%2 != 0 {
+		return "", fmt.Errorf("metric %s: tags must be a multiplier of 2", key)
+	}
+
+	definition, err := sm.definition(key, tags)
+	if err != nil {
+		return "", err
+	}
+	if _, err := checkLabels(definition.Labels, tags); err != nil {
+		return "", fmt.Errorf("metric %s: %v", key, err)
+	}
+	return sm.prefix + sanitizeStatsd(definition.exposedName(key)), nil
+}
+
+// sampled tells whether a use of key is sent, and at which rate
+func (sm *StatsdMetric) sampled(key string) (bool, float64) {
+	rate := sm.sampleRate
+	if keyRate, ok := sm.sampleRates[key]; ok {
+		rate = keyRate
+	}
+	return rate >= 1 || rand.Float64() < rate, rate
+}
+
+// BumpTime starts a timer sent as a timing when it ends. The tags are checked against the labels of
+// the metric right away, tags EndWith adds are checked at the end and a failing end is logged.
+func (sm *StatsdMetric) BumpTime(key string, tags ...string) (Endable, error) {
+	if _, err := sm.use(key, tags); err != nil {
+		return nil, err
+	}
+
+	return newTimer(tags, func(duration time.Duration, tags []string) {
+		if err := sm.Observe(key, duration, tags...); err != nil {
+			sm.sugar.Warnw("failed to observe timer", "metric", key, "err", err)
+		}
+	}), nil
+}
+
+// BumpTimeContext is BumpTime, statsd has no exemplars
+func (sm *StatsdMetric) BumpTimeContext(ctx context.Context, key string, tags ...string) (Endable, error) {
+	return sm.BumpTime(key, tags...)
+}
+
+func (sm *StatsdMetric) ObserveContext(ctx context.Context, key string, duration time.Duration, tags ...string) error {
+	return sm.Observe(key, duration, tags...)
+}
+
+// Observe sends the duration in milliseconds as a timing
+func (sm *StatsdMetric) Observe(key string, duration time.Duration, tags ...string) error {
+	name, err := sm.use(key, tags)
+	if err != nil {
+		return err
+	}
+	if ok, rate := sm.sampled(key); ok {
+		sm.send(sm.line(name, float64(duration)/float64(time.Millisecond), "ms", rate, tags))
+	}
+	return nil
+}
+
+func (sm *StatsdMetric) BumpCount(key string, val float64, tags ...string) error {
+	name, err := sm.use(key, tags)
+	if err != nil {
+		return err
+	}
+	if val < 0 {
+		return fmt.Errorf("metric %s: counters can't decrease, got %v", key, val)
+	}
+	if ok, rate := sm.sampled(key); ok {
+		sm.send(sm.line(name, val, "c", rate, tags))
+	}
+	return nil
+}
+
+func (sm *StatsdMetric) BumpCountContext(ctx context.Context, key string, val float64, tags ...string) error {
+	return sm.BumpCount(key, val, tags...)
+}
+
+func (sm *StatsdMetric) SetGauge(key string, val float64, tags ...string) error {
+	return sm.updateGauge(key, tags, func(float64) float64 { return val })
+}
+
+func (sm *StatsdMetric) AddGauge(key string, val float64, tags ...string) error {
+	return sm.updateGauge(key, tags, func(current float64) float64 { return current + val })
+}
+
+func (sm *StatsdMetric) SubGauge(key string, val float64, tags ...string) error {
+	return sm.updateGauge(key, tags, func(current float64) float64 { return current - val })
+}
+
+// updateGauge keeps the value and sends it whole, DogStatsD has no relative gauges
+func (sm *StatsdMetric) updateGauge(key string, tags []string, update func(current float64) float64) error {
+	name, err := sm.use(key, tags)
+	if err != nil {
+		return err
+	}
+
+	id := name + "\xff" + strings.Join(sortedTags(tags), "\xff")
+	sm.gaugesMutex.Lock()
+	value := update(sm.gauges[id])
+	sm.gauges[id] = value
+	sm.gaugesMutex.Unlock()
+
+	sm.send(sm.gaugeLines(name, value, tags)...)
+	return nil
+}
+
+// gaugeLines formats a gauge. Plain StatsD reads a signed value as a change, so a negative value follows a 0
+func (sm *StatsdMetric) gaugeLines(name string, value float64, tags []string) []string {
+	line := sm.line(name, value, "g", 1, tags)
+	if value < 0 && !sm.dogstatsd {
+		return []string{sm.line(name, 0, "g", 1, tags), line}
+	}
+	return []string{line}
+}
+
+// RegisterGaugeFunc registers fn once per key and tags, it's sent every METRICS_STATSD_GAUGE_PERIOD seconds
+func (sm *StatsdMetric) RegisterGaugeFunc(key string, fn func() float64, tags ...string) error {
+	name, err := sm.use(key, tags)
+	if err != nil {
+		return err
+	}
+
+	id := name + "\xff" + strings.Join(sortedTags(tags), "\xff")
+	sm.gaugesMutex.Lock()
+	defer sm.gaugesMutex.Unlock()
+	if _, ok := sm.gaugeFuncs[id]; ok {
+		return fmt.Errorf("gauge func %s is already registered with these tags", key)
+	}
+	sm.gaugeFuncs[id] = statsdGaugeFunc{name: name, tags: tags, fn: fn}
+	return nil
+}
+
+func (sm *StatsdMetric) reportGaugeFuncs() {
+	sm.gaugesMutex.Lock()
+	gaugeFuncs := make([]statsdGaugeFunc, 0, len(sm.gaugeFuncs))
+	for _, gaugeFunc := range sm.gaugeFuncs {
+		gaugeFuncs = append(gaugeFuncs, gaugeFunc)
+	}
+	sm.gaugesMutex.Unlock()
+
+	for _, gaugeFunc := range gaugeFuncs {
+		sm.send(sm.gaugeLines(gaugeFunc.name, gaugeFunc.fn(), gaugeFunc.tags)...)
+	}
+}
+
+// BumpSummary sends a DogStatsD histogram, or a timing with plain StatsD which has no histograms
+func (sm *StatsdMetric) BumpSummary(key string, val float64, tags ...string) error {
+	name, err := sm.use(key, tags)
+	if err != nil {
+		return err
+	}
+	metricType := "ms"
+	if sm.dogstatsd {
+		metricType = "h"
+	}
+	if ok, rate := sm.sampled(key); ok {
+		sm.send(sm.line(name, val, metricType, rate, tags))
+	}
+	return nil
+}
+
+// sortedTags returns the pairs of tags ordered by key, so the same labels given in another order match
+func sortedTags(tags []string) []string {
+	pairs := make([][2]string, 0, len(tags)/2)
+	for i := 0; i+1 < len(tags); i += 2 {
+		pairs = append(pairs, [2]string{tags[i], tags[i+1]})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+
+	sorted := make([]string, 0, len(tags))
+	for _, pair := range pairs {
+		sorted = append(sorted, pair[0], pair[1])
+	}
+	return sorted
+}
@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestStatsd returns a statsd backend sending to a local UDP listener, its flush period is long
+// so only a full packet or Close sends anything
+func newTestStatsd(t *testing.T, values map[string]interface{}) (*StatsdMetric, *net.UDPConn) {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	values["METRICS_STATSD_ADDR"] = listener.LocalAddr().String()
+	if _, ok := values["METRICS_STATSD_FLUSH_PERIOD"]; !ok {
+		values["METRICS_STATSD_FLUSH_PERIOD"] = int(time.Hour / time.Millisecond)
+	}
+	sm, err := NewStatsd(Params{ServiceName: "svc", Config: newTestConfig(t, values)})
+	require.NoError(t, err)
+	t.Cleanup(func() { sm.Close() })
+	return sm, listener
+}
+
+// readPackets returns the packets received until none comes for a while
+func readPackets(t *testing.T, listener *net.UDPConn) []string {
+	packets := []string{}
+	buf := make([]byte, 65536)
+	for {
+		require.NoError(t, listener.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		n, err := listener.Read(buf)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+func readLines(t *testing.T, listener *net.UDPConn) []string {
+	lines := []string{}
+	for _, packet := range readPackets(t, listener) {
+		lines = append(lines, strings.Split(packet, "\n")...)
+	}
+	return lines
+}
+
+func TestStatsdBatchesWithinMTU(t *testing.T) {
+	sm, listener := newTestStatsd(t, map[string]interface{}{"METRICS_STATSD_MTU": 64})
+
+	want := []string{}
+	for i := 0; i < 20; i++ {
+		require.NoError(t, sm.BumpCount("requests", 1, "code", "200"))
+		want = append(want, "svc.requests:1|c|#code:200")
+	}
+	require.NoError(t, sm.Close())
+
+	packets := readPackets(t, listener)
+	require.Greater(t, len(packets), 1)
+	lines := []string{}
+	for _, packet := range packets {
+		assert.LessOrEqual(t, len(packet), 64)
+		lines = append(lines, strings.Split(packet, "\n")...)
+	}
+	assert.Equal(t, want, lines, "no line is split or lost")
+}
+
+func TestStatsdFormat(t *testing.T) {
+	sm, listener := newTestStatsd(t, map[string]interface{}{
+		"METRICS_CONST_LABELS":        map[string]interface{}{"region": "tw"},
+		"METRICS_STATSD_SAMPLE_RATES": map[string]interface{}{"lookups": 0.5},
+	})
+
+	require.NoError(t, sm.BumpCount("requests", 2, "code", "200", "path", "/a:b|c"))
+	require.NoError(t, sm.Observe("latency", 1500*time.Microsecond))
+	require.NoError(t, sm.BumpSummary("size", 3))
+	for i := 0; i < 50; i++ {
+		require.NoError(t, sm.BumpCount("lookups", 1))
+	}
+	require.NoError(t, sm.Close())
+
+	lines := readLines(t, listener)
+	require.Greater(t, len(lines), 3, "some of the sampled lookups are sent")
+	assert.Equal(t, []string{
+		"svc.requests:2|c|#region:tw,code:200,path:/a_b_c",
+		"svc.latency:1.5|ms|#region:tw",
+		"svc.size:3|h|#region:tw",
+	}, lines[:3])
+	for _, line := range lines[3:] {
+		assert.Equal(t, "svc.lookups:1|c|@0.5|#region:tw", line)
+	}
+}
+
+func TestStatsdPlainFormat(t *testing.T) {
+	sm, listener := newTestStatsd(t, map[string]interface{}{"METRICS_STATSD_FORMAT": STATSD_FORMAT_STATSD})
+
+	require.NoError(t, sm.BumpCount("requests", 1, "code", "200"))
+	require.NoError(t, sm.BumpSummary("size", 3))
+	require.NoError(t, sm.SetGauge("temperature", 2))
+	require.NoError(t, sm.SubGauge("temperature", 7))
+	require.NoError(t, sm.RegisterGaugeFunc("balance", func() float64 { return -1.5 }))
+	require.NoError(t, sm.Close())
+
+	// tags are dropped, and a negative gauge is reset to 0 first so it isn't read as a change
+	assert.Equal(t, []string{
+		"svc.requests:1|c",
+		"svc.size:3|ms",
+		"svc.temperature:2|g",
+		"svc.temperature:0|g",
+		"svc.temperature:-5|g",
+		"svc.balance:0|g",
+		"svc.balance:-1.5|g",
+	}, readLines(t, listener))
+}
+
+func TestStatsdNegativeGaugeWithDogStatsD(t *testing.T) {
+	sm, listener := newTestStatsd(t, map[string]interface{}{})
+
+	require.NoError(t, sm.SetGauge("temperature", -5))
+	require.NoError(t, sm.Close())
+
+	assert.Equal(t, []string{"svc.temperature:-5|g"}, readLines(t, listener))
+}
+
+func TestStatsdCloseFlushes(t *testing.T) {
+	sm, listener := newTestStatsd(t, map[string]interface{}{})
+
+	require.NoError(t, sm.BumpCount("requests", 1))
+	assert.Empty(t, readPackets(t, listener), "nothing is sent before the flush")
+
+	require.NoError(t, sm.Close())
+	assert.Equal(t, []string{"svc.requests:1|c"}, readLines(t, listener))
+	assert.NoError(t, sm.Close(), "a second close does nothing")
+}
+
+func TestStatsdTimerChecksLabelsAtStart(t *testing.T) {
+	sm, listener := newTestStatsd(t, map[string]interface{}{})
+	require.NoError(t, sm.Define(Definition{Name: "latency", Labels: []string{"route"}}))
+
+	_, err := sm.BumpTime("latency")
+	assert.ErrorContains(t, err, "labels [route] are missing")
+	_, err = sm.BumpTime("latency", "route")
+	assert.ErrorContains(t, err, "multiplier of 2")
+
+	timer, err := sm.BumpTime("latency", "route", "unknown")
+	require.NoError(t, err)
+	EndWith(timer, "route", "/a")
+	require.NoError(t, sm.Close())
+
+	lines := readLines(t, listener)
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], "|ms|#route:/a")
+}
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// STATUS_LABEL tags the timings of Time with STATUS_SUCCESS or STATUS_ERROR
+	STATUS_LABEL   = "status"
+	STATUS_SUCCESS = "success"
+	STATUS_ERROR   = "error"
+)
+
+// timer observes the time since its start on its first end, later ends are no-ops
+type timer struct {
+	start    time.Time
+	tags     []string
+	observe  func(duration time.Duration, tags []string)
+	once     sync.Once
+	duration atomic.Int64
+	ended    atomic.Bool
+}
+
+// newTimer starts a timer, observe is called once with the duration and the tags of the start and the end
+func newTimer(tags []string, observe func(duration time.Duration, tags []string)) *timer {
+	return &timer{
+		start:   time.Now(),
+		tags:    tags,
+		observe: observe,
+	}
+}
+
+func (t *timer) End() {
+	t.EndWith()
+}
+
+func (t *timer) EndWith(tags ...string) time.Duration {
+	t.once.Do(func() {
+		duration := time.Since(t.start)
+		t.duration.Store(int64(duration))
+		t.ended.Store(true)
+
+		if t.observe != nil {
+			t.observe(duration, mergeTags(t.tags, tags))
+		}
+	})
+	return time.Duration(t.duration.Load())
+}
+
+// mergeTags returns the start tags with the values of the end tags, end tags the start lacks are appended
+func mergeTags(start, end []string) []string {
+	merged := make([]string, len(start), len(start)+len(end))
+	copy(merged, start)
+	for i := 0; i+1 < len(end); i += 2 {
+		replaced := false
+		for j := 0; j+1 < len(merged); j += 2 {
+			if merged[j] == end[i] {
+				merged[j+1] = end[i+1]
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, end[i], end[i+1])
+		}
+	}
+	if len(end)%2 != 0 {
+		merged = append(merged, end[len(end)-1])
+	}
+	return merged
+}
+
+func (t *timer) Elapsed() time.Duration {
+	if t.ended.Load() {
+		return time.Duration(t.duration.Load())
+	}
+	return time.Since(t.start)
+}
+
+// EndWith ends timer with tags replacing the values of the ones it started with, see TimedEndable.
+// It returns the measured duration, or 0 for an Endable reporting none, which is only ended.
+func EndWith(timer Endable, tags ...string) time.Duration {
+	if timed, ok := timer.(TimedEndable); ok {
+		return timed.EndWith(tags...)
+	}
+	timer.End()
+	return 0
+}
+
+// Time runs fn timed under key, tagged status=success or status=error by its result. The timer starts
+// with status=success, so the labels of key are checked before fn runs and have to include status:
+// a key also timed by BumpTime without the status label is rejected, by whichever of both comes second.
+// fn doesn't run when the timer can't be started, the error of the timer is returned then.
+func Time(m Metrics, key string, fn func() error, tags ...string) error {
+	startTags := make([]string, 0, len(tags)+2)
+	startTags = append(startTags, tags...)
+	timer, err := m.BumpTime(key, append(startTags, STATUS_LABEL, STATUS_SUCCESS)...)
+	if err != nil {
+		return fmt.Errorf("can't time %s: %w", key, err)
+	}
+
+	err = fn()
+	status := STATUS_SUCCESS
+	if err != nil {
+		status = STATUS_ERROR
+	}
+	EndWith(timer, STATUS_LABEL, status)
+	return err
+}
@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// plainTimer is an Endable from outside this package, it has no duration to report
+type plainTimer struct {
+	ends int
+}
+
+func (t *plainTimer) End() {
+	t.ends++
+}
+
+func TestTimerEndsOnce(t *testing.T) {
+	observed := []time.Duration{}
+	tags := [][]string{}
+	timer := newTimer([]string{"route", "/a"}, func(duration time.Duration, timerTags []string) {
+		observed = append(observed, duration)
+		tags = append(tags, timerTags)
+	})
+
+	var endable Endable = timer
+	_, ok := endable.(TimedEndable)
+	require.True(t, ok)
+
+	duration := timer.EndWith("status", "error")
+	timer.End()
+	assert.Equal(t, []time.Duration{duration}, observed)
+	assert.Equal(t, [][]string{{"route", "/a", "status", "error"}}, tags)
+	assert.Equal(t, duration, timer.Elapsed())
+}
+
+func TestTimerEndReplacesStartTags(t *testing.T) {
+	var tags []string
+	timer := newTimer([]string{"route", "/a", STATUS_LABEL, STATUS_SUCCESS}, func(_ time.Duration, timerTags []string) {
+		tags = timerTags
+	})
+	timer.EndWith(STATUS_LABEL, STATUS_ERROR, "code", "500")
+	assert.Equal(t, []string{"route", "/a", STATUS_LABEL, STATUS_ERROR, "code", "500"}, tags)
+}
+
+func TestMultiTimerEndsOutsideTimers(t *testing.T) {
+	plain := &plainTimer{}
+	timed := newTimer(nil, nil)
+	timers := multiTimer{plain, timed}
+
+	duration := timers.EndWith("status", "success")
+	assert.Equal(t, 1, plain.ends)
+	assert.Equal(t, timed.Elapsed(), duration, "the duration is the one of the first timer reporting it")
+	assert.Equal(t, duration, timers.Elapsed())
+}
+
+func TestEndWith(t *testing.T) {
+	plain := &plainTimer{}
+	assert.Zero(t, EndWith(plain, STATUS_LABEL, STATUS_ERROR))
+	assert.Equal(t, 1, plain.ends)
+
+	var tags []string
+	timed := newTimer([]string{STATUS_LABEL, STATUS_SUCCESS}, func(_ time.Duration, timerTags []string) {
+		tags = timerTags
+	})
+	duration := EndWith(timed, STATUS_LABEL, STATUS_ERROR)
+	assert.Equal(t, timed.Elapsed(), duration)
+	assert.Equal(t, []string{STATUS_LABEL, STATUS_ERROR}, tags)
+}
+
+func TestTime(t *testing.T) {
+	errFailed := errors.New("failed")
+	assert.ErrorIs(t, Time(NewNop(), "job", func() error { return errFailed }), errFailed)
+	assert.NoError(t, Time(NewNop(), "job", func() error { return nil }))
+}
+
+func TestTimeRejectsPlainTimers(t *testing.T) {
+	pm, registry := newTestProm(t, nil)
+	ran := 0
+	run := func() error {
+		ran++
+		return nil
+	}
+
+	// a key timed by BumpTime first can't be timed by Time, fn doesn't run
+	timer, err := pm.BumpTime("import_duration", "source", "csv")
+	require.NoError(t, err)
+	timer.End()
+	assert.ErrorContains(t, Time(pm, "import_duration", run, "source", "csv"), "labels [status] are unexpected")
+	assert.Zero(t, ran)
+
+	// and the other way around
+	require.NoError(t, Time(pm, "job_duration", run, "queue", "q"))
+	assert.EqualError(t, Time(pm, "job_duration", func() error { return errors.New("failed") }, "queue", "q"), "failed")
+	assert.Equal(t, 1, ran)
+	_, err = pm.BumpTime("job_duration", "queue", "q")
+	assert.ErrorContains(t, err, "labels [status] are missing")
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	statuses := []string{}
+	for _, family := range families {
+		if family.GetName() != "svc_job_duration" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == STATUS_LABEL {
+					statuses = append(statuses, label.GetValue())
+				}
+			}
+		}
+	}
+	assert.ElementsMatch(t, []string{STATUS_SUCCESS, STATUS_ERROR}, statuses)
+}
@@ -20,18 +20,15 @@ type Impl struct {
 	config config.Config
 }
 
-func New(name string, client *redis.Client, config config.Config) Redis {
-	logger, err := zap.NewProduction()
-	if err != nil {
-		panic(err)
+// New wraps client, a nil logger discards the logs
+func New(name string, client *redis.Client, config config.Config, logger *zap.Logger) Redis {
+	if logger == nil {
+		logger = zap.NewNop()
 	}
-
-	//TODO move logger to service
-	sugar := logger.Sugar()
 	return &Impl{
 		name:   name,
 		client: client,
-		sugar:  sugar,
+		sugar:  logger.Sugar(),
 		config: config,
 	}
 }
@@ -3,13 +3,11 @@ package redis
 import (
 	"context"
 	"errors"
-	"os"
 	"time"
 
 	"github.com/redis/go-redis/extra/rediscensus/v9"
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
 const (
@@ -70,26 +68,13 @@ type Redis interface {
 	HMGet(ctx context.Context, key string, fields []string, removeNil bool) (map[string]interface{}, error)
 }
 
-func ConnectRedisCluster(addr, username, password string) (*redis.ClusterClient, error) {
+// ConnectRedisCluster connects to the cluster at addr and panics if it can't be reached, a nil logger discards the logs
+func ConnectRedisCluster(addr, username, password string, logger *zap.Logger) (*redis.ClusterClient, error) {
 	ctx := context.Background()
-
-	config := zap.NewProductionConfig()
-	config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
-	config.Level = zap.NewAtomicLevelAt(zap.InfoLevel)
-	logger, err := config.Build()
-	if err != nil {
-		panic(err)
+	if logger == nil {
+		logger = zap.NewNop()
 	}
 	sugar := logger.Sugar()
-	defer func() {
-		if err := logger.Sync(); err != nil {
-			// catch path stdout/stderr bug of zap package
-			// https://github.com/uber-go/zap/issues/880
-			if _, ok := err.(*os.PathError); !ok {
-				logger.Error("logger sync failed, err")
-			}
-		}
-	}()
 
 	options := &redis.ClusterOptions{
 		Addrs:    []string{addr},
@@ -116,7 +101,7 @@ func ConnectRedisCluster(addr, username, password string) (*redis.ClusterClient,
 	rdb := redis.NewClusterClient(options)
 	rdb.AddHook(rediscensus.NewTracingHook())
 
-	_, err = rdb.Ping(ctx).Result()
+	_, err := rdb.Ping(ctx).Result()
 	if err != nil {
 		sugar.Errorw(
 			"fail to connect to redis cluster",
@@ -131,26 +116,13 @@ func ConnectRedisCluster(addr, username, password string) (*redis.ClusterClient,
 	return rdb, nil
 }
 
-func ConnectRedis(addr, username, password string) (*redis.Client, error) {
+// ConnectRedis connects to the server at addr and panics if it can't be reached, a nil logger discards the logs
+func ConnectRedis(addr, username, password string, logger *zap.Logger) (*redis.Client, error) {
 	ctx := context.Background()
-
-	config := zap.NewProductionConfig()
-	config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
-	config.Level = zap.NewAtomicLevelAt(zap.InfoLevel)
-	logger, err := config.Build()
-	if err != nil {
-		panic(err)
+	if logger == nil {
+		logger = zap.NewNop()
 	}
 	sugar := logger.Sugar()
-	defer func() {
-		if err := logger.Sync(); err != nil {
-			// catch path stdout/stderr bug of zap package
-			// https://github.com/uber-go/zap/issues/880
-			if _, ok := err.(*os.PathError); !ok {
-				logger.Error("logger sync failed, err")
-			}
-		}
-	}()
 
 	// Define Redis client options
 	options := &redis.Options{
@@ -168,7 +140,7 @@ func ConnectRedis(addr, username, password string) (*redis.Client, error) {
 	rdb := redis.NewClient(options)
 
 	// Ping the Redis server to check the connection
-	_, err = rdb.Ping(ctx).Result()
+	_, err := rdb.Ping(ctx).Result()
 	if err != nil {
 		sugar.Errorw(
 			"fail to connect to redis cluster",
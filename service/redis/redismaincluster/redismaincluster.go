@@ -5,21 +5,35 @@ import (
 	"github.com/smallhouse123/go-library/service/config"
 	redisService "github.com/smallhouse123/go-library/service/redis"
 	"go.uber.org/fx"
+	"go.uber.org/zap"
 )
 
 var (
 	Service = fx.Provide(NewRedisMainCluster)
 )
 
-func NewRedisMainCluster(config config.Config) redisService.Redis {
+type Params struct {
+	fx.In
+
+	Config config.Config
+	Logger *zap.Logger `optional:"true"`
+}
+
+func NewRedisMainCluster(p Params) redisService.Redis {
+	logger := p.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	logger = logger.Named("redis").With(zap.String("redis", "redisMainCluster"))
+
 	var client *redis.Client
-	addr, err := config.Get("ENVOY_REDIS_ADDRESS")
+	addr, err := p.Config.Get("ENVOY_REDIS_ADDRESS")
 	if err != nil {
 		return nil
 	}
-	client, err = redisService.ConnectRedis(addr.(string), "", "")
+	client, err = redisService.ConnectRedis(addr.(string), "", "", logger)
 	if err != nil {
 		return nil
 	}
-	return redisService.New("redisMainCluster", client, config)
+	return redisService.New("redisMainCluster", client, p.Config, logger)
 }